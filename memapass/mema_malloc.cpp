@@ -4,23 +4,74 @@
 #include "interception.h"
 typedef int64_t uptr;
 
+extern "C" {
+  void __mema_alloc(uptr pc, uptr addr, uptr size);
+  void __mema_free(uptr pc, uptr addr);
+}
+
+# define GET_CALLER_PC() (uptr)__builtin_return_address(0)
+
 DECLARE_REAL(void*, malloc, uptr)
 INTERCEPTOR(void*, malloc, uptr size) {
   void* addr = REAL(malloc)(size);
-  printf("Called malloc: size=%ld ptr=%p\n", size, addr);
+  if (addr)
+    __mema_alloc(GET_CALLER_PC(), (uptr)addr, size);
+  return addr;
+}
+
+// dlsym() calls calloc before the real calloc is known, so the first few
+// requests are served from here.
+static char early_calloc_pool[1024];
+static uptr early_calloc_used = 0;
+
+static bool is_early_calloc(void* addr) {
+  return (char*)addr >= early_calloc_pool &&
+         (char*)addr < early_calloc_pool + sizeof(early_calloc_pool);
+}
+
+DECLARE_REAL(void*, calloc, uptr, uptr)
+INTERCEPTOR(void*, calloc, uptr nmemb, uptr size) {
+  if (!REAL(calloc)) {
+    uptr n = (nmemb * size + 15) & ~15;
+    if (early_calloc_used + n > (uptr)sizeof(early_calloc_pool))
+      return NULL;
+    void* addr = early_calloc_pool + early_calloc_used;
+    early_calloc_used += n;
+    return addr;
+  }
+  void* addr = REAL(calloc)(nmemb, size);
+  if (addr)
+    __mema_alloc(GET_CALLER_PC(), (uptr)addr, nmemb * size);
+  return addr;
+}
+
+DECLARE_REAL(void*, realloc, void*, uptr)
+INTERCEPTOR(void*, realloc, void* ptr, uptr size) {
+  void* addr = REAL(realloc)(ptr, size);
+  // realloc is recorded as a free of the old object and a new allocation
+  if (addr || size == 0) {
+    if (ptr)
+      __mema_free(GET_CALLER_PC(), (uptr)ptr);
+    if (addr)
+      __mema_alloc(GET_CALLER_PC(), (uptr)addr, size);
+  }
   return addr;
 }
 
 DECLARE_REAL(void, free, void*)
 INTERCEPTOR(void, free, void* addr) {
-  // printf("Calling free: ptr=%p\n", addr);
+  if (is_early_calloc(addr))
+    return;
+  if (addr)
+    __mema_free(GET_CALLER_PC(), (uptr)addr);
   REAL(free)(addr);
 }
 
 namespace {
   void __attribute__((constructor)) init() {
     INTERCEPT_FUNCTION(malloc);
+    INTERCEPT_FUNCTION(calloc);
+    INTERCEPT_FUNCTION(realloc);
     INTERCEPT_FUNCTION(free);
   }
 };
-
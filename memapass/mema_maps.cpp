@@ -0,0 +1,91 @@
+// Interceptors for the calls which change the page table, so that the trace
+// can follow what is mapped where (see __mema_maps_changed). Anonymous data
+// mappings come and go with malloc, and don't change which binary an address
+// belongs to, so those changes are only noted (see __mema_maps_touched).
+
+#include <dlfcn.h>
+#include <stdarg.h>
+#include <sys/mman.h>
+#include <sys/syscall.h>
+#include <sys/types.h>
+#include <unistd.h>
+
+#include "interception.h"
+typedef int64_t uptr;
+
+extern "C" {
+  void __mema_maps_changed();
+  void __mema_maps_touched();
+}
+
+// mmap and munmap are used by the loader before our constructor has run, in
+// which case they go straight to the kernel.
+
+DECLARE_REAL(void*, mmap, void*, size_t, int, int, int, off_t)
+INTERCEPTOR(void*, mmap, void* addr, size_t length, int prot, int flags,
+            int fd, off_t offset) {
+  if (!REAL(mmap))
+    return (void*)syscall(SYS_mmap, addr, length, prot, flags, fd, offset);
+  void* result = REAL(mmap)(addr, length, prot, flags, fd, offset);
+  if (result != MAP_FAILED) {
+    if (!(flags & MAP_ANONYMOUS) || (prot & PROT_EXEC))
+      __mema_maps_changed();
+    else
+      __mema_maps_touched();
+  }
+  return result;
+}
+
+DECLARE_REAL(int, munmap, void*, size_t)
+INTERCEPTOR(int, munmap, void* addr, size_t length) {
+  if (!REAL(munmap))
+    return syscall(SYS_munmap, addr, length);
+  int result = REAL(munmap)(addr, length);
+  if (result == 0)
+    __mema_maps_touched();
+  return result;
+}
+
+// new_address is only passed with MREMAP_FIXED
+DECLARE_REAL(void*, mremap, void*, size_t, size_t, int, ...)
+INTERCEPTOR(void*, mremap, void* old_address, size_t old_size,
+            size_t new_size, int flags, ...) {
+  void* new_address = NULL;
+  if (flags & MREMAP_FIXED) {
+    va_list ap;
+    va_start(ap, flags);
+    new_address = va_arg(ap, void*);
+    va_end(ap);
+  }
+  void* result = REAL(mremap)(old_address, old_size, new_size, flags,
+                              new_address);
+  if (result != MAP_FAILED)
+    __mema_maps_touched();
+  return result;
+}
+
+DECLARE_REAL(void*, dlopen, const char*, int)
+INTERCEPTOR(void*, dlopen, const char* filename, int flag) {
+  void* result = REAL(dlopen)(filename, flag);
+  if (result)
+    __mema_maps_changed();
+  return result;
+}
+
+DECLARE_REAL(int, dlclose, void*)
+INTERCEPTOR(int, dlclose, void* handle) {
+  int result = REAL(dlclose)(handle);
+  if (result == 0)
+    __mema_maps_changed();
+  return result;
+}
+
+namespace {
+  void __attribute__((constructor)) init() {
+    INTERCEPT_FUNCTION(mmap);
+    INTERCEPT_FUNCTION(munmap);
+    INTERCEPT_FUNCTION(mremap);
+    INTERCEPT_FUNCTION(dlopen);
+    INTERCEPT_FUNCTION(dlclose);
+  }
+};
@@ -19,6 +19,7 @@
 #include <cxxabi.h>
 
 #include <pthread.h>
+#include <sys/syscall.h>
 
 #include "lz4.h"
 
@@ -44,11 +45,15 @@ static Flags mema_flags;
 # define GET_CALLER_PC() (uptr)__builtin_return_address(0)
 # define GET_CURRENT_FRAME() (uptr)__builtin_frame_address(0)
 
+// bp and sp describe the frame of the instrumented function which called us:
+// its frame pointer, and its stack pointer at the call (just above our return
+// address). The instrumented program needs -fno-omit-frame-pointer for bp.
+# define GET_CALLER_FRAME() (uptr)__builtin_frame_address(1)
+
 #define GET_CALLER_PC_BP_SP \
-  uptr bp = GET_CURRENT_FRAME();              \
+  uptr bp = GET_CALLER_FRAME();               \
   uptr pc = GET_CALLER_PC();                  \
-  uptr local_stack;                           \
-  uptr sp = (uptr)&local_stack
+  uptr sp = GET_CURRENT_FRAME() + 2 * sizeof(uptr)
   
 Flags *flags() {
   return &mema_flags;
@@ -141,9 +146,17 @@ void InitializeFlags(Flags *f, const char *env) {
 enum MemaRecordType {
   MEMA_ACCESS = 0,
   MEMA_FUNC_ENTER = 1,
-  MEMA_FUNC_EXIT = 2
+  MEMA_FUNC_EXIT = 2,
+  MEMA_ALLOC = 3,
+  MEMA_FREE = 4,
+  MEMA_THREAD = 5,
+  MEMA_MAPS = 6,
+  MEMA_MAPS_TEXT = 7
 };
 
+// Bytes of /proc/self/maps text carried by each MEMA_MAPS_TEXT record
+const unsigned int maps_text_per_record = 48;
+
 typedef struct {
   MemaRecordType type;
   union {
@@ -151,10 +164,30 @@ typedef struct {
       double time;
       uptr pc, bp, sp, addr;
       bool is_write;
+      // In bytes, or 0 if unknown (memset and friends, or wider than 255)
+      unsigned char size;
     } acc;
     struct {
       uptr addr;
+      // On enter, the return address of the instrumented function
+      uptr ret;
     } func;
+    struct {
+      double time;
+      // pc is the return address into the caller of malloc/free
+      uptr pc, addr, size;
+    } heap;
+    struct {
+      uptr tid;
+    } thread;
+    struct {
+      double time;
+      // Length of the text in the MEMA_MAPS_TEXT records which follow
+      uptr size;
+    } maps;
+    struct {
+      char text[maps_text_per_record];
+    } maps_text;
   };
 } MemAccess;
 
@@ -195,6 +228,26 @@ static std::set<uptr> monitor_func_addresses;
 static __thread bool monitor_func = false;
 static __thread int monitor_func_entry_count = 0;
 
+// Buffers are flushed as whole blocks, and the blocks of different threads
+// are interleaved in the file. Each block starts with a record saying which
+// thread it came from.
+static void __mema_reset_buffer() {
+  next_free_mem_access = &mem_accesses[0];
+
+  MemAccess & f = *(next_free_mem_access++);
+  f.type = MEMA_THREAD;
+  f.thread.tid = syscall(SYS_gettid);
+}
+
+extern "C" void __mema_maps_changed();
+// Set when the page table may have changed since the last snapshot (see
+// __mema_maps_touched)
+static bool maps_pending = false;
+// Set while this thread writes a snapshot, which may flush the buffer part
+// way through. That flush mustn't start another snapshot: it would wait for
+// maps_mutex, which this thread holds, and overwrite maps_buffer.
+static __thread bool in_maps_snapshot = false;
+
 // This function can be run in multiple threads simultaneously.
 void __mema_empty_buffer() {
 
@@ -202,7 +255,7 @@ void __mema_empty_buffer() {
 
   if (memaccess_fd == -1) {
     // We're not currently writing, just reset the buffer.
-    next_free_mem_access = &mem_accesses[0];
+    __mema_reset_buffer();
     return;
   }
 
@@ -275,8 +328,11 @@ void __mema_empty_buffer() {
              uncompressed_size);
   }
     
-  next_free_mem_access = &mem_accesses[0];
+  __mema_reset_buffer();
   inside_mema = false;
+
+  if (!in_maps_snapshot && __atomic_load_n(&maps_pending, __ATOMIC_RELAXED))
+    __mema_maps_changed();
 }
 
 extern "C" {
@@ -313,6 +369,8 @@ void __mema_function_entry(uptr addr) {
   f.type = MEMA_FUNC_ENTER;
   //f.acc.pc = pc; f.acc.bp = bp; f.acc.sp = sp;
   f.func.addr = addr;
+  // Needs the frame pointer, like bp
+  f.func.ret = (uptr)__builtin_return_address(1);
   
   // Round-robbin buffer
   if (next_free_mem_access == last_mem_access) {
@@ -354,9 +412,9 @@ void __mema_function_exit(uptr addr) {
   }
 }
 
+// `size` is in bits, as the pass gives it, truncated to 8 bits
 void __mema_access(uptr addr, char size, bool is_write) {
   
-  // TODO: something with the size variable?
   GET_CALLER_PC_BP_SP;
 
   if (inside_mema || !mema_initialized || flags()->disable) return;
@@ -371,6 +429,7 @@ void __mema_access(uptr addr, char size, bool is_write) {
   f.acc.pc = pc; f.acc.bp = bp; f.acc.sp = sp;
   f.acc.addr = addr;
   f.acc.is_write = is_write;
+  f.acc.size = (unsigned char)size / 8;
   
   // Round-robbin buffer
   if (next_free_mem_access == last_mem_access) {
@@ -378,6 +437,111 @@ void __mema_access(uptr addr, char size, bool is_write) {
   }
 }
 
+static void __mema_heap_event(MemaRecordType type, uptr pc, uptr addr, uptr size) {
+  if (inside_mema || !mema_initialized || flags()->disable) return;
+  if (!flags()->filename) return;
+
+  struct timeval tv;
+  gettimeofday(&tv, NULL);
+
+  MemAccess & f = *(next_free_mem_access++);
+  f.type = type;
+  f.heap.time = tv.tv_sec + (0.000001 * tv.tv_usec);
+  f.heap.pc = pc;
+  f.heap.addr = addr;
+  f.heap.size = size;
+
+  // Round-robbin buffer
+  if (next_free_mem_access == last_mem_access) {
+    __mema_empty_buffer();
+  }
+}
+
+// Big enough for the page table of most processes, larger ones are truncated
+static char maps_buffer[1024*1024];
+static pthread_mutex_t maps_mutex = PTHREAD_MUTEX_INITIALIZER;
+
+// Notes a change to the page table which doesn't need a snapshot straight
+// away (munmap, mremap, anonymous mmap). The next block to be written starts
+// with one, so the page table is read at most once per block for these.
+void __mema_maps_touched() {
+  __atomic_store_n(&maps_pending, true, __ATOMIC_RELAXED);
+}
+
+// Writes a snapshot of /proc/self/maps into this thread's buffer: a
+// MEMA_MAPS record followed by the text in MEMA_MAPS_TEXT records, all in one
+// block. The buffer is flushed first if the snapshot wouldn't fit.
+static void __mema_write_maps() {
+  Lock l(&maps_mutex);
+  in_maps_snapshot = true;
+  __atomic_store_n(&maps_pending, false, __ATOMIC_RELAXED);
+
+  // PORTABILITY
+  uptr size = 0;
+  int maps_fd = open("/proc/self/maps", O_RDONLY);
+  if (maps_fd != -1) {
+    int bytes_read;
+    do {
+      bytes_read = read(maps_fd, maps_buffer + size, sizeof(maps_buffer) - size);
+      if (bytes_read > 0)
+        size += bytes_read;
+    } while (bytes_read > 0 && size < (uptr)sizeof(maps_buffer));
+    close(maps_fd);
+  }
+
+  const uptr n_text = (size + maps_text_per_record - 1) / maps_text_per_record;
+  if ((uptr)(last_mem_access - next_free_mem_access) < n_text + 1) {
+    __mema_empty_buffer();
+    inside_mema = true;
+  }
+
+  struct timeval tv;
+  gettimeofday(&tv, NULL);
+
+  MemAccess & f = *(next_free_mem_access++);
+  f.type = MEMA_MAPS;
+  f.maps.time = tv.tv_sec + (0.000001 * tv.tv_usec);
+  f.maps.size = size;
+
+  for (uptr i = 0; i < n_text; i++) {
+    MemAccess & t = *(next_free_mem_access++);
+    t.type = MEMA_MAPS_TEXT;
+    uptr offset = i * maps_text_per_record;
+    uptr n = size - offset;
+    if (n > maps_text_per_record)
+      n = maps_text_per_record;
+    memset(t.maps_text.text, 0, maps_text_per_record);
+    memcpy(t.maps_text.text, maps_buffer + offset, n);
+  }
+
+  in_maps_snapshot = false;
+}
+
+// Records a new snapshot of /proc/self/maps, called after anything which may
+// have changed which binary an address belongs to (file-backed or executable
+// mmap, dlopen, dlclose), and after writing a block if the page table was
+// touched in the meantime (see __mema_maps_touched).
+void __mema_maps_changed() {
+  if (inside_mema || !mema_initialized || flags()->disable) return;
+  if (!flags()->filename) return;
+
+  inside_mema = true;
+  __mema_write_maps();
+  inside_mema = false;
+
+  // With maps_mutex released, so that this may take the next snapshot
+  if (next_free_mem_access == last_mem_access) {
+    __mema_empty_buffer();
+  }
+}
+
+void __mema_alloc(uptr pc, uptr addr, uptr size) {
+  __mema_heap_event(MEMA_ALLOC, pc, addr, size);
+}
+
+void __mema_free(uptr pc, uptr addr) {
+  __mema_heap_event(MEMA_FREE, pc, addr, 0);
+}
 
 void __mema_finalize() {
   //if (flags()->disable) return;
@@ -462,7 +626,10 @@ void __mema_write_initial_maps(int fd) {
 void __mema_write_header(int fd) {
   printf("Will write memaccess data to %s..\n", flags()->filename);
 
-  write(memaccess_fd, "MEMACCES", 8); // magic bytes
+  // Magic bytes, which also give the format version: "MEMACCES" was version 1,
+  // whose bp and sp were the runtime's own frame, and "MEMACCv2" version 2,
+  // which didn't record acc.size or func.ret
+  write(memaccess_fd, "MEMACCv3", 8);
   total_uncompressed_size += 8;
   total_compressed_size += 8;
 
@@ -486,8 +653,8 @@ static void __mema_thread_starting() {
   pthread_key_create(&thread_destructor_key, __mema_pthread_finishing);
 
   first_mem_access = &mem_accesses[0];
-  next_free_mem_access = first_mem_access;
   last_mem_access = &mem_accesses[mem_accesses_bufsize - 1];
+  __mema_reset_buffer();
 }
 
 void __mema_initialize_thread_hooking() {
@@ -504,8 +671,8 @@ void __mema_initialize() {
   mema_initialized = true;
 
   first_mem_access = &mem_accesses[0];
-  next_free_mem_access = first_mem_access;
   last_mem_access = &mem_accesses[mem_accesses_bufsize - 1];
+  __mema_reset_buffer();
 
   // NOTE: this doesn't work. We probably have to interpose our own pthread_create.
   __mema_initialize_thread_hooking();
@@ -0,0 +1,141 @@
+// annotate.go: printing source files with the number of reads and writes
+//              made by each line in the margin
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+)
+
+var annotate_files = flag.String("files", "",
+	"regexp selecting which source files to annotate (default all)")
+
+type SourceFileCounts struct {
+	File  string
+	Total AccessCounts
+	Lines map[int]*AccessCounts
+}
+
+type SourceFilesByTotal []*SourceFileCounts
+
+func (p SourceFilesByTotal) Len() int { return len(p) }
+func (p SourceFilesByTotal) Less(i, j int) bool {
+	return p[i].Total.Total() > p[j].Total.Total()
+}
+func (p SourceFilesByTotal) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+
+// Counts accesses per source line, attributing each to the innermost
+// (possibly inlined) location of its pc
+func (data *ProgramData) CountSourceLines() ([]*SourceFileCounts, AccessCounts) {
+	pcs := make(map[uint64]*AccessCounts)
+	data.ForEachRecord(func(index int64, r *Record) {
+		if r.Type != MEMA_ACCESS {
+			return
+		}
+		a := r.MemAccess()
+		c, ok := pcs[a.Pc]
+		if !ok {
+			c = &AccessCounts{}
+			pcs[a.Pc] = c
+		}
+		c.Add(a)
+		c.Last = index
+	})
+
+	files := make(map[string]*SourceFileCounts)
+	var unknown AccessCounts
+	for pc, c := range pcs {
+		locations := data.GetSourceLocationsAt(CallSite(pc), c.Last)
+		if len(locations) == 0 || locations[0].Line == 0 {
+			unknown.Reads += c.Reads
+			unknown.Writes += c.Writes
+			continue
+		}
+		loc := &locations[0]
+		f, ok := files[loc.File]
+		if !ok {
+			f = &SourceFileCounts{File: loc.File, Lines: make(map[int]*AccessCounts)}
+			files[loc.File] = f
+		}
+		l, ok := f.Lines[loc.Line]
+		if !ok {
+			l = &AccessCounts{}
+			f.Lines[loc.Line] = l
+		}
+		l.Reads += c.Reads
+		l.Writes += c.Writes
+		f.Total.Reads += c.Reads
+		f.Total.Writes += c.Writes
+	}
+
+	result := make([]*SourceFileCounts, 0, len(files))
+	for _, f := range files {
+		result = append(result, f)
+	}
+	sort.Sort(SourceFilesByTotal(result))
+	return result, unknown
+}
+
+func (f *SourceFileCounts) Print() {
+	fmt.Printf("=== %s: %d reads, %d writes\n", f.File, f.Total.Reads, f.Total.Writes)
+
+	margin := func(n int) string {
+		c, ok := f.Lines[n]
+		if !ok {
+			return fmt.Sprintf("%10s %10s", "", "")
+		}
+		return fmt.Sprintf("%10d %10d", c.Reads, c.Writes)
+	}
+
+	fd, err := os.Open(f.File)
+	if err != nil {
+		// No source to hand, just list the lines
+		lines := make([]int, 0, len(f.Lines))
+		for n := range f.Lines {
+			lines = append(lines, n)
+		}
+		sort.Ints(lines)
+		for _, n := range lines {
+			fmt.Printf("%s %6d\n", margin(n), n)
+		}
+		fmt.Println()
+		return
+	}
+	defer fd.Close()
+
+	scanner := bufio.NewScanner(fd)
+	for n := 1; scanner.Scan(); n++ {
+		fmt.Printf("%s %6d  %s\n", margin(n), n, scanner.Text())
+	}
+	fmt.Println()
+}
+
+// The "annotate" action
+func (data *ProgramData) Annotate() {
+	var filter *regexp.Regexp
+	if *annotate_files != "" {
+		var err error
+		filter, err = regexp.Compile(*annotate_files)
+		if err != nil {
+			log.Fatalf("Bad -files regexp: %v", err)
+		}
+	}
+
+	files, unknown := data.CountSourceLines()
+
+	fmt.Printf("%10s %10s\n", "reads", "writes")
+	for _, f := range files {
+		if filter != nil && !filter.MatchString(f.File) {
+			continue
+		}
+		f.Print()
+	}
+	fmt.Printf("%d reads, %d writes without line information\n",
+		unknown.Reads, unknown.Writes)
+}
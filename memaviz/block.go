@@ -4,9 +4,9 @@ import (
 	"image"
 	// "image/color"
 	"log"
-	"runtime"
 	"sort"
 	"sync"
+	"unsafe"
 
 	"github.com/JohannesEbke/go-stree/stree"
 
@@ -24,21 +24,49 @@ type Block struct {
 	quiet_pages, active_pages, display_active_pages map[uint64]bool
 	n_pages_to_left, n_inactive_to_left             map[uint64]uint64
 	stack_stree                                     *stree.Tree
+	calls                                           []CallInterval
+	// Accesses binned for the minimap, see minimap.go
+	density []uint32
 
 	tex *glh.Texture
 	img *image.RGBA
 
-	full_data   *ProgramData
-	file_offset int64
+	full_data    *ProgramData
+	file_offset  int64
+	first_record int64
+	// Earliest and latest record times, both zero if no record has one
+	start_time, end_time float64
 
 	requests struct {
 		texture, vertices sync.Once
 	}
-	// Texture
+	// Memory held, see blockcache.go
+	usage blockUsage
 }
 
 const WIDTH = 4.25
 
+// Memory held by the summaries of the block's records, see BLOCK_SUMMARY
+func (block *Block) summaryBytes() int64 {
+	return int64(len(block.calls))*int64(unsafe.Sizeof(CallInterval{})) +
+		int64(len(block.density))*4
+}
+
+func (block *Block) FindTimeRange() {
+	for i := range block.records {
+		t, ok := block.records[i].Time()
+		if !ok {
+			continue
+		}
+		if block.start_time == 0 || t < block.start_time {
+			block.start_time = t
+		}
+		if t > block.end_time {
+			block.end_time = t
+		}
+	}
+}
+
 func (block *Block) ActiveRegionIDs() {
 	page_activity := make(map[uint64]uint)
 
@@ -122,8 +150,14 @@ func (block *Block) ActiveRegionIDs() {
 }
 
 func (block *Block) BuildTexture() {
+	if block.tex != nil || block.vertex_data == nil {
+		// Evicted before we got here, Draw will ask again
+		return
+	}
 	block.tex = glh.NewTexture(1024, 256)
 	block.tex.Init()
+	// Both mipmap levels
+	block_cache.Account(block, BLOCK_TEXTURE, int64(block.tex.W*block.tex.H*4)*5/4)
 
 	// TODO: use runtime.SetFinalizer() to clean up/delete the texture?
 	glh.With(block.tex, func() {
@@ -189,8 +223,7 @@ func (block *Block) BuildTexture() {
 
 	//block.img = block.tex.AsImage()
 	if !block.detail_needed {
-		block.vertex_data = nil
-		runtime.GC()
+		block.dropVertices()
 	}
 
 	blocks_rendered++
@@ -215,6 +248,26 @@ func (block *Block) RequestTexture() {
 	})
 }
 
+// Frees the texture, vertices and cached records of the block, which are
+// loaded again when next needed. Only called on the main thread.
+func (block *Block) Evict() {
+	block.full_data.dropCachedRecords(block)
+	if block.tex != nil {
+		block.tex.Delete()
+		block.tex = nil
+		block_cache.Account(block, BLOCK_TEXTURE, 0)
+	}
+	block.dropVertices()
+}
+
+func (block *Block) dropVertices() {
+	if block.vertex_data != nil {
+		block.vertex_data.Release()
+		block.vertex_data = nil
+	}
+	block_cache.Account(block, BLOCK_VERTICES, 0)
+}
+
 func (block *Block) RequestVertices() {
 	block.requests.vertices.Do(func() {
 		// This request is processed by the file reading go-routine
@@ -223,8 +276,14 @@ func (block *Block) RequestVertices() {
 }
 
 func (block *Block) Draw(start, N int64, detailed bool) {
+	block_cache.Viewed(block)
 	if block.tex == nil {
-		block.RequestTexture()
+		// The texture is drawn from the vertices, which may have been evicted
+		if block.vertex_data == nil {
+			block.RequestVertices()
+		} else {
+			block.RequestTexture()
+		}
 	}
 
 	switch detailed {
@@ -318,7 +377,7 @@ func (block *Block) Draw(start, N int64, detailed bool) {
 			if block.vertex_data != nil && !block.detail_needed {
 				// TODO: figure out when we can unload
 				// Hey, we can unload you, because you are not needed
-				block.vertex_data = nil
+				block.dropVertices()
 			}
 
 		}
@@ -346,9 +405,19 @@ func (block *Block) Draw(start, N int64, detailed bool) {
 	})
 }
 
-func (block *Block) GenerateVertices() *glh.MeshBuffer {
-
+// Returns where accesses to `addr` are drawn across the plot, from -2 to 2, or
+// false if they aren't because the page is quiet
+func (block *Block) AccessX(addr uint64) (float64, bool) {
+	page := addr / *PAGE_SIZE
+	if block.quiet_pages[page] {
+		return 0, false
+	}
 	width := uint64(len(block.display_active_pages)+1) * *PAGE_SIZE
+	x := float64(addr-block.n_inactive_to_left[page]**PAGE_SIZE) / float64(width)
+	return (x - 0.5) * 4, true
+}
+
+func (block *Block) GenerateVertices() *glh.MeshBuffer {
 
 	vc := glh.NewMeshBuffer(
 		glh.RenderArrays,
@@ -402,19 +471,21 @@ func (block *Block) GenerateVertices() *glh.MeshBuffer {
 
 			stack_depth--
 
+			continue
+		} else if rec.Type == MEMA_ALLOC || rec.Type == MEMA_FREE ||
+			rec.Type == MEMA_THREAD || rec.Type == MEMA_MAPS ||
+			rec.Type == MEMA_MAPS_TEXT {
 			continue
 		} else {
 			log.Panic("Unexpected record type: ", rec.Type)
 		}
 		a := rec.MemAccess()
 
-		page := a.Addr / *PAGE_SIZE
-		if _, present := block.quiet_pages[page]; present {
+		ax, ok := block.AccessX(a.Addr)
+		if !ok {
 			continue
 		}
-
-		*x = float32((a.Addr - block.n_inactive_to_left[page]*(*PAGE_SIZE))) / float32(width)
-		*x = (*x - 0.5) * 4
+		*x = float32(ax)
 
 		if *x > 4 || *x < -4 {
 			log.Panic("x has unexpected value: ", x)
@@ -442,9 +513,10 @@ func (block *Block) GenerateVertices() *glh.MeshBuffer {
 	}
 
 	vc.Add(vertices, colours)
+	block_cache.Account(block, BLOCK_VERTICES, int64(len(vertices)*4+len(colours)))
 	// Don't need the record data anymore
 	block.records = Records{}
-	runtime.GC()
+	block_cache.Account(block, BLOCK_RECORDS, 0)
 
 	return vc
 }
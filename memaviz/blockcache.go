@@ -0,0 +1,195 @@
+// blockcache.go: a budget for the memory held by blocks (their records, vertex
+//                buffers, textures and summaries), evicting the least recently
+//                viewed
+
+package main
+
+import (
+	"container/list"
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A number of bytes, which can be given as e.g. 512M or 4G
+type ByteSize int64
+
+var byte_units = []struct {
+	suffix string
+	scale  int64
+}{{"T", 1 << 40}, {"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10}, {"", 1}}
+
+func (s *ByteSize) Set(value string) error {
+	v := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(value)), "B")
+	for _, u := range byte_units {
+		if !strings.HasSuffix(v, u.suffix) {
+			continue
+		}
+		n, err := strconv.ParseFloat(strings.TrimSuffix(v, u.suffix), 64)
+		if err != nil || n < 0 {
+			break
+		}
+		*s = ByteSize(n * float64(u.scale))
+		return nil
+	}
+	return fmt.Errorf("bad size %q", value)
+}
+
+func (s ByteSize) String() string {
+	for _, u := range byte_units {
+		if int64(s) >= u.scale {
+			return strconv.FormatFloat(float64(s)/float64(u.scale), 'f', -1, 64) + u.suffix
+		}
+	}
+	return "0"
+}
+
+var mem_budget = ByteSize(4 << 30)
+
+func init() {
+	flag.Var(&mem_budget, "mem", "memory to spend on the records, vertices, textures and summaries of blocks")
+}
+
+// What a block holds memory for
+const (
+	// While it is being loaded
+	BLOCK_RECORDS = iota
+	BLOCK_VERTICES
+	BLOCK_TEXTURE
+	// Read back by WithBlockRecords
+	BLOCK_CACHED_RECORDS
+	// Block.calls and Block.density, which are kept for as long as the block
+	BLOCK_SUMMARY
+	BLOCK_NKINDS
+)
+
+// The memory accounted to a block
+type blockUsage struct {
+	bytes [BLOCK_NKINDS]int64
+	// In the cache's list while it holds any
+	entry *list.Element
+	// Frame in which it was last drawn
+	viewed int64
+}
+
+func (u *blockUsage) total() int64 {
+	total := int64(0)
+	for _, bytes := range u.bytes {
+		total += bytes
+	}
+	return total
+}
+
+// Bytes which Block.Evict gives back
+func (u *blockUsage) evictable() int64 {
+	return u.bytes[BLOCK_VERTICES] + u.bytes[BLOCK_TEXTURE] + u.bytes[BLOCK_CACHED_RECORDS]
+}
+
+type BlockCache struct {
+	used int64
+	// Blocks holding memory, most recently viewed or loaded at the front
+	order *list.List
+	frame int64
+	lock  sync.Mutex
+	// Signalled when memory is given back
+	room *sync.Cond
+}
+
+func NewBlockCache() *BlockCache {
+	c := &BlockCache{order: list.New(), frame: 1}
+	c.room = sync.NewCond(&c.lock)
+	return c
+}
+
+// Shared by all of the traces being viewed
+var block_cache = NewBlockCache()
+
+// Records that `b` now holds `bytes` of `kind`
+func (c *BlockCache) Account(b *Block, kind int, bytes int64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	u := &b.usage
+	change := bytes - u.bytes[kind]
+	u.bytes[kind] = bytes
+	c.used += change
+
+	switch {
+	case u.total() == 0 && u.entry != nil:
+		c.order.Remove(u.entry)
+		u.entry = nil
+	case u.total() != 0 && u.entry == nil:
+		u.entry = c.order.PushFront(b)
+	}
+	if change < 0 {
+		c.room.Broadcast()
+	}
+}
+
+// Notes that `b` is being drawn this frame
+func (c *BlockCache) Viewed(b *Block) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	b.usage.viewed = c.frame
+	if b.usage.entry != nil {
+		c.order.MoveToFront(b.usage.entry)
+	}
+}
+
+func (c *BlockCache) Used() int64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.used
+}
+
+// Whether `b` holds anything which can be evicted, and hasn't been drawn
+// since frame `since`
+func (c *BlockCache) evictable(b *Block, since int64) bool {
+	u := &b.usage
+	return u.viewed < since && u.evictable() > 0
+}
+
+// Waits until there is room for `bytes` more, unless everything which could
+// be evicted to make room is in view
+func (c *BlockCache) WaitForRoom(bytes int64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for c.used+bytes > int64(mem_budget) {
+		// Blocks drawn in the last frame are taken to still be in view
+		can_evict := false
+		for e := c.order.Back(); e != nil && !can_evict; e = e.Prev() {
+			can_evict = c.evictable(e.Value.(*Block), c.frame-1)
+		}
+		if !can_evict {
+			return
+		}
+		c.room.Wait()
+	}
+}
+
+// Evicts the vertices, textures and cached records of the blocks least
+// recently viewed until the budget is met, and starts the next frame. Must be
+// called on the main thread, after drawing. The records of blocks being
+// loaded and the summaries of blocks aren't evicted, but are counted so that
+// loading waits for room.
+func (c *BlockCache) EndFrame() {
+	c.lock.Lock()
+	victims := []*Block{}
+	over := c.used - int64(mem_budget)
+	for e := c.order.Back(); e != nil && over > 0; e = e.Prev() {
+		b := e.Value.(*Block)
+		if c.evictable(b, c.frame) {
+			victims = append(victims, b)
+			over -= b.usage.evictable()
+		}
+	}
+	c.frame++
+	c.lock.Unlock()
+
+	for _, b := range victims {
+		b.Evict()
+	}
+	c.room.Broadcast()
+}
@@ -0,0 +1,59 @@
+package main
+
+import "testing"
+
+func TestByteSizeSet(t *testing.T) {
+	tests := []struct {
+		text string
+		want ByteSize
+		ok   bool
+	}{
+		{"4096", 4096, true},
+		{"100B", 100, true},
+		{"4k", 4 << 10, true},
+		{"4KB", 4 << 10, true},
+		{"512M", 512 << 20, true},
+		{" 1.5gb ", 3 << 29, true},
+		{"2T", 2 << 40, true},
+		{"0", 0, true},
+		{"", 0, false},
+		{"G", 0, false},
+		{"-1G", 0, false},
+		{"1.5X", 0, false},
+		{"lots", 0, false},
+	}
+	for _, test := range tests {
+		var s ByteSize
+		err := s.Set(test.text)
+		if (err == nil) != test.ok || s != test.want {
+			t.Errorf("Set(%q) = %d, %v, want %d, ok %v", test.text, int64(s), err,
+				int64(test.want), test.ok)
+		}
+	}
+}
+
+func TestByteSizeString(t *testing.T) {
+	tests := []struct {
+		s    ByteSize
+		want string
+	}{
+		{0, "0"},
+		{1, "1"},
+		{1023, "1023"},
+		{1024, "1K"},
+		{1536, "1.5K"},
+		{4 << 30, "4G"},
+		{3 << 29, "1.5G"},
+		{1 << 40, "1T"},
+	}
+	for _, test := range tests {
+		if got := test.s.String(); got != test.want {
+			t.Errorf("ByteSize(%d).String() = %q, want %q", int64(test.s), got, test.want)
+		}
+		// It reads back what it writes
+		var s ByteSize
+		if err := s.Set(test.s.String()); err != nil || s != test.s {
+			t.Errorf("Set(%q) = %d, %v, want %d", test.s.String(), int64(s), err, int64(test.s))
+		}
+	}
+}
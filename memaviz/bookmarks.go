@@ -0,0 +1,383 @@
+// bookmarks.go: named record ranges of a trace, kept in a sidecar file next
+//               to it (filename.mema.bookmarks) so that they can be shared
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/go-gl/gl"
+	"github.com/go-gl/glh"
+)
+
+type Bookmark struct {
+	Name string `json:"name"`
+	// Records [Start, End)
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+	// Optionally, the addresses of interest [AddrLow, AddrHi)
+	AddrLow uint64 `json:"addr_low,omitempty"`
+	AddrHi  uint64 `json:"addr_hi,omitempty"`
+	Note    string `json:"note,omitempty"`
+}
+
+func (b Bookmark) String() string {
+	s := fmt.Sprintf("%-20s records %d-%d", b.Name, b.Start, b.End)
+	if b.AddrHi != 0 {
+		s += fmt.Sprintf(" addresses 0x%x-0x%x", b.AddrLow, b.AddrHi)
+	}
+	if b.Note != "" {
+		s += "  " + b.Note
+	}
+	return s
+}
+
+type BookmarksByStart []Bookmark
+
+func (p BookmarksByStart) Len() int           { return len(p) }
+func (p BookmarksByStart) Less(i, j int) bool { return p[i].Start < p[j].Start }
+func (p BookmarksByStart) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+func (data *ProgramData) BookmarksFilename() string {
+	return data.filename + ".bookmarks"
+}
+
+// Reads the sidecar file, if there is one
+func (data *ProgramData) LoadBookmarks() {
+	buf, err := ioutil.ReadFile(data.BookmarksFilename())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Can't read bookmarks: %v", err)
+		}
+		return
+	}
+	var bookmarks []Bookmark
+	if err := json.Unmarshal(buf, &bookmarks); err != nil {
+		log.Printf("Ignoring bad bookmarks file %s: %v", data.BookmarksFilename(), err)
+		return
+	}
+	sort.Sort(BookmarksByStart(bookmarks))
+
+	data.bookmarks_lock.Lock()
+	defer data.bookmarks_lock.Unlock()
+	data.bookmarks = bookmarks
+}
+
+// Writes the sidecar file, replacing it atomically
+func (data *ProgramData) saveBookmarks(bookmarks []Bookmark) error {
+	buf, err := json.MarshalIndent(bookmarks, "", "  ")
+	if err != nil {
+		return err
+	}
+	filename := data.BookmarksFilename()
+	fd, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = fd.Write(append(buf, '\n'))
+	if err == nil {
+		err = fd.Close()
+	} else {
+		fd.Close()
+	}
+	if err == nil {
+		err = os.Rename(fd.Name(), filename)
+	}
+	if err != nil {
+		os.Remove(fd.Name())
+	}
+	return err
+}
+
+func (data *ProgramData) Bookmarks() []Bookmark {
+	data.bookmarks_lock.Lock()
+	defer data.bookmarks_lock.Unlock()
+	return data.bookmarks
+}
+
+// Adds bookmark `b`, replacing any with the same name, and saves the sidecar
+func (data *ProgramData) AddBookmark(b Bookmark) error {
+	data.bookmarks_lock.Lock()
+	defer data.bookmarks_lock.Unlock()
+
+	bookmarks := []Bookmark{b}
+	for _, old := range data.bookmarks {
+		if old.Name != b.Name {
+			bookmarks = append(bookmarks, old)
+		}
+	}
+	sort.Sort(BookmarksByStart(bookmarks))
+	if err := data.saveBookmarks(bookmarks); err != nil {
+		return err
+	}
+	data.bookmarks = bookmarks
+	return nil
+}
+
+func (data *ProgramData) RemoveBookmark(name string) error {
+	data.bookmarks_lock.Lock()
+	defer data.bookmarks_lock.Unlock()
+
+	bookmarks := []Bookmark{}
+	for _, b := range data.bookmarks {
+		if b.Name != name {
+			bookmarks = append(bookmarks, b)
+		}
+	}
+	if len(bookmarks) == len(data.bookmarks) {
+		return fmt.Errorf("no bookmark %q", name)
+	}
+	if err := data.saveBookmarks(bookmarks); err != nil {
+		return err
+	}
+	data.bookmarks = bookmarks
+	return nil
+}
+
+func (data *ProgramData) FindBookmark(name string) (Bookmark, bool) {
+	for _, b := range data.Bookmarks() {
+		if b.Name == name {
+			return b, true
+		}
+	}
+	return Bookmark{}, false
+}
+
+// Returns the first bookmark starting after record `from`, wrapping around
+func (data *ProgramData) NextBookmark(from int64) (Bookmark, bool) {
+	bookmarks := data.Bookmarks()
+	if len(bookmarks) == 0 {
+		return Bookmark{}, false
+	}
+	for _, b := range bookmarks {
+		if b.Start > from {
+			return b, true
+		}
+	}
+	return bookmarks[0], true
+}
+
+// Runs the bookmark commands of the prompt against the records [start, end)
+// in view, returning a message for the status line. handled is false if
+// `command` isn't a bookmark command.
+//
+//	mark NAME [records=A-B] [addr=A[-B|+N]] [note...]
+//	                            bookmark the view or records A-B, and
+//	                            optionally some addresses
+//	unmark NAME
+//	marks                       list the bookmarks
+func (data *ProgramData) BookmarkCommand(command string, start, end int64) (status string, handled bool, err error) {
+	words := strings.Fields(command)
+	if len(words) == 0 {
+		return "", false, nil
+	}
+	switch words[0] {
+	case "mark":
+		if len(words) < 2 {
+			return "", true, fmt.Errorf("usage: mark NAME [records=A-B] [addr=A-B] [note]")
+		}
+		b := Bookmark{Name: words[1], Start: start, End: end}
+		rest := words[2:]
+		// Anything after these is the note, so it may look like a range
+		for len(rest) > 0 {
+			var err error
+			if strings.HasPrefix(rest[0], "records=") {
+				b.Start, b.End, err = ParseRecordRange(strings.TrimPrefix(rest[0], "records="))
+			} else if strings.HasPrefix(rest[0], "addr=") {
+				var r AddrRange
+				r, err = ParseAddrRange(strings.TrimPrefix(rest[0], "addr="))
+				b.AddrLow, b.AddrHi = r.Low, r.Hi
+			} else {
+				break
+			}
+			if err != nil {
+				return "", true, err
+			}
+			rest = rest[1:]
+		}
+		b.Note = strings.Join(rest, " ")
+		if err := data.AddBookmark(b); err != nil {
+			return "", true, err
+		}
+		return "marked " + b.String(), true, nil
+
+	case "unmark":
+		if len(words) != 2 {
+			return "", true, fmt.Errorf("usage: unmark NAME")
+		}
+		if err := data.RemoveBookmark(words[1]); err != nil {
+			return "", true, err
+		}
+		return "removed " + words[1], true, nil
+
+	case "marks":
+		names := []string{}
+		for _, b := range data.Bookmarks() {
+			names = append(names, b.Name)
+		}
+		if len(names) == 0 {
+			return "no bookmarks", true, nil
+		}
+		return "bookmarks: " + strings.Join(names, " "), true, nil
+	}
+	return "", false, nil
+}
+
+func BookmarkColour(name string) (r, g, b float32) {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	return FunctionColour(h.Sum64())
+}
+
+// Returns the span of x, in the co-ordinates of the plot, over which the
+// addresses [low, hi) are drawn in the block, if any of them are
+func (block *Block) AddrRangeX(low, hi uint64) (x1, x2 float64, ok bool) {
+	for page := range block.display_active_pages {
+		page_low, page_hi := page**PAGE_SIZE, (page+1)**PAGE_SIZE
+		if page_hi <= low || page_low >= hi {
+			continue
+		}
+		from, to := page_low, page_hi
+		if from < low {
+			from = low
+		}
+		if to > hi {
+			to = hi
+		}
+		a, ok_a := block.AccessX(from)
+		b, ok_b := block.AccessX(to - 1)
+		if !ok_a || !ok_b {
+			continue
+		}
+		if !ok || a < x1 {
+			x1 = a
+		}
+		if !ok || b > x2 {
+			x2 = b
+		}
+		ok = true
+	}
+	return
+}
+
+// A part of a bookmark band, records [y1, y2) across x1 to x2
+type bookmarkSpan struct {
+	y1, y2, x1, x2 float64
+}
+
+// Returns where bookmark `b` is drawn within records [start_index,
+// start_index+n). Bookmarks of addresses are drawn block by block, since each
+// block lays out its pages separately.
+func (data *ProgramData) bookmarkSpans(b Bookmark, start_index, n int64) []bookmarkSpan {
+	from, to := max(b.Start, start_index), min(b.End, start_index+n)
+	if b.AddrHi == 0 {
+		return []bookmarkSpan{{float64(from), float64(to), -2, 2}}
+	}
+
+	result := []bookmarkSpan{}
+	for i := from; i < to; i = (i/RECORDS_PER_BLOCK + 1) * RECORDS_PER_BLOCK {
+		block := BlockOf(data.blocks, i)
+		if block == nil {
+			break
+		}
+		if x1, x2, ok := block.AddrRangeX(b.AddrLow, b.AddrHi); ok {
+			end := min(to, block.first_record+block.nrecords)
+			result = append(result, bookmarkSpan{float64(i), float64(end), x1, x2})
+		}
+	}
+	return result
+}
+
+// Labels of the bookmarks drawn so far
+var bookmark_labels = NewLabelCache()
+
+// Draws the bookmarks overlapping records [start_index, start_index+n) as
+// bands across the plot, labelled at the top left
+func (data *ProgramData) DrawBookmarks(start_index, n int64) {
+	bookmarks := data.Bookmarks()
+
+	type label struct {
+		text *glh.Text
+		x, y float64
+	}
+	labels := []label{}
+
+	glh.With(glh.Matrix{gl.MODELVIEW}, func() {
+		gl.Translated(0, -2, 0)
+		gl.Scaled(1, 4/float64(n), 1)
+		gl.Translated(0, -float64(start_index), 0)
+
+		for _, b := range bookmarks {
+			if b.End <= start_index || b.Start >= start_index+n {
+				continue
+			}
+			spans := data.bookmarkSpans(b, start_index, n)
+			if len(spans) == 0 {
+				continue
+			}
+			r, g, bl := BookmarkColour(b.Name)
+
+			gl.Color4f(r, g, bl, 0.15)
+			glh.With(glh.Primitive{gl.QUADS}, func() {
+				for _, s := range spans {
+					gl.Vertex2d(s.x1, s.y1)
+					gl.Vertex2d(s.x2, s.y1)
+					gl.Vertex2d(s.x2, s.y2)
+					gl.Vertex2d(s.x1, s.y2)
+				}
+			})
+			gl.Color4f(r, g, bl, 0.8)
+			glh.With(glh.Primitive{gl.LINES}, func() {
+				// Only where the bookmark begins and ends
+				for _, s := range spans {
+					if s.y1 == float64(b.Start) {
+						gl.Vertex2d(s.x1, s.y1)
+						gl.Vertex2d(s.x2, s.y1)
+					}
+					if s.y2 == float64(b.End) {
+						gl.Vertex2d(s.x1, s.y2)
+						gl.Vertex2d(s.x2, s.y2)
+					}
+				}
+			})
+
+			text := bookmark_labels.Get(b.Name)
+			top := spans[len(spans)-1]
+			x, y := glh.ProjToWindow(top.x1, top.y2)
+			labels = append(labels, label{text, x, y})
+		}
+	})
+
+	bookmark_labels.EndFrame()
+
+	glh.With(glh.WindowCoords{}, func() {
+		_, h := glh.GetViewportWHD()
+		glh.With(glh.Attrib{gl.ENABLE_BIT}, func() {
+			gl.Enable(gl.TEXTURE_2D)
+			for _, l := range labels {
+				// ProjToWindow counts from the top of the window
+				l.text.Draw(int(l.x)+4, int(h-l.y)-20)
+			}
+		})
+	})
+}
+
+// The "bookmarks" action
+func (data *ProgramData) ListBookmarks() {
+	bookmarks := data.Bookmarks()
+	if len(bookmarks) == 0 {
+		fmt.Printf("No bookmarks in %s\n", data.BookmarksFilename())
+		return
+	}
+	for _, b := range bookmarks {
+		fmt.Println(b)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestBookmarkCommand(t *testing.T) {
+	dir := testTraceDir(t)
+	defer os.RemoveAll(dir)
+	data := writeTestTrace(t, dir, "in.mema", Records{threadRecord(1)})
+
+	tests := []struct {
+		command string
+		want    Bookmark
+		ok      bool
+	}{
+		// The view is records 10-20
+		{"mark a", Bookmark{Name: "a", Start: 10, End: 20}, true},
+		{"mark a records=3-5", Bookmark{Name: "a", Start: 3, End: 5}, true},
+		{"mark a addr=0x1000+16 hot loop",
+			Bookmark{Name: "a", Start: 10, End: 20, AddrLow: 0x1000, AddrHi: 0x1010, Note: "hot loop"}, true},
+		{"mark a records=3-5 addr=0x1000-0x2000",
+			Bookmark{Name: "a", Start: 3, End: 5, AddrLow: 0x1000, AddrHi: 0x2000}, true},
+		{"mark a addr=0x1000 records=3-5",
+			Bookmark{Name: "a", Start: 3, End: 5, AddrLow: 0x1000, AddrHi: 0x1001}, true},
+		// A note may begin with what looks like a range
+		{"mark a 123 iterations", Bookmark{Name: "a", Start: 10, End: 20, Note: "123 iterations"}, true},
+		{"mark a 0x10-0x20", Bookmark{Name: "a", Start: 10, End: 20, Note: "0x10-0x20"}, true},
+		{"mark a note records=3-5", Bookmark{Name: "a", Start: 10, End: 20, Note: "note records=3-5"}, true},
+		{"mark", Bookmark{}, false},
+		{"mark a records=5-3", Bookmark{}, false},
+		{"mark a addr=zz", Bookmark{}, false},
+	}
+	for _, test := range tests {
+		_, handled, err := data.BookmarkCommand(test.command, 10, 20)
+		if !handled || (err == nil) != test.ok {
+			t.Errorf("%q: handled %v, error %v, want ok %v", test.command, handled, err, test.ok)
+			continue
+		}
+		if !test.ok {
+			continue
+		}
+		if got, ok := data.FindBookmark("a"); !ok || got != test.want {
+			t.Errorf("%q: bookmarked %+v, want %+v", test.command, got, test.want)
+		}
+	}
+
+	// Saved to the sidecar, and read back
+	data.bookmarks = nil
+	data.LoadBookmarks()
+	if _, ok := data.FindBookmark("a"); !ok {
+		t.Errorf("bookmark a wasn't saved")
+	}
+	if _, _, err := data.BookmarkCommand("unmark a", 10, 20); err != nil {
+		t.Errorf("unmark a: %v", err)
+	}
+	if _, _, err := data.BookmarkCommand("unmark a", 10, 20); err == nil {
+		t.Errorf("unmark a twice: no error")
+	}
+	if status, _, _ := data.BookmarkCommand("marks", 10, 20); status != "no bookmarks" {
+		t.Errorf("marks: %q, want %q", status, "no bookmarks")
+	}
+	if _, handled, _ := data.BookmarkCommand("search w", 10, 20); handled {
+		t.Errorf("search w: handled as a bookmark command")
+	}
+}
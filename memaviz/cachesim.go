@@ -0,0 +1,64 @@
+// cachesim.go: a simple set-associative LRU cache, used to estimate how many
+//              of the traced accesses would miss
+
+package main
+
+import (
+	"flag"
+	"log"
+)
+
+var cache_size = flag.Uint64("cache-size", 32*1024, "simulated cache size in bytes")
+var cache_ways = flag.Int("cache-ways", 8, "simulated cache associativity")
+
+type Cache struct {
+	line_size uint64
+	nsets     uint64
+	ways      int
+	// For each set, the tags it holds (plus one, so that zero is empty),
+	// most recently used first
+	sets [][]uint64
+}
+
+func NewCache(size, line_size uint64, ways int) *Cache {
+	if line_size == 0 || ways < 1 || size < line_size*uint64(ways) {
+		log.Panicf("Bad cache geometry: size=%d line_size=%d ways=%d",
+			size, line_size, ways)
+	}
+	c := &Cache{
+		line_size: line_size,
+		nsets:     size / line_size / uint64(ways),
+		ways:      ways,
+	}
+	c.sets = make([][]uint64, c.nsets)
+	storage := make([]uint64, c.nsets*uint64(ways))
+	for i := range c.sets {
+		c.sets[i] = storage[i*ways : (i+1)*ways]
+	}
+	return c
+}
+
+// The cache described by the -cache-* and -line-size flags
+func NewDefaultCache() *Cache {
+	return NewCache(*cache_size, *LINE_SIZE, *cache_ways)
+}
+
+// Simulates an access to `addr`, returning true if it missed
+func (c *Cache) Access(addr uint64) bool {
+	line := addr / c.line_size
+	set := c.sets[line%c.nsets]
+	tag := line + 1
+
+	for i := range set {
+		if set[i] == tag {
+			// Hit, move to front
+			copy(set[1:i+1], set[:i])
+			set[0] = tag
+			return false
+		}
+	}
+	// Miss, evict the least recently used
+	copy(set[1:], set[:len(set)-1])
+	set[0] = tag
+	return true
+}
@@ -0,0 +1,93 @@
+// callstack.go: following function enter/exit records while streaming
+//               through a trace, to know the call stack at every record
+
+package main
+
+type CallTracker struct {
+	// Function pointers of the active calls, outermost first
+	Stack []uint64
+	// Record index of the MEMA_FUNC_ENTER of each active call
+	Entries []int64
+	// Return address of each active call into its caller, if recorded
+	ReturnPcs []uint64
+}
+
+// Updates the stack for record `r`. Returns true if `r` was an enter or exit.
+func (t *CallTracker) Update(index int64, r *Record) bool {
+	switch r.Type {
+	case MEMA_FUNC_ENTER:
+		t.Stack = append(t.Stack, r.FunctionCall().FuncPointer)
+		t.Entries = append(t.Entries, index)
+		t.ReturnPcs = append(t.ReturnPcs, r.FunctionCall().ReturnPc)
+		return true
+	case MEMA_FUNC_EXIT:
+		f := r.FunctionCall().FuncPointer
+		// Unwind to the matching enter. Calls which exit without one (e.g,
+		// those which began before mema was enabled) are ignored.
+		for i := len(t.Stack) - 1; i >= 0; i-- {
+			if t.Stack[i] == f {
+				t.Stack = t.Stack[:i]
+				t.Entries = t.Entries[:i]
+				t.ReturnPcs = t.ReturnPcs[:i]
+				break
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func (t *CallTracker) Depth() int {
+	return len(t.Stack)
+}
+
+// Innermost active function, or zero if there is none
+func (t *CallTracker) Current() uint64 {
+	if len(t.Stack) == 0 {
+		return 0
+	}
+	return t.Stack[len(t.Stack)-1]
+}
+
+// Keeps a separate call stack for each thread, switching between them on
+// MEMA_THREAD records. The embedded CallTracker is the current thread's.
+// Threads are told apart by their process too, for merged traces.
+type ThreadTracker struct {
+	*CallTracker
+	Tid, Pid uint64
+	threads  map[ThreadMarker]*CallTracker
+}
+
+func NewThreadTracker() *ThreadTracker {
+	t := &ThreadTracker{threads: make(map[ThreadMarker]*CallTracker)}
+	t.Switch(ThreadMarker{})
+	return t
+}
+
+func (t *ThreadTracker) Switch(thread ThreadMarker) {
+	calls, ok := t.threads[thread]
+	if !ok {
+		calls = &CallTracker{}
+		t.threads[thread] = calls
+	}
+	t.Tid, t.Pid, t.CallTracker = thread.Tid, thread.Pid, calls
+}
+
+// The current thread
+func (t *ThreadTracker) Thread() ThreadMarker {
+	return ThreadMarker{t.Tid, t.Pid}
+}
+
+// Like CallTracker.Update, but also follows thread switches
+func (t *ThreadTracker) Update(index int64, r *Record) bool {
+	if r.Type == MEMA_THREAD {
+		t.Switch(*r.ThreadMarker())
+		return true
+	}
+	return t.CallTracker.Update(index, r)
+}
+
+// Threads seen so far, and their call stacks
+func (t *ThreadTracker) Threads() map[ThreadMarker]*CallTracker {
+	return t.threads
+}
@@ -0,0 +1,252 @@
+// chrometrace.go: exporting the function timeline of a trace in the Chrome
+//                 Trace Event format, which ui.perfetto.dev and
+//                 chrome://tracing can open
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+var trace_clock = flag.String("clock", "time",
+	"timeline for exported traces: 'time' (recorded timestamps) or 'records' (1us per record)")
+var counter_window = flag.Int64("window", 10000,
+	"number of records over which exported counters are computed, with -clock records")
+var counter_period = flag.Duration("window-time", time.Millisecond,
+	"time over which exported counters are computed, with -clock time")
+
+type TraceEvent struct {
+	Name string                 `json:"name,omitempty"`
+	Ph   string                 `json:"ph"`
+	Ts   float64                `json:"ts"`
+	Pid  int                    `json:"pid"`
+	Tid  uint64                 `json:"tid"`
+	Args map[string]interface{} `json:"args,omitempty"`
+}
+
+type ChromeTraceWriter struct {
+	w     *bufio.Writer
+	first bool
+}
+
+func NewChromeTraceWriter(fd *os.File) *ChromeTraceWriter {
+	w := bufio.NewWriterSize(fd, 1024*1024)
+	w.WriteString(`{"displayTimeUnit":"ns","traceEvents":[` + "\n")
+	return &ChromeTraceWriter{w: w, first: true}
+}
+
+func (t *ChromeTraceWriter) Write(e *TraceEvent) {
+	if !t.first {
+		t.w.WriteString(",\n")
+	}
+	t.first = false
+	buf, err := json.Marshal(e)
+	if err != nil {
+		log.Panic("Error encoding event: ", err)
+	}
+	t.w.Write(buf)
+}
+
+func (t *ChromeTraceWriter) Close() error {
+	t.w.WriteString("\n]}\n")
+	return t.w.Flush()
+}
+
+// The accesses counted over one window of the trace
+type counterWindow struct {
+	counts AccessCounts
+	lines  map[uint64]struct{}
+}
+
+func newCounterWindow() *counterWindow {
+	return &counterWindow{lines: make(map[uint64]struct{})}
+}
+
+func (w *counterWindow) Add(a *MemAccess) {
+	w.counts.Add(a)
+	w.lines[a.Addr / *LINE_SIZE] = struct{}{}
+}
+
+// Writes the counters of `w` at time `ts`
+func (t *ChromeTraceWriter) WriteCounters(w *counterWindow, ts float64, pid int) {
+	args := map[string]interface{}{
+		"reads": w.counts.Reads, "writes": w.counts.Writes}
+	t.Write(&TraceEvent{Name: "accesses", Ph: "C", Ts: ts, Pid: pid, Args: args})
+	args = map[string]interface{}{
+		"bytes": uint64(len(w.lines)) * *LINE_SIZE}
+	t.Write(&TraceEvent{Name: "working set", Ph: "C", Ts: ts, Pid: pid, Args: args})
+}
+
+// A window of time of one process, with -clock time
+type timeWindowKey struct {
+	k   int64
+	pid int
+}
+
+type timeWindowKeys []timeWindowKey
+
+func (p timeWindowKeys) Len() int { return len(p) }
+func (p timeWindowKeys) Less(i, j int) bool {
+	if p[i].k != p[j].k {
+		return p[i].k < p[j].k
+	}
+	return p[i].pid < p[j].pid
+}
+func (p timeWindowKeys) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+
+// The pid of the events of `thread`. Each process of a merged trace is its
+// own, and other traces are process 1.
+func chromePid(thread ThreadMarker) int {
+	if thread.Pid == 0 {
+		return 1
+	}
+	return int(thread.Pid)
+}
+
+// The "trace" action
+func (data *ProgramData) ExportChromeTrace() {
+	switch *trace_clock {
+	case "time", "records":
+	default:
+		log.Fatalf("Unknown -clock %q", *trace_clock)
+	}
+
+	filename := OutputFilename(data.filename, ".json")
+	fd, err := os.Create(filename)
+	if err != nil {
+		log.Panic("Fatal error: ", err)
+	}
+	defer fd.Close()
+
+	out := NewChromeTraceWriter(fd)
+
+	calls := NewThreadTracker()
+	// Timestamp of the most recent access on each thread. Function records
+	// don't carry a time, so they are placed at the last known one.
+	now := make(map[ThreadMarker]float64)
+	first_time := 0.
+	ts := func(index int64) float64 {
+		if *trace_clock == "records" {
+			return float64(index)
+		}
+		return now[calls.Thread()]
+	}
+
+	// Counters are kept for each process. With -clock records, they are
+	// emitted as each window of records finishes. With -clock time, the blocks
+	// of different threads overlap in time, so the windows of time are kept
+	// until the end.
+	windows := make(map[int]*counterWindow)
+	pids := []int{}
+	window_end := *counter_window
+	period := float64(*counter_period) / float64(time.Microsecond)
+	if period <= 0 {
+		log.Fatal("-window-time must be positive")
+	}
+	time_windows := make(map[timeWindowKey]*counterWindow)
+	last_index := int64(0)
+
+	data.ForEachRecord(func(index int64, r *Record) {
+		last_index = index
+		for *trace_clock == "records" && index >= window_end {
+			// Emit the counters for the window which just finished
+			for _, pid := range pids {
+				out.WriteCounters(windows[pid], ts(index), pid)
+				windows[pid] = newCounterWindow()
+			}
+			window_end += *counter_window
+		}
+
+		pid := chromePid(calls.Thread())
+		switch r.Type {
+		case MEMA_THREAD:
+			thread := *r.ThreadMarker()
+			pid = chromePid(thread)
+			if _, seen := windows[pid]; !seen {
+				name := filepath.Base(data.filename)
+				if thread.Pid != 0 {
+					name = fmt.Sprintf("%s process %d", name, thread.Pid)
+				}
+				out.Write(&TraceEvent{Name: "process_name", Ph: "M", Pid: pid,
+					Args: map[string]interface{}{"name": name}})
+				windows[pid] = newCounterWindow()
+				pids = append(pids, pid)
+			}
+			if _, seen := calls.Threads()[thread]; !seen {
+				out.Write(&TraceEvent{Name: "thread_name", Ph: "M", Pid: pid,
+					Tid: thread.Tid, Args: map[string]interface{}{"name": fmt.Sprintf("thread %d", thread.Tid)}})
+			}
+			calls.Update(index, r)
+
+		case MEMA_FUNC_ENTER:
+			f := r.FunctionCall().FuncPointer
+			out.Write(&TraceEvent{Name: data.FunctionName(f), Ph: "B", Ts: ts(index),
+				Pid: pid, Tid: calls.Tid})
+			calls.Update(index, r)
+
+		case MEMA_FUNC_EXIT:
+			depth := calls.Depth()
+			calls.Update(index, r)
+			// One exit may unwind several calls whose exits went missing
+			for ; depth > calls.Depth(); depth-- {
+				out.Write(&TraceEvent{Ph: "E", Ts: ts(index), Pid: pid, Tid: calls.Tid})
+			}
+
+		case MEMA_ACCESS:
+			a := r.MemAccess()
+			if first_time == 0 {
+				first_time = a.Time
+			}
+			// Microseconds since the start of the trace
+			now[calls.Thread()] = (a.Time - first_time) * 1e6
+
+			if *trace_clock == "records" {
+				if windows[pid] == nil {
+					// Before any thread marker
+					windows[pid] = newCounterWindow()
+					pids = append(pids, pid)
+				}
+				windows[pid].Add(a)
+				break
+			}
+			key := timeWindowKey{int64(math.Floor(now[calls.Thread()] / period)), pid}
+			if time_windows[key] == nil {
+				time_windows[key] = newCounterWindow()
+			}
+			time_windows[key].Add(a)
+		}
+	})
+
+	keys := timeWindowKeys{}
+	for key := range time_windows {
+		keys = append(keys, key)
+	}
+	sort.Sort(keys)
+	for _, key := range keys {
+		// At the end of the window, as with -clock records
+		out.WriteCounters(time_windows[key], float64(key.k+1)*period, key.pid)
+	}
+
+	// Close calls which never exited
+	for thread, stack := range calls.Threads() {
+		calls.Switch(thread)
+		for range stack.Stack {
+			out.Write(&TraceEvent{Ph: "E", Ts: ts(last_index), Pid: chromePid(thread),
+				Tid: thread.Tid})
+		}
+	}
+
+	if err := out.Close(); err != nil {
+		log.Panic("Error writing trace: ", err)
+	}
+	log.Printf("Wrote %s", filename)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExportChromeTraceProcesses(t *testing.T) {
+	dir := testTraceDir(t)
+	defer os.RemoveAll(dir)
+
+	marker := func(tid, pid uint64) Record {
+		r := threadRecord(tid)
+		r.ThreadMarker().Pid = pid
+		return r
+	}
+	// Thread 7 of two processes, as after merging traces
+	data := writeTestTrace(t, dir, "merged.mema", Records{
+		marker(7, 1),
+		callRecord(MEMA_FUNC_ENTER, 1),
+		accessRecord(16, 1.0),
+		callRecord(MEMA_FUNC_EXIT, 1),
+	}, Records{
+		marker(7, 2),
+		callRecord(MEMA_FUNC_ENTER, 2),
+		accessRecord(32, 1.5),
+	})
+	data.function_names[1] = "f1"
+	data.function_names[2] = "f2"
+
+	filename := filepath.Join(dir, "out.json")
+	defer func(o string) { *output_filename = o }(*output_filename)
+	*output_filename = filename
+	data.ExportChromeTrace()
+
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var trace struct{ TraceEvents []TraceEvent }
+	if err := json.Unmarshal(buf, &trace); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, e := range trace.TraceEvents {
+		switch e.Ph {
+		case "M":
+			got = append(got, fmt.Sprintf("%s %d/%d %v", e.Name, e.Pid, e.Tid, e.Args["name"]))
+		case "B", "E":
+			got = append(got, fmt.Sprintf("%s%s %d/%d", e.Ph, e.Name, e.Pid, e.Tid))
+		}
+	}
+	want := []string{
+		"process_name 1/0 merged.mema process 1",
+		"thread_name 1/7 thread 7",
+		"Bf1 1/7",
+		"E 1/7",
+		"process_name 2/0 merged.mema process 2",
+		"thread_name 2/7 thread 7",
+		"Bf2 2/7",
+		// Closed at the end
+		"E 2/7",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("events:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	pids := make(map[int]bool)
+	for _, e := range trace.TraceEvents {
+		if e.Ph == "C" {
+			pids[e.Pid] = true
+		}
+	}
+	if !pids[1] || !pids[2] || len(pids) != 2 {
+		t.Errorf("counters are for processes %v, want 1 and 2", pids)
+	}
+}
@@ -0,0 +1,193 @@
+// commands.go: the viewer's command prompt, which jumps to a record, block,
+//              time, function call or bookmark, or searches the trace
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const COMMAND_HELP = "goto record N | goto block N | goto time 1.25s | goto function NAME | " +
+	"goto mark NAME | search QUERY | mark NAME [records=A-B] [addr=A-B] [note] | unmark NAME | marks | export FILE"
+
+// Returns the number of records in `blocks`, counting the unused slots at the
+// end of all but the last
+func NumRecords(blocks []*Block) int64 {
+	if len(blocks) == 0 {
+		return 0
+	}
+	last := blocks[len(blocks)-1]
+	return last.first_record + last.nrecords
+}
+
+// Returns the query of a "search QUERY" (or "/QUERY") command
+func SearchCommand(command string) (string, bool) {
+	command = strings.TrimSpace(command)
+	if strings.HasPrefix(command, "/") {
+		return command[1:], true
+	}
+	words := strings.SplitN(command, " ", 2)
+	if len(words) == 2 && (words[0] == "search" || words[0] == "s") {
+		return words[1], true
+	}
+	return "", false
+}
+
+// Runs a command typed at the prompt, returning the range of records to show.
+// `blocks` are the blocks loaded so far, and `from` is the record at the
+// centre of the view, which searches start after.
+func (data *ProgramData) RunCommand(blocks []*Block, command string, from int64) (start, end int64, err error) {
+	words := strings.Fields(command)
+	if len(words) > 0 && (words[0] == "goto" || words[0] == "g") {
+		words = words[1:]
+	}
+	if len(words) < 2 {
+		return 0, 0, fmt.Errorf("usage: %s", COMMAND_HELP)
+	}
+	what, arg := words[0], strings.Join(words[1:], " ")
+
+	switch what {
+	case "record", "r":
+		n, err := strconv.ParseInt(arg, 0, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("bad record number %q", arg)
+		}
+		return n, n + 1, nil
+
+	case "block", "b":
+		n, err := strconv.ParseInt(arg, 0, 64)
+		if err != nil || n < 0 || n >= int64(len(blocks)) {
+			return 0, 0, fmt.Errorf("no block %q, there are %d", arg, len(blocks))
+		}
+		b := blocks[n]
+		return b.first_record, b.first_record + b.nrecords, nil
+
+	case "time", "t":
+		t, err := ParseTraceTime(arg)
+		if err != nil {
+			return 0, 0, err
+		}
+		n, ok := data.FindTime(blocks, t)
+		if !ok {
+			return 0, 0, fmt.Errorf("no record at %v", arg)
+		}
+		return n, n + 1, nil
+
+	case "function", "func", "f":
+		c, ok := data.FindCall(blocks, arg, from)
+		if !ok {
+			return 0, 0, fmt.Errorf("no call to %q", arg)
+		}
+		start, end := data.CallExtent(c)
+		return start, end, nil
+
+	case "mark", "m":
+		b, ok := data.FindBookmark(arg)
+		if !ok {
+			return 0, 0, fmt.Errorf("no bookmark %q", arg)
+		}
+		return b.Start, b.End, nil
+	}
+	return 0, 0, fmt.Errorf("can't goto %q, try: %s", what, COMMAND_HELP)
+}
+
+// Parses a time since the start of the trace, as seconds ("1.25") or a
+// duration ("1.25s", "300ms")
+func ParseTraceTime(s string) (float64, error) {
+	if t, err := strconv.ParseFloat(s, 64); err == nil {
+		return t, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("bad time %q", s)
+	}
+	return d.Seconds(), nil
+}
+
+// Returns the first record at or after `t` seconds into the trace. The blocks
+// of different threads overlap in time, so this is the first in file order.
+func (data *ProgramData) FindTime(blocks []*Block, t float64) (int64, bool) {
+	start_time := 0.
+	for _, b := range blocks {
+		if b.start_time != 0 && (start_time == 0 || b.start_time < start_time) {
+			start_time = b.start_time
+		}
+	}
+	target := start_time + t
+
+	for _, b := range blocks {
+		if b.start_time == 0 || b.end_time < target {
+			continue
+		}
+		result := int64(-1)
+		data.WithBlockRecords(b, func(records Records) {
+			for i := range records {
+				if rt, ok := records[i].Time(); ok && rt >= target {
+					result = b.first_record + int64(i)
+					return
+				}
+			}
+		})
+		if result >= 0 {
+			return result, true
+		}
+	}
+	return 0, false
+}
+
+// Whether function `name` is the one asked for as `query`. The arguments and
+// template arguments may be left out of the query.
+func matchesFunction(name, query string) bool {
+	if name == query {
+		return true
+	}
+	for _, c := range "(<" {
+		if strings.HasPrefix(name, query+string(c)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the first call to the function `query` which starts after record
+// `from`, wrapping around to the start of the trace
+func (data *ProgramData) FindCall(blocks []*Block, query string, from int64) (CallInterval, bool) {
+	matches := make(map[uint64]bool)
+	is_match := func(f uint64) bool {
+		m, ok := matches[f]
+		if !ok {
+			m = matchesFunction(data.FunctionName(f), query)
+			matches[f] = m
+		}
+		return m
+	}
+
+	// The calls of a block are in order of their exit, so look at all of
+	// them for the earliest entry. Calls begun in a block enter after those
+	// begun in the blocks before it.
+	var first CallInterval
+	found_first := false
+	for _, b := range blocks {
+		var next CallInterval
+		found_next := false
+		for _, c := range b.calls {
+			// Only the part of a call which begins it
+			if c.Start != c.Entry || !is_match(c.Func) {
+				continue
+			}
+			if c.Entry > from && (!found_next || c.Entry < next.Entry) {
+				next, found_next = c, true
+			}
+			if !found_first || c.Entry < first.Entry {
+				first, found_first = c, true
+			}
+		}
+		if found_next {
+			return next, true
+		}
+	}
+	return first, found_first
+}
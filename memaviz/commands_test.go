@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseTraceTime(t *testing.T) {
+	tests := []struct {
+		text string
+		want float64
+		ok   bool
+	}{
+		{"1.25", 1.25, true},
+		{"0", 0, true},
+		{"1e-3", 0.001, true},
+		{"1.25s", 1.25, true},
+		{"300ms", 0.3, true},
+		{"1m30s", 90, true},
+		{"2us", 2e-6, true},
+		{"", 0, false},
+		{"1.25 s", 0, false},
+		{"soon", 0, false},
+	}
+	for _, test := range tests {
+		got, err := ParseTraceTime(test.text)
+		if got != test.want || (err == nil) != test.ok {
+			t.Errorf("ParseTraceTime(%q) = %v, %v, want %v, ok %v", test.text, got, err, test.want, test.ok)
+		}
+	}
+}
+
+func TestMatchesFunction(t *testing.T) {
+	tests := []struct {
+		name, query string
+		want        bool
+	}{
+		{"main", "main", true},
+		{"solve(int, double)", "solve", true},
+		{"solve(int, double)", "solve(int, double)", true},
+		{"std::vector<int>::push_back(int const&)", "std::vector", true},
+		{"std::vector<int>::push_back(int const&)", "std::vector<int>::push_back", true},
+		{"solver", "solve", false},
+		{"solve", "solver", false},
+		{"ns::solve(int)", "solve", false},
+		{"main", "", false},
+	}
+	for _, test := range tests {
+		if got := matchesFunction(test.name, test.query); got != test.want {
+			t.Errorf("matchesFunction(%q, %q) = %v, want %v", test.name, test.query, got, test.want)
+		}
+	}
+}
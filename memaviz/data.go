@@ -5,12 +5,9 @@ package main
 import (
 	"bufio"
 	"encoding/binary"
-	"fmt"
 	"io"
 	"log"
 	"os"
-	"sort"
-	"strings"
 	"sync"
 
 	"github.com/pwaller/go-clz4"
@@ -18,21 +15,64 @@ import (
 	"github.com/go-gl/glh"
 )
 
+// Number of record slots in each block written by the runtime. Record indices
+// are block*RECORDS_PER_BLOCK + position, whether or not a block is full.
+const RECORDS_PER_BLOCK = 10 * 1024 * 1024 / 56
+
+// The magic bytes which start a trace, for each format version from 1.
+// Version 2 traces record the frame of the instrumented function in
+// MemAccess.Bp and Sp, version 1 traces that of the runtime. Version 3 traces
+// record MemAccess.Size and FunctionCall.ReturnPc.
+var TRACE_MAGIC = []string{"MEMACCES", "MEMACCv2", "MEMACCv3"}
+
 type ProgramData struct {
 	filename       string
 	region         []MemRegion
 	blocks         []*Block
 	detail_request chan *Block
+
+	// Format version of the trace, see TRACE_MAGIC
+	version int
+
+	// Offset of the first block in the file
+	blocks_offset int64
+
+	function_names map[uint64]string
+	// Names being looked up for FunctionNameIfKnown
+	function_name_requests map[uint64]bool
+
+	// Guards function_names and function_name_requests, which are used from
+	// both the render thread and the goroutines doing lookups for it
+	lock sync.Mutex
+
+	// The blocks most recently read by WithBlockRecords, latest first
+	record_cache      []cachedRecords
+	record_cache_lock sync.Mutex
+
+	// Page tables recorded during the run, in record order (see maps.go)
+	region_tables []RegionTable
+	regions_lock  sync.RWMutex
+	region_cache  *RegionCache
+	// Where the blocks of each process of a merged trace start, in record
+	// order. Empty for other traces. Guarded by regions_lock.
+	process_runs []ProcessRun
+
+	// Sorted by start, see bookmarks.go
+	bookmarks      []Bookmark
+	bookmarks_lock sync.Mutex
 }
 
-func NewProgramData(filename string) *ProgramData {
+// Opens a trace and reads its header and page table, without loading any
+// blocks. Used directly by the non-graphical actions.
+func OpenProgramData(filename string) (*ProgramData, *os.File) {
 	data := &ProgramData{
 		filename:       filename,
 		detail_request: make(chan *Block, 1000),
+		function_names: make(map[uint64]string),
+		region_cache:   NewRegionCache(REGION_CACHE_SIZE),
 	}
 
 	fd, err := os.Open(filename)
-	//defer fd.Close()
 	if err != nil {
 		log.Panic("Fatal error: ", err)
 	}
@@ -41,14 +81,11 @@ func NewProgramData(filename string) *ProgramData {
 	reader := bufio.NewReaderSize(fd, 10*1024*1024)
 	data.ParseHeader(reader)
 	data.ParsePageTable(reader)
-	_, err = fd.Seek(-int64(reader.Buffered()), 1)
+	data.blocks_offset, err = fd.Seek(-int64(reader.Buffered()), 1)
 	if err != nil {
 		log.Panic(err)
 	}
-
-	// TODO: Record block start offsets so that they can be jumped back to
-
-	go data.ParseBlocks(fd)
+	data.LoadBookmarks()
 
 	if *debug {
 		log.Print("Region info:")
@@ -57,15 +94,42 @@ func NewProgramData(filename string) *ProgramData {
 		}
 	}
 
+	return data, fd
+}
+
+func NewProgramData(filename string) *ProgramData {
+	data, fd := OpenProgramData(filename)
+
+	// TODO: Record block start offsets so that they can be jumped back to
+
+	go data.ParseBlocks(fd)
+
 	return data
 }
 
 func (data *ProgramData) ParseHeader(reader io.Reader) {
 	magic_buf := make([]byte, 8)
 	_, err := reader.Read(magic_buf)
-	if err != nil || string(magic_buf) != "MEMACCES" {
+	for i, magic := range TRACE_MAGIC {
+		if err == nil && string(magic_buf) == magic {
+			data.version = i + 1
+		}
+	}
+	if data.version == 0 {
 		log.Panic("Error reading magic bytes: ", err, " bytes=", magic_buf)
 	}
+	if data.version < 2 {
+		log.Printf("%s is a version %d trace, which can't name stack variables",
+			data.filename, data.version)
+	}
+}
+
+// Returns the size in bytes of access `a`, if the trace records it
+func (data *ProgramData) AccessSize(a *MemAccess) (uint64, bool) {
+	if data.version < 3 || a.Size == 0 {
+		return 0, false
+	}
+	return uint64(a.Size), true
 }
 
 func (data *ProgramData) ParsePageTable(reader *bufio.Reader) {
@@ -78,36 +142,10 @@ func (data *ProgramData) ParsePageTable(reader *bufio.Reader) {
 	}
 
 	page_table := string(page_table_bytes[:len(page_table_bytes)-1])
-	page_table_lines := strings.Split(page_table, "\n")
-
-	last := MemRegion{}
-
-	for i := range page_table_lines {
-		line := page_table_lines[i]
-		if len(line) == 0 {
-			continue
-		}
-		x := MemRegion{data: data}
-
-		_, err := fmt.Sscanf(line, "%x-%x %s %s %s %s %s", &x.low, &x.hi,
-			&x.perms, &x.offset, &x.dev, &x.inode, &x.pathname)
-		if err != nil {
-			_, err := fmt.Sscanf(line, "%x-%x %s %s %s %s", &x.low, &x.hi,
-				&x.perms, &x.offset, &x.dev, &x.inode)
-			x.pathname = ""
-			if err != nil {
-				log.Panic("Error parsing: ", err, " '", line, "'")
-			}
-		}
-		data.region = append(data.region, x)
-		if !(last.low < x.low) {
-			panic("Expecting map regions to be sorted")
-		}
-		last = x
-	}
-
+	data.region = data.ParseMaps(page_table)
 }
 
+// Blocks loaded, by all traces
 var nblocks = int64(0)
 
 func (data *ProgramData) ParseBlocks(reader io.ReadSeeker) {
@@ -133,13 +171,19 @@ func (data *ProgramData) ParseBlocks(reader io.ReadSeeker) {
 		// them to the list of blocks which the ProgramData is aware of.
 
 		current_context := make(Records, 0)
+		calls := NewThreadTracker()
 		for b := range new_block {
 			b.full_data = data
 			b.context_records = current_context
 			if *use_stree {
 				b.stack_stree, current_context = b.BuildStree()
 			}
+			data.ScanMapsEvents(b.first_record, b.records)
+			b.FindTimeRange()
+			b.calls = b.BuildCallIntervals(b.first_record, calls)
 			b.ActiveRegionIDs()
+			b.ComputeDensity()
+			block_cache.Account(b, BLOCK_SUMMARY, b.summaryBytes())
 			b.vertex_data = b.GenerateVertices()
 			b.RequestTexture()
 
@@ -179,24 +223,34 @@ func (data *ProgramData) ParseBlocks(reader io.ReadSeeker) {
 	decode_records := func(block *Block, input []byte) {
 		// Allocate block.records, decode `input` into that field
 
-		exected_nrec := 10 * 1024 * 1024 / 56
-		block.records = make(Records, exected_nrec)
+		block.records = make(Records, RECORDS_PER_BLOCK)
 
 		// TODO: use known output size decompression, allegedly faster..
 		clz4.UncompressUnknownOutputSize(input, &round_1)
 		clz4.UncompressUnknownOutputSize(round_1, block.records.AsBytes())
 
 		block.nrecords = int64(len(block.records))
+		block_cache.Account(block, BLOCK_RECORDS, int64(len(block.records)*RecordSize()))
 	}
 
+	// Blocks of this trace loaded so far
+	loaded := int64(0)
+
 	create_new_block := func(block_offset int64) {
 		// A wild block appears!
 
-		block := &Block{file_offset: block_offset}
+		block := &Block{file_offset: block_offset,
+			first_record: loaded * RECORDS_PER_BLOCK}
 
 		decode_records(block, input)
+		if !WantBlock(block.records) {
+			block.records = nil
+			block_cache.Account(block, BLOCK_RECORDS, 0)
+			return
+		}
 
 		new_block <- block
+		loaded++
 		nblocks++
 	}
 
@@ -213,6 +267,10 @@ func (data *ProgramData) ParseBlocks(reader io.ReadSeeker) {
 				decode_records(block, input)
 				block.vertex_data = block.GenerateVertices()
 				block.requests.vertices = sync.Once{}
+				if block.tex == nil {
+					// It was evicted
+					block.RequestTexture()
+				}
 
 				// Continue where we left off
 				reader.Seek(current_offset, 0)
@@ -225,7 +283,7 @@ func (data *ProgramData) ParseBlocks(reader io.ReadSeeker) {
 	}
 
 	for {
-		BlockUnlessSpareRAM(500)
+		block_cache.WaitForRoom(RECORDS_PER_BLOCK * int64(RecordSize()))
 
 		current_offset := tell()
 
@@ -243,25 +301,8 @@ func (data *ProgramData) ParseBlocks(reader io.ReadSeeker) {
 	}
 }
 
-func (data *ProgramData) GetRegion(addr uint64) *MemRegion {
-
-	bi := sort.Search(len(data.region), func(i int) bool { return data.region[i].low > addr })
-
-	// TODO: More efficient implementation
-	for i := range data.region {
-		r := &data.region[i]
-		if r.low <= addr && addr < r.hi {
-			if bi != i {
-				panic("bi != i, binary search didn't agree with stupid search")
-			}
-			return r
-		}
-	}
-	return &MemRegion{addr, addr, "-", "-", "-", "-", "unknown", data}
-}
-
 func (data *ProgramData) Draw(start_index, n int64) {
-	nperblock := int64(10 * 1024 * 1024 / 56)
+	nperblock := int64(RECORDS_PER_BLOCK)
 	start_block := start_index / nperblock
 	if start_block < 0 {
 		start_block = 0
@@ -297,23 +338,109 @@ func (data *ProgramData) Draw(start_index, n int64) {
 			b.Draw(from, N, detailed)
 		}
 	})
+	data.DrawBookmarks(start_index, n)
+}
+
+// How many blocks WithBlockRecords keeps, enough for the tooltip to look
+// either side of the block under the mouse without reading any of them again
+const RECORD_CACHE_BLOCKS = 2*TOOLTIP_SEARCH_BLOCKS + 1
+
+type cachedRecords struct {
+	block   *Block
+	records Records
+}
+
+// Calls `fn` with the records of `b`, which are read back from the trace file
+// since blocks don't keep them. The last few blocks read are kept around, and
+// may be in use by other goroutines, so `fn` mustn't modify them.
+func (data *ProgramData) WithBlockRecords(b *Block, fn func(records Records)) {
+	data.record_cache_lock.Lock()
+	var records Records
+	found := false
+	for i, c := range data.record_cache {
+		if c.block == b {
+			copy(data.record_cache[1:i+1], data.record_cache[:i])
+			data.record_cache[0] = c
+			records, found = c.records, true
+			break
+		}
+	}
+	data.record_cache_lock.Unlock()
+
+	if !found {
+		// Not under the lock, other lookups needn't wait for the disk
+		fd := data.OpenBlocks()
+		_, err := fd.Seek(b.file_offset, 0)
+		if err != nil {
+			log.Panic(err)
+		}
+		records = NewBlockReader(fd).Next()
+		fd.Close()
+
+		data.record_cache_lock.Lock()
+		// Another goroutine may have read it meanwhile
+		for i, c := range data.record_cache {
+			if c.block == b {
+				data.record_cache = append(data.record_cache[:i], data.record_cache[i+1:]...)
+				break
+			}
+		}
+		data.record_cache = append([]cachedRecords{{b, records}}, data.record_cache...)
+		var dropped *Block
+		if len(data.record_cache) > RECORD_CACHE_BLOCKS {
+			dropped = data.record_cache[RECORD_CACHE_BLOCKS].block
+			data.record_cache = data.record_cache[:RECORD_CACHE_BLOCKS]
+		}
+		data.record_cache_lock.Unlock()
+
+		block_cache.Account(b, BLOCK_CACHED_RECORDS, int64(len(records)*RecordSize()))
+		if dropped != nil {
+			block_cache.Account(dropped, BLOCK_CACHED_RECORDS, 0)
+		}
+	}
+	fn(records)
 }
 
-func (data *ProgramData) GetRecord(i int64) *Record {
-	// TODO: determine block from `i`
-	return nil
-	if i >= 0 && i < data.blocks[0].nrecords {
-		return &data.blocks[0].records[i]
+// Drops the records of `b` read back by WithBlockRecords, if they are cached
+func (data *ProgramData) dropCachedRecords(b *Block) {
+	data.record_cache_lock.Lock()
+	found := false
+	for i, c := range data.record_cache {
+		if c.block == b {
+			data.record_cache = append(data.record_cache[:i], data.record_cache[i+1:]...)
+			found = true
+			break
+		}
 	}
-	return nil
+	data.record_cache_lock.Unlock()
+	if found {
+		block_cache.Account(b, BLOCK_CACHED_RECORDS, 0)
+	}
+}
+
+// Returns a copy of record `i` of `blocks`. Blocks discard their records once
+// drawn, so this reads the block back from disk.
+func (data *ProgramData) GetRecord(blocks []*Block, i int64) *Record {
+	b := BlockOf(blocks, i)
+	if b == nil {
+		return nil
+	}
+	var result *Record
+	data.WithBlockRecords(b, func(records Records) {
+		j := i - b.first_record
+		if j < int64(len(records)) {
+			r := records[j]
+			result = &r
+		}
+	})
+	return result
 }
 
-func (data *ProgramData) GetStackNames(i int64) []string {
-	records_per_block := (int64)(10 * 1024 * 1024 / 56)
-	block_index := i / records_per_block
-	internal_index := i % records_per_block
-	if block_index >= 0 && block_index < int64(len(data.blocks)) {
-		return data.blocks[block_index].GetStackNames(internal_index)
+func (data *ProgramData) GetStackNames(blocks []*Block, i int64) []string {
+	stack := CallsAt(blocks, i)
+	result := make([]string, len(stack))
+	for j := range stack {
+		result[j] = data.FunctionName(stack[j].Func)
 	}
-	return []string{}
+	return result
 }
@@ -0,0 +1,28 @@
+package main
+
+import "testing"
+
+func TestAccessSize(t *testing.T) {
+	tests := []struct {
+		version int
+		size    uint8
+		want    uint64
+		ok      bool
+	}{
+		{3, 8, 8, true},
+		{3, 1, 1, true},
+		// memset and friends
+		{3, 0, 0, false},
+		// Older traces left the byte as it was
+		{2, 8, 0, false},
+		{1, 4, 0, false},
+	}
+	for _, test := range tests {
+		data := &ProgramData{version: test.version}
+		size, ok := data.AccessSize(&MemAccess{Size: test.size})
+		if size != test.want || ok != test.ok {
+			t.Errorf("version %d AccessSize(size %d) = %d, %v, want %d, %v",
+				test.version, test.size, size, ok, test.want, test.ok)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+// debugfile.go: finding the separate debug file of a binary, by build ID or
+//               .gnu_debuglink, as described in
+//               http://sourceware.org/gdb/onlinedocs/gdb/Separate-Debug-Files.html
+
+package main
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"encoding/hex"
+	"flag"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var debug_dirs = flag.String("debug-dirs", "/usr/lib/debug",
+	"colon separated list of global debug directories")
+var debuginfod_dirs = flag.String("debuginfod-dirs", "",
+	"colon separated list of directories with a debuginfod client cache layout "+
+		"(<dir>/<build-id>/debuginfo). Default $DEBUGINFOD_CACHE_PATH or "+
+		"~/.cache/debuginfod_client")
+
+const NT_GNU_BUILD_ID = 3
+
+// Returns the hex encoded GNU build ID of `file`, or "" if it has none
+func BuildID(file *elf.File) string {
+	for _, s := range file.Sections {
+		if s.Type != elf.SHT_NOTE {
+			continue
+		}
+		data, err := s.Data()
+		if err != nil {
+			continue
+		}
+		if id := findBuildIDNote(data, file.ByteOrder); id != "" {
+			return id
+		}
+	}
+	return ""
+}
+
+func findBuildIDNote(notes []byte, order binary.ByteOrder) string {
+	align4 := func(n uint32) uint32 { return (n + 3) &^ 3 }
+	for len(notes) >= 12 {
+		namesz := order.Uint32(notes[0:])
+		descsz := order.Uint32(notes[4:])
+		note_type := order.Uint32(notes[8:])
+		notes = notes[12:]
+		if uint64(align4(namesz))+uint64(align4(descsz)) > uint64(len(notes)) {
+			break
+		}
+		name := notes[:namesz]
+		desc := notes[align4(namesz) : align4(namesz)+descsz]
+		notes = notes[align4(namesz)+align4(descsz):]
+
+		if note_type == NT_GNU_BUILD_ID && string(bytes.TrimRight(name, "\x00")) == "GNU" {
+			return hex.EncodeToString(desc)
+		}
+	}
+	return ""
+}
+
+func splitDirs(dirs string) []string {
+	result := []string{}
+	for _, d := range strings.Split(dirs, ":") {
+		if d != "" {
+			result = append(result, d)
+		}
+	}
+	return result
+}
+
+func DebuginfodDirs() []string {
+	if *debuginfod_dirs != "" {
+		return splitDirs(*debuginfod_dirs)
+	}
+	if dir := os.Getenv("DEBUGINFOD_CACHE_PATH"); dir != "" {
+		return []string{dir}
+	}
+	if dir, err := os.UserCacheDir(); err == nil {
+		return []string{filepath.Join(dir, "debuginfod_client")}
+	}
+	return []string{}
+}
+
+// Returns the name stored in the .gnu_debuglink section, if there is one
+func DebugLink(file *elf.File) string {
+	s := file.Section(".gnu_debuglink")
+	if s == nil {
+		return ""
+	}
+	data, err := s.Data()
+	if err != nil {
+		return ""
+	}
+	nul := bytes.IndexByte(data, 0)
+	if nul < 0 {
+		return ""
+	}
+	return string(data[:nul])
+}
+
+// Returns the places where the debug file for `path` might be, best first
+func DebugFileCandidates(path, build_id, debuglink string) []string {
+	result := []string{}
+
+	if len(build_id) > 2 {
+		for _, dir := range splitDirs(*debug_dirs) {
+			result = append(result, filepath.Join(dir, ".build-id",
+				build_id[:2], build_id[2:]+".debug"))
+		}
+		for _, dir := range DebuginfodDirs() {
+			result = append(result, filepath.Join(dir, build_id, "debuginfo"))
+		}
+	}
+
+	debugname := debuglink
+	if debugname == "" {
+		debugname = filepath.Base(path)
+	}
+	file_dir := filepath.Dir(path)
+	if debuglink != "" && debuglink != filepath.Base(path) {
+		result = append(result, filepath.Join(file_dir, debugname))
+	}
+	result = append(result, filepath.Join(file_dir, ".debug", debugname))
+	for _, dir := range splitDirs(*debug_dirs) {
+		result = append(result, filepath.Join(dir, file_dir, debugname))
+		if strings.Contains(file_dir, "lib64") {
+			result = append(result, filepath.Join(dir,
+				strings.Replace(file_dir, "lib64", "lib", -1), debugname))
+		}
+	}
+	return result
+}
+
+// Returns the separate debug file for the binary at `path`, or "". If the
+// binary has a build ID, `build_id`, the debug file's must match.
+func GetDebugFilename(path string, file *elf.File, build_id string) string {
+	debuglink := DebugLink(file)
+
+	for _, candidate := range DebugFileCandidates(path, build_id, debuglink) {
+		if !exists(candidate) {
+			continue
+		}
+		if build_id != "" {
+			debug_file, err := elf.Open(candidate)
+			if err != nil {
+				log.Printf("Can't open debug file %s: %v", candidate, err)
+				continue
+			}
+			debug_build_id := BuildID(debug_file)
+			debug_file.Close()
+			if debug_build_id != build_id {
+				log.Printf("Ignoring %s, its build ID %q doesn't match %q of %s",
+					candidate, debug_build_id, build_id, path)
+				continue
+			}
+		}
+		if *verbose {
+			log.Printf("Using debug file %s for %s", candidate, path)
+		}
+		return candidate
+	}
+	return ""
+}
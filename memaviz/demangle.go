@@ -1,36 +1,21 @@
-// +build cgo
+// demangle.go: turning mangled C++ (Itanium ABI) and Rust symbol names back
+//              into source names
 
 package main
 
 import (
-	//"log"
-	"unsafe"
+	"flag"
+
+	demangler "github.com/ianlancetaylor/demangle"
 )
 
-// #cgo LDFLAGS: -lstdc++
-// // #include <stddef.h>
-// #include <stdlib.h>
-// char* __cxa_demangle(const char* __mangled_name, char* __output_buffer,
-//					    size_t* __length, int* __status);
-import "C"
+var simple_names = flag.Bool("simple-names", false,
+	"leave template arguments out of demangled names (toggle with T in the viewer)")
 
+// Returns `sym` demangled, or unchanged if it isn't a mangled name
 func demangle(sym string) string {
-
-	csym := C.CString(sym)
-	defer C.free(unsafe.Pointer(csym))
-
-	var status C.int
-
-	// __cxa_demangle has a length field, but it's the length of the buffer,
-	// not the length of the resulting string.
-	cdemangled := C.__cxa_demangle(csym, nil, nil, &status)
-	if status != C.int(0) {
-		// Demangling failed for some reason (e.g, it's not a mangled sym)
-		return sym
+	if *simple_names {
+		return demangler.Filter(sym, demangler.NoTemplateParams)
 	}
-	defer C.free(unsafe.Pointer(cdemangled))
-
-	sym = C.GoString(cdemangled)
-
-	return sym
+	return demangler.Filter(sym)
 }
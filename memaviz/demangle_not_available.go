@@ -1,7 +0,0 @@
-// +build !cgo
-
-package main
-
-func demangle(sym string) string {
-	return sym
-}
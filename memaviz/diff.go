@@ -0,0 +1,455 @@
+// diff.go: comparing two traces, e.g. of a kernel before and after a change,
+//          function by function and side by side in the viewer
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"sort"
+
+	"github.com/go-gl/gl"
+	"github.com/go-gl/glh"
+)
+
+var diff_depth = flag.Int("diff-depth", 8, "diff aligns the calls up to this deep")
+var diff_sort = flag.String("diff-sort", "accesses",
+	"order of the diff, by the size of the change: accesses, lines or misses")
+var split_view = flag.Bool("split", false,
+	"diff shows the traces side by side in the viewer, scrolling together, rather than printing")
+
+// A call made in a trace, from the record of its enter to just after its exit
+type TraceCall struct {
+	// Index into CallAlignment.Paths
+	Path       int
+	Start, End int64
+	// The call it was made from, or -1
+	Parent int
+}
+
+// The calls of two traces, paired up by the calls they were made from: calls
+// of the same function made from aligned calls (or at the top level) are
+// aligned in the order they were made
+type CallAlignment struct {
+	// Names of the paths of calls, e.g. "main;solve;kernel"
+	Paths []string
+	// For each trace, its calls in the order they were made
+	Calls [2][]TraceCall
+	// Match[t][k] is the call of the other trace aligned with call k of trace
+	// t, or -1
+	Match [2][]int
+	// Number of records of each trace
+	Records [2]int64
+}
+
+type callPathKey struct {
+	parent int
+	name   string
+}
+
+// Lists the calls of the trace up to -diff-depth deep, and returns them with
+// the number of records. `paths` and `names` give the call paths ids, and are
+// shared between the traces being aligned.
+func (data *ProgramData) ListCalls(paths map[callPathKey]int, names *[]string) ([]TraceCall, int64) {
+	calls := []TraceCall{}
+	// The calls being made by each thread of each process, with -1 for those
+	// too deep to list
+	stacks := make(map[ThreadMarker][]int)
+	var thread ThreadMarker
+	last := int64(-1)
+
+	data.ForEachRecord(func(index int64, r *Record) {
+		last = index
+		switch r.Type {
+		case MEMA_THREAD:
+			thread = *r.ThreadMarker()
+
+		case MEMA_FUNC_ENTER:
+			stack := stacks[thread]
+			k := -1
+			if len(stack) < *diff_depth {
+				parent, parent_path := -1, -1
+				if len(stack) > 0 {
+					parent = stack[len(stack)-1]
+					parent_path = calls[parent].Path
+				}
+				key := callPathKey{parent_path, data.FunctionName(r.FunctionCall().FuncPointer)}
+				path, ok := paths[key]
+				if !ok {
+					path = len(*names)
+					name := key.name
+					if parent_path >= 0 {
+						name = (*names)[parent_path] + ";" + name
+					}
+					*names = append(*names, name)
+					paths[key] = path
+				}
+				k = len(calls)
+				calls = append(calls, TraceCall{path, index, -1, parent})
+			}
+			stacks[thread] = append(stack, k)
+
+		case MEMA_FUNC_EXIT:
+			stack := stacks[thread]
+			if len(stack) == 0 {
+				// Entered before the trace started
+				return
+			}
+			if k := stack[len(stack)-1]; k >= 0 {
+				calls[k].End = index + 1
+			}
+			stacks[thread] = stack[:len(stack)-1]
+		}
+	})
+
+	// Calls which were still being made at the end
+	for k := range calls {
+		if calls[k].End < 0 {
+			calls[k].End = last + 1
+		}
+	}
+	return calls, last + 1
+}
+
+// Lists the calls of both traces and aligns them
+func AlignCalls(traces [2]*ProgramData) *CallAlignment {
+	al := &CallAlignment{}
+	paths := make(map[callPathKey]int)
+	for t, data := range traces {
+		al.Calls[t], al.Records[t] = data.ListCalls(paths, &al.Paths)
+		al.Match[t] = make([]int, len(al.Calls[t]))
+		for k := range al.Match[t] {
+			al.Match[t][k] = -1
+		}
+	}
+
+	// Calls are keyed by the call of the first trace they were made from,
+	// their path and how many calls with the same path that call made before
+	// them. Parents are listed before their children, so they are aligned
+	// first.
+	type key struct{ parent, path, n int }
+	type sibling struct{ parent, path int }
+	first := make(map[key]int)
+	for t := range al.Calls {
+		seen := make(map[sibling]int)
+		for k, c := range al.Calls[t] {
+			parent := c.Parent
+			if t == 1 && parent >= 0 {
+				if parent = al.Match[1][parent]; parent < 0 {
+					continue
+				}
+			}
+			n := seen[sibling{parent, c.Path}]
+			seen[sibling{parent, c.Path}] = n + 1
+
+			if t == 0 {
+				first[key{parent, c.Path, n}] = k
+			} else if j, ok := first[key{parent, c.Path, n}]; ok {
+				al.Match[0][j], al.Match[1][k] = k, j
+			}
+		}
+	}
+	return al
+}
+
+// Returns the innermost aligned call of trace `t` made at record `index`
+func (al *CallAlignment) MatchedCallAt(t int, index int64) (int, bool) {
+	calls := al.Calls[t]
+	k := sort.Search(len(calls), func(k int) bool {
+		return calls[k].Start > index
+	}) - 1
+	for k >= 0 && (calls[k].End <= index || al.Match[t][k] < 0) {
+		k = calls[k].Parent
+	}
+	return k, k >= 0
+}
+
+// Returns the view of the second trace which corresponds to the view of
+// records [start, start+n) of the first, and the aligned call of the first
+// it is worked out from (or -1). The centres of the views are at the same
+// place in the two calls, and the heights in proportion to their lengths.
+func (al *CallAlignment) MapView(start, n int64) (int64, int64, int) {
+	centre := start + n/2
+	a0, a1, b0, b1 := int64(0), al.Records[0], int64(0), al.Records[1]
+	k, ok := al.MatchedCallAt(0, centre)
+	if ok {
+		a, b := al.Calls[0][k], al.Calls[1][al.Match[0][k]]
+		a0, a1, b0, b1 = a.Start, a.End, b.Start, b.End
+	}
+	if a1 <= a0 || b1 <= b0 {
+		return start, n, -1
+	}
+	ratio := float64(b1-b0) / float64(a1-a0)
+	n2 := int64(float64(n) * ratio)
+	if n2 < 64 {
+		n2 = 64
+	}
+	centre2 := b0 + int64(float64(centre-a0)*ratio)
+	return centre2 - n2/2, n2, k
+}
+
+type FunctionDiff struct {
+	Name string
+	// Inclusive counts in each trace
+	Counts [2]ProfileCounts
+	Calls  [2]uint64
+}
+
+type FunctionDiffsBy struct {
+	diffs []*FunctionDiff
+	key   func(d *FunctionDiff, t int) uint64
+}
+
+func absDiff(a, b uint64) uint64 {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
+
+func (p FunctionDiffsBy) Len() int { return len(p.diffs) }
+func (p FunctionDiffsBy) Less(i, j int) bool {
+	di, dj := p.diffs[i], p.diffs[j]
+	ki := absDiff(p.key(di, 0), p.key(di, 1))
+	kj := absDiff(p.key(dj, 0), p.key(dj, 1))
+	if ki != kj {
+		return ki > kj
+	}
+	return di.Name < dj.Name
+}
+func (p FunctionDiffsBy) Swap(i, j int) { p.diffs[i], p.diffs[j] = p.diffs[j], p.diffs[i] }
+
+// Works out the profile of each trace, with the functions keyed by name since
+// the traces may be of different builds
+func DiffFunctions(traces [2]*ProgramData) (map[string]*FunctionDiff, [2]*FunctionProfiles) {
+	diffs := make(map[string]*FunctionDiff)
+	var profiles [2]*FunctionProfiles
+	for t, data := range traces {
+		profiles[t] = data.BuildProfile()
+		for _, fp := range profiles[t].functions {
+			name := data.FunctionName(fp.Func)
+			d, ok := diffs[name]
+			if !ok {
+				d = &FunctionDiff{Name: name}
+				diffs[name] = d
+			}
+			d.Counts[t].AddCounts(&fp.Inclusive)
+			d.Calls[t] += fp.Calls
+		}
+	}
+	return diffs, profiles
+}
+
+// Describes the change from `a` to `b`
+func change(a, b uint64) string {
+	switch {
+	case a == b:
+		return "="
+	case a == 0:
+		return "new"
+	}
+	return fmt.Sprintf("%+.1f%%", 100*(float64(b)-float64(a))/float64(a))
+}
+
+type AlignedCallsByChange struct {
+	al    *CallAlignment
+	calls []int
+}
+
+func (p AlignedCallsByChange) length(k int) (uint64, uint64) {
+	a, b := p.al.Calls[0][k], p.al.Calls[1][p.al.Match[0][k]]
+	return uint64(a.End - a.Start), uint64(b.End - b.Start)
+}
+
+func (p AlignedCallsByChange) Len() int { return len(p.calls) }
+func (p AlignedCallsByChange) Less(i, j int) bool {
+	ai, bi := p.length(p.calls[i])
+	aj, bj := p.length(p.calls[j])
+	if absDiff(ai, bi) != absDiff(aj, bj) {
+		return absDiff(ai, bi) > absDiff(aj, bj)
+	}
+	return p.calls[i] < p.calls[j]
+}
+func (p AlignedCallsByChange) Swap(i, j int) { p.calls[i], p.calls[j] = p.calls[j], p.calls[i] }
+
+// The "diff" action
+func Diff(before, after *ProgramData) {
+	traces := [2]*ProgramData{before, after}
+
+	var key func(d *FunctionDiff, t int) uint64
+	switch *diff_sort {
+	case "accesses":
+		key = func(d *FunctionDiff, t int) uint64 { return d.Counts[t].Total() }
+	case "lines":
+		key = func(d *FunctionDiff, t int) uint64 { return d.Counts[t].Lines }
+	case "misses":
+		key = func(d *FunctionDiff, t int) uint64 { return d.Counts[t].Misses }
+	default:
+		log.Fatalf("Unknown -diff-sort %q", *diff_sort)
+	}
+
+	by_name, profiles := DiffFunctions(traces)
+	al := AlignCalls(traces)
+
+	for t, data := range traces {
+		total := &profiles[t].Total
+		fmt.Printf("%-7s %s: %d accesses, %d distinct lines, %d simulated misses, %d calls listed\n",
+			[]string{"before", "after"}[t], data.filename, total.Total(), total.Lines,
+			total.Misses, len(al.Calls[t]))
+	}
+	aligned := []int{}
+	for k, j := range al.Match[0] {
+		if j >= 0 {
+			aligned = append(aligned, k)
+		}
+	}
+	fmt.Printf("%d calls aligned, up to %d deep, in a %d byte %d-way cache with %d byte lines\n\n",
+		len(aligned), *diff_depth, *cache_size, *cache_ways, *LINE_SIZE)
+
+	diffs := make([]*FunctionDiff, 0, len(by_name))
+	for _, d := range by_name {
+		diffs = append(diffs, d)
+	}
+	sort.Sort(FunctionDiffsBy{diffs, key})
+
+	fmt.Printf("%31s | %26s | %26s | %17s |\n", "accesses", "distinct lines", "misses", "calls")
+	fmt.Printf("%10s %10s %9s | %8s %8s %8s | %8s %8s %8s | %8s %8s |  %s\n",
+		"before", "after", "change", "before", "after", "change",
+		"before", "after", "change", "before", "after", "function")
+	for i, d := range diffs {
+		if *top_n > 0 && i >= *top_n {
+			break
+		}
+		a, b := &d.Counts[0], &d.Counts[1]
+		la, lb := a.Lines, b.Lines
+		fmt.Printf("%10d %10d %9s | %8d %8d %8s | %8d %8d %8s | %8d %8d |  %s\n",
+			a.Total(), b.Total(), change(a.Total(), b.Total()),
+			la, lb, change(la, lb),
+			a.Misses, b.Misses, change(a.Misses, b.Misses),
+			d.Calls[0], d.Calls[1], d.Name)
+	}
+
+	fmt.Printf("\nAligned calls whose length changed the most, in records:\n")
+	sort.Sort(AlignedCallsByChange{al, aligned})
+	for i, k := range aligned {
+		if *top_n > 0 && i >= *top_n {
+			break
+		}
+		a, b := al.Calls[0][k], al.Calls[1][al.Match[0][k]]
+		fmt.Printf("%10d %10d %9s  %s  (#%d-%d, #%d-%d)\n", a.End-a.Start, b.End-b.Start,
+			change(uint64(a.End-a.Start), uint64(b.End-b.Start)), al.Paths[a.Path],
+			a.Start, a.End, b.Start, b.End)
+	}
+}
+
+// Draws a second trace to the right of the first in the viewer, following it
+// through their aligned calls
+type DiffView struct {
+	traces [2]*ProgramData
+	// Nil until the calls have been aligned
+	alignment *CallAlignment
+	// Captions of the two halves, and the aligned call they describe
+	labels     [2]*glh.Text
+	label_call int
+}
+
+// Aligns the calls of the traces in the background
+func NewDiffView(data, other *ProgramData) *DiffView {
+	v := &DiffView{traces: [2]*ProgramData{data, other}, label_call: -2}
+	go func() {
+		al := AlignCalls(v.traces)
+		main_thread_work <- func() {
+			v.alignment = al
+			v.label_call = -2
+		}
+	}()
+	return v
+}
+
+// Directs drawing to the left half of the window, where the first trace is
+// drawn and the mouse works
+func (v *DiffView) Left() {
+	gl.Viewport(0, 0, window_width/2, window_height)
+}
+
+func (v *DiffView) updateLabels(k int) {
+	text := [2]string{v.traces[0].filename, v.traces[1].filename}
+	switch {
+	case v.alignment == nil:
+		text[1] += ", aligning calls..."
+	case k >= 0:
+		al := v.alignment
+		a, b := al.Calls[0][k], al.Calls[1][al.Match[0][k]]
+		text[0] += fmt.Sprintf(" in %s, %d records", al.Paths[a.Path], a.End-a.Start)
+		text[1] += fmt.Sprintf(" in %s, %d records (%s)", al.Paths[b.Path], b.End-b.Start,
+			change(uint64(a.End-a.Start), uint64(b.End-b.Start)))
+	}
+	for t := range v.labels {
+		if v.labels[t] != nil {
+			v.labels[t].Destroy()
+		}
+		v.labels[t] = glh.MakeText(text[t], 32)
+	}
+	v.label_call = k
+}
+
+// Marks call `c` across the plot of records [start_index, start_index+n)
+func DrawCallBand(c TraceCall, start_index, n int64) {
+	glh.With(glh.Matrix{gl.MODELVIEW}, func() {
+		gl.Translated(0, -2, 0)
+		gl.Scaled(1, 4/float64(n), 1)
+		gl.Translated(0, -float64(start_index), 0)
+
+		gl.Color4f(1, 1, 1, 0.06)
+		glh.With(glh.Primitive{gl.QUADS}, func() {
+			glh.Squared(-2, float64(c.Start), 4, float64(c.End-c.Start))
+		})
+		gl.Color4f(1, 1, 1, 0.5)
+		glh.With(glh.Primitive{gl.LINES}, func() {
+			gl.Vertex2d(-2, float64(c.Start))
+			gl.Vertex2d(2, float64(c.Start))
+			gl.Vertex2d(-2, float64(c.End))
+			gl.Vertex2d(2, float64(c.End))
+		})
+	})
+}
+
+func drawCaption(text *glh.Text) {
+	glh.With(glh.WindowCoords{}, func() {
+		_, h := glh.GetViewportWHD()
+		glh.With(glh.Attrib{gl.ENABLE_BIT}, func() {
+			gl.Enable(gl.TEXTURE_2D)
+			text.Draw(10, int(h)-19)
+		})
+	})
+}
+
+// Draws the aligned call in the view of records [start_index, start_index+n)
+// of the first trace, then the second trace in the right half of the window
+func (v *DiffView) Draw(start_index, n int64) {
+	start2, n2, k := start_index, n, -1
+	if v.alignment != nil {
+		start2, n2, k = v.alignment.MapView(start_index, n)
+	}
+	if k != v.label_call {
+		v.updateLabels(k)
+	}
+
+	if k >= 0 {
+		DrawCallBand(v.alignment.Calls[0][k], start_index, n)
+	}
+	drawCaption(v.labels[0])
+
+	gl.Viewport(window_width/2, 0, window_width-window_width/2, window_height)
+	other := v.traces[1]
+	other.Draw(start2, n2)
+	other.DrawFlame(start2, n2)
+	other.DrawMinimap(start2, n2, nil)
+	if k >= 0 {
+		DrawCallBand(v.alignment.Calls[1][v.alignment.Match[0][k]], start2, n2)
+	}
+	drawCaption(v.labels[1])
+
+	v.Left()
+}
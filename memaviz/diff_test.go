@@ -0,0 +1,126 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+var testFunctionNames = map[uint64]string{1: "main", 2: "f", 3: "g", 4: "h"}
+
+// Writes a trace of main calling each of `calls` in turn, each of which makes
+// as many accesses as its function pointer
+func writeCallsTrace(t *testing.T, dir, name string, calls ...uint64) *ProgramData {
+	b := Records{threadRecord(1), callRecord(MEMA_FUNC_ENTER, 1)}
+	for _, f := range calls {
+		b = append(b, callRecord(MEMA_FUNC_ENTER, f))
+		for i := uint64(0); i < f; i++ {
+			b = append(b, accessRecord(f, 0))
+		}
+		b = append(b, callRecord(MEMA_FUNC_EXIT, f))
+	}
+	b = append(b, callRecord(MEMA_FUNC_EXIT, 1))
+
+	data := writeTestTrace(t, dir, name, b)
+	for f, name := range testFunctionNames {
+		data.function_names[f] = name
+	}
+	return data
+}
+
+func TestAlignCalls(t *testing.T) {
+	dir := testTraceDir(t)
+	defer os.RemoveAll(dir)
+
+	// main { f g f } and main { f h g f f }
+	al := AlignCalls([2]*ProgramData{
+		writeCallsTrace(t, dir, "a.mema", 2, 3, 2),
+		writeCallsTrace(t, dir, "b.mema", 2, 4, 3, 2, 2),
+	})
+
+	if want := []string{"main", "main;f", "main;g", "main;h"}; !reflect.DeepEqual(al.Paths, want) {
+		t.Errorf("Paths = %q, want %q", al.Paths, want)
+	}
+	if want := [2]int64{16, 26}; al.Records != want {
+		t.Errorf("Records = %v, want %v", al.Records, want)
+	}
+	want_calls := [2][]TraceCall{{
+		{0, 1, 16, -1},
+		{1, 2, 6, 0},
+		{2, 6, 11, 0},
+		{1, 11, 15, 0},
+	}, {
+		{0, 1, 26, -1},
+		{1, 2, 6, 0},
+		{3, 6, 12, 0},
+		{2, 12, 17, 0},
+		{1, 17, 21, 0},
+		{1, 21, 25, 0},
+	}}
+	if !reflect.DeepEqual(al.Calls, want_calls) {
+		t.Errorf("Calls = %v, want %v", al.Calls, want_calls)
+	}
+	want_match := [2][]int{{0, 1, 3, 4}, {0, 1, -1, 2, 3, -1}}
+	if !reflect.DeepEqual(al.Match, want_match) {
+		t.Errorf("Match = %v, want %v", al.Match, want_match)
+	}
+
+	// h isn't aligned with anything, so within it main is
+	if k, ok := al.MatchedCallAt(1, 8); k != 0 || !ok {
+		t.Errorf("MatchedCallAt(1, 8) = %d, %v, want 0, true", k, ok)
+	}
+	if k, ok := al.MatchedCallAt(0, 0); ok {
+		t.Errorf("MatchedCallAt(0, 0) = %d, %v, want no call", k, ok)
+	}
+
+	tests := []struct {
+		start, n   int64
+		want_start int64
+		want_n     int64
+		want_call  int
+	}{
+		// Centred on the first f, the same length in both
+		{-47, 100, -47, 100, 1},
+		// Centred on g, at least 64 records tall
+		{3, 10, -18, 64, 2},
+		// Centred on the thread marker, so the whole of the traces
+		{-50, 100, -81, 162, -1},
+	}
+	for _, test := range tests {
+		start, n, k := al.MapView(test.start, test.n)
+		if start != test.want_start || n != test.want_n || k != test.want_call {
+			t.Errorf("MapView(%d, %d) = %d, %d, %d, want %d, %d, %d", test.start, test.n,
+				start, n, k, test.want_start, test.want_n, test.want_call)
+		}
+	}
+}
+
+func TestListCallsProcesses(t *testing.T) {
+	dir := testTraceDir(t)
+	defer os.RemoveAll(dir)
+
+	// Thread 1 of two processes of a merged trace: main { g } and f
+	marker := func(pid uint64) Record {
+		r := threadRecord(1)
+		r.ThreadMarker().Pid = pid
+		return r
+	}
+	data := writeTestTrace(t, dir, "merged.mema",
+		Records{marker(1), callRecord(MEMA_FUNC_ENTER, 1)},
+		Records{marker(2), callRecord(MEMA_FUNC_ENTER, 2), callRecord(MEMA_FUNC_EXIT, 2)},
+		Records{marker(1), callRecord(MEMA_FUNC_ENTER, 3), callRecord(MEMA_FUNC_EXIT, 3),
+			callRecord(MEMA_FUNC_EXIT, 1)})
+	for f, name := range testFunctionNames {
+		data.function_names[f] = name
+	}
+
+	names := []string{}
+	calls, _ := data.ListCalls(make(map[callPathKey]int), &names)
+	got := []string{}
+	for _, c := range calls {
+		got = append(got, names[c.Path])
+	}
+	if want := []string{"main", "f", "main;g"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ListCalls listed %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,390 @@
+// dwarf.go: finding the scopes, source lines and inlined calls which cover an
+//           instruction address
+
+package main
+
+import (
+	"debug/dwarf"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+)
+
+// A DWARF entry which covers some code (compilation unit, subprogram,
+// inlined subroutine, lexical block, ...). What SourceLocations needs is
+// copied out of the entry, so that a cached binary doesn't need its DWARF.
+type DwarfScope struct {
+	Offset dwarf.Offset
+	Tag    dwarf.Tag
+	// Nesting depth in the DWARF tree, the compilation unit is 0
+	Depth int
+	// Index into Binary.dwarf_files
+	Unit int
+	// Function name of a subprogram or inlined subroutine (see EntryName)
+	Name string
+	// Call site of an inlined subroutine
+	CallFile             string
+	CallLine, CallColumn int
+}
+
+type LineRow struct {
+	Address      uint64
+	File         string
+	Line, Column int
+	// The first address after a sequence, which has no line
+	End bool
+}
+
+type LineRowsByAddress []LineRow
+
+func (p LineRowsByAddress) Len() int { return len(p) }
+func (p LineRowsByAddress) Less(i, j int) bool {
+	if p[i].Address != p[j].Address {
+		return p[i].Address < p[j].Address
+	}
+	// A sequence may start where another ends
+	return p[i].End && !p[j].End
+}
+func (p LineRowsByAddress) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+
+// One level of the (possibly inlined) source call chain at an address
+type SourceLocation struct {
+	Function     string
+	File         string
+	Line, Column int
+	// This location was inlined into the one which follows it
+	Inlined bool
+}
+
+func (l SourceLocation) String() string {
+	s := fmt.Sprintf("%s at %s:%d:%d", l.Function, l.File, l.Line, l.Column)
+	if l.Inlined {
+		s += " (inlined)"
+	}
+	return s
+}
+
+// Reads the line and file tables of every compilation unit
+func (b *Binary) IndexLines() {
+	dr := b.Dwarf().Reader()
+	for {
+		cu, err := dr.Next()
+		if err != nil {
+			log.Panic("Error reading dwarf: ", err)
+		}
+		if cu == nil {
+			break
+		}
+		if cu.Tag == dwarf.TagCompileUnit {
+			b.dwarf_files = append(b.dwarf_files, b.ReadLines(cu))
+		}
+		dr.SkipChildren()
+	}
+	sort.Stable(LineRowsByAddress(b.lines))
+}
+
+// Indexes every entry with code ranges and every variable with a fixed
+// address. This walks the whole of the DWARF, so it is only done once
+// something needs it, and the result is added to the symbol cache.
+func (b *Binary) IndexScopes() {
+	b.scopes_once.Do(func() {
+		if b.Dwarf() != nil {
+			intervals := b.indexScopes()
+			b.dwarf_tree = NewIntervalTree(intervals)
+			b.SaveSymbolCache()
+		}
+	})
+}
+
+// Returns the code ranges of b.dwarf_scopes
+func (b *Binary) indexScopes() []Interval {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	intervals := []Interval{}
+	dr := b.dwarf.Reader()
+	depth, unit := 0, -1
+
+	for {
+		entry, err := dr.Next()
+		if err != nil {
+			log.Panic("Error reading dwarf: ", err)
+		}
+		if entry == nil {
+			break
+		}
+		if entry.Tag == 0 {
+			// End of a list of children
+			depth--
+			continue
+		}
+
+		d := depth
+		if entry.Children {
+			depth++
+		}
+		switch entry.Tag {
+		case dwarf.TagCompileUnit:
+			unit++
+		case dwarf.TagVariable:
+			b.indexVariable(entry)
+		}
+
+		ranges, err := b.dwarf.Ranges(entry)
+		if err != nil || len(ranges) == 0 {
+			continue
+		}
+		id := len(b.dwarf_scopes)
+		b.dwarf_scopes = append(b.dwarf_scopes, b.newScope(entry, d, unit))
+		for _, r := range ranges {
+			if r[1] > r[0] {
+				intervals = append(intervals, Interval{r[0], r[1], id})
+			}
+		}
+	}
+
+	if *verbose {
+		log.Printf("Building dwarf tree for %s (%d scopes, %d variables)..",
+			b.pathname, len(b.dwarf_scopes), len(b.variables))
+	}
+	sort.Sort(DwarfVariablesByAddr(b.variables))
+	return intervals
+}
+
+func (b *Binary) newScope(e *dwarf.Entry, depth, unit int) DwarfScope {
+	s := DwarfScope{Offset: e.Offset, Tag: e.Tag, Depth: depth, Unit: unit}
+	switch e.Tag {
+	case dwarf.TagInlinedSubroutine:
+		s.CallFile = b.unitFileName(unit, e.Val(dwarf.AttrCallFile))
+		s.CallLine = intVal(e, dwarf.AttrCallLine)
+		s.CallColumn = intVal(e, dwarf.AttrCallColumn)
+		fallthrough
+	case dwarf.TagSubprogram:
+		s.Name = b.EntryName(e)
+	}
+	return s
+}
+
+// Reads the DWARF entry of scope `s`
+func (b *Binary) ScopeEntry(s *DwarfScope) *dwarf.Entry {
+	dw := b.Dwarf()
+	if dw == nil {
+		return nil
+	}
+	r := dw.Reader()
+	r.Seek(s.Offset)
+	e, err := r.Next()
+	if err != nil {
+		return nil
+	}
+	return e
+}
+
+// Appends the line table of compilation unit `cu` to b.lines, returning the
+// names in its file table
+func (b *Binary) ReadLines(cu *dwarf.Entry) []string {
+	lr, err := b.Dwarf().LineReader(cu)
+	if err != nil || lr == nil {
+		return nil
+	}
+	var le dwarf.LineEntry
+	for {
+		err := lr.Next(&le)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Printf("Error reading line table of %s: %v", b.pathname, err)
+			break
+		}
+		file := ""
+		if le.File != nil {
+			file = le.File.Name
+		}
+		b.lines = append(b.lines,
+			LineRow{le.Address, file, le.Line, le.Column, le.EndSequence})
+	}
+	files := make([]string, len(lr.Files()))
+	for i, f := range lr.Files() {
+		if f != nil {
+			files[i] = f.Name
+		}
+	}
+	return files
+}
+
+// Returns the line table row covering the link-time address `addr`
+func (b *Binary) LineAt(addr uint64) (*LineRow, bool) {
+	i := sort.Search(len(b.lines), func(i int) bool {
+		return b.lines[i].Address > addr
+	}) - 1
+	if i < 0 || b.lines[i].End {
+		return nil, false
+	}
+	return &b.lines[i], true
+}
+
+type DwarfScopesByDepth []*DwarfScope
+
+func (p DwarfScopesByDepth) Len() int           { return len(p) }
+func (p DwarfScopesByDepth) Less(i, j int) bool { return p[i].Depth < p[j].Depth }
+func (p DwarfScopesByDepth) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// Returns the scopes covering link-time address `addr`, outermost first
+func (b *Binary) ScopesAt(addr uint64) []*DwarfScope {
+	result := []*DwarfScope{}
+	b.IndexScopes()
+	if b.dwarf_tree == nil {
+		return result
+	}
+	b.dwarf_tree.Stab(addr, func(id int) bool {
+		result = append(result, &b.dwarf_scopes[id])
+		return true
+	})
+	sort.Sort(DwarfScopesByDepth(result))
+	return result
+}
+
+// Name of a subprogram or inlined subroutine, preferring the (demangled)
+// linkage name, and following abstract origins and specifications
+func (b *Binary) EntryName(e *dwarf.Entry) string {
+	name := "?"
+	for i := 0; i < 8 && e != nil; i++ {
+		if linkage, ok := e.Val(dwarf.AttrLinkageName).(string); ok {
+			return demangle(linkage)
+		}
+		if n, ok := e.Val(dwarf.AttrName).(string); ok && name == "?" {
+			name = n
+		}
+		next, ok := e.Val(dwarf.AttrAbstractOrigin).(dwarf.Offset)
+		if !ok {
+			next, ok = e.Val(dwarf.AttrSpecification).(dwarf.Offset)
+		}
+		if !ok {
+			break
+		}
+		r := b.Dwarf().Reader()
+		r.Seek(next)
+		e, _ = r.Next()
+	}
+	return name
+}
+
+func (b *Binary) unitFileName(unit int, index interface{}) string {
+	i, ok := index.(int64)
+	if !ok || unit < 0 || unit >= len(b.dwarf_files) {
+		return "?"
+	}
+	files := b.dwarf_files[unit]
+	if i < 0 || int(i) >= len(files) || files[i] == "" {
+		return "?"
+	}
+	return files[i]
+}
+
+func intVal(e *dwarf.Entry, attr dwarf.Attr) int {
+	v, _ := e.Val(attr).(int64)
+	return int(v)
+}
+
+// Returns the source locations of the link-time address `addr`, innermost
+// first. Each inlined call adds a location in the function it was inlined
+// into.
+func (b *Binary) SourceLocations(addr uint64) []SourceLocation {
+	result := []SourceLocation{}
+
+	loc := SourceLocation{File: "?"}
+	row, have_line := b.LineAt(addr)
+	if have_line {
+		loc.File, loc.Line, loc.Column = row.File, row.Line, row.Column
+	}
+
+	scopes := b.ScopesAt(addr)
+	for i := len(scopes) - 1; i >= 0; i-- {
+		s := scopes[i]
+		switch s.Tag {
+		case dwarf.TagInlinedSubroutine:
+			loc.Function = s.Name
+			loc.Inlined = true
+			result = append(result, loc)
+			// The call site is a location in the enclosing function
+			loc = SourceLocation{
+				File:   s.CallFile,
+				Line:   s.CallLine,
+				Column: s.CallColumn,
+			}
+		case dwarf.TagSubprogram:
+			loc.Function = s.Name
+			return append(result, loc)
+		}
+	}
+
+	if have_line || len(result) > 0 {
+		// No enclosing subprogram, the caller will have to make do with
+		// the symbol table for the function name
+		result = append(result, loc)
+	}
+	return result
+}
+
+func (d *ProgramData) GetDwarf(addr uint64) []*dwarf.Entry {
+	return d.GetDwarfAt(addr, -1)
+}
+
+// As GetDwarf, with the page table in effect at record `index`
+func (d *ProgramData) GetDwarfAt(addr uint64, index int64) []*dwarf.Entry {
+	return d.GetRegionAt(addr, index).GetDwarf(addr)
+}
+
+// Returns the DWARF entries covering `addr`, outermost first
+func (r *MemRegion) GetDwarf(addr uint64) []*dwarf.Entry {
+	binary, link_addr, ok := r.BinaryAddress(addr)
+	if !ok || !binary.has_dwarf {
+		return make([]*dwarf.Entry, 0)
+	}
+
+	scopes := binary.ScopesAt(link_addr)
+	dwarf_entries := make([]*dwarf.Entry, 0, len(scopes))
+	for _, s := range scopes {
+		if e := binary.ScopeEntry(s); e != nil {
+			dwarf_entries = append(dwarf_entries, e)
+		}
+	}
+	return dwarf_entries
+}
+
+// Accesses and heap events record the return address of their call into the
+// runtime, which may be the first instruction of the next line or scope. This
+// is an address within the call itself, for looking up where it was made.
+func CallSite(pc uint64) uint64 {
+	if pc == 0 {
+		return 0
+	}
+	return pc - 1
+}
+
+func (d *ProgramData) GetSourceLocations(addr uint64) []SourceLocation {
+	return d.GetSourceLocationsAt(addr, -1)
+}
+
+// As GetSourceLocations, with the page table in effect at record `index`
+func (d *ProgramData) GetSourceLocationsAt(addr uint64, index int64) []SourceLocation {
+	return d.GetRegionAt(addr, index).GetSourceLocations(addr)
+}
+
+// Returns file:line:column of `addr` and the chain of inlined calls leading
+// to it, innermost first. Empty if there is no line information.
+func (r *MemRegion) GetSourceLocations(addr uint64) []SourceLocation {
+	binary, link_addr, ok := r.BinaryAddress(addr)
+	if !ok || !binary.has_dwarf {
+		return []SourceLocation{}
+	}
+	locations := binary.SourceLocations(link_addr)
+	for i := range locations {
+		if locations[i].Function == "" {
+			locations[i].Function = r.GetSymbol(addr)
+		}
+	}
+	return locations
+}
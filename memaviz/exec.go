@@ -3,7 +3,6 @@
 package main
 
 import (
-	"bytes"
 	"debug/dwarf"
 	"debug/elf"
 	"fmt"
@@ -11,15 +10,21 @@ import (
 	"os"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
-
-	"github.com/JohannesEbke/go-stree/stree"
+	"sync"
 )
 
 type MemRegion struct {
 	low, hi                             uint64
 	perms, offset, dev, inode, pathname string
 	data                                *ProgramData
+	// Nothing is mapped here, see ProgramData.FindRegion
+	unmapped bool
+}
+
+func (r *MemRegion) Mapped() bool {
+	return !r.unmapped
 }
 
 func (r *MemRegion) String() string {
@@ -27,13 +32,49 @@ func (r *MemRegion) String() string {
 }
 
 type Binary struct {
-	pathname  string
-	elf       *elf.File
-	dwarf     *dwarf.Data
-	symbolmap map[uint64]*elf.Symbol
-	// TODO: Extend this to care for multiple entries with the same "Lowpc" value
-	dwarf_entries map[uint64]*dwarf.Entry
-	dwarf_stree   *stree.Tree
+	pathname string
+	build_id string
+	elf      *elf.File
+	// The file the debug info was read from, if it isn't `pathname`
+	debug_filename string
+
+	// Parsed on first use (see Binary.Dwarf), which a cached binary may never
+	// need
+	dwarf_once sync.Once
+	dwarf      *dwarf.Data
+	has_dwarf  bool // see HasDwarf
+
+	// Entries with code ranges (see dwarf.go), indexed on first use or
+	// loaded from the symbol cache
+	scopes_once  sync.Once
+	dwarf_scopes []DwarfScope
+	dwarf_tree   *IntervalTree
+	// Line table rows of all compilation units, sorted by address
+	lines []LineRow
+	// File names of each compilation unit's file table
+	dwarf_files [][]string
+
+	// Loadable segments of the binary itself (not the debug file), used to
+	// turn file offsets into link-time addresses
+	loads []elf.ProgHeader
+	// Functions and data objects, sorted by link-time address
+	funcsyms []SymbolRange
+	datasyms []SymbolRange
+
+	// DWARF variables with fixed addresses, sorted by address, and the
+	// frame layout at each pc asked about so far (see variables.go)
+	variables []DwarfVariable
+	frames    map[uint64]*FrameLayout
+
+	// Guards frames and the dwarf type cache, which debug/dwarf doesn't
+	// protect itself
+	lock sync.Mutex
+}
+
+// A symbol and the range of link-time addresses it covers
+type SymbolRange struct {
+	Name        string
+	Value, Size uint64
 }
 
 func exists(path string) bool {
@@ -41,49 +82,6 @@ func exists(path string) bool {
 	return err == nil
 }
 
-func GetDebugFilename(path string, file *elf.File) string {
-	debugname := filepath.Base(path)
-	for i := range file.Sections {
-		s := file.Sections[i]
-		if s.Name == ".gnu_debuglink" {
-			data, err := s.Data()
-			if err == nil {
-				nul := bytes.IndexByte(data, 0)
-				debugname = string(data[:nul])
-			}
-			break
-		}
-	}
-	// From http://sourceware.org/gdb/onlinedocs/gdb/Separate-Debug-Files.html
-	// [not checked, don't know how to get BID.]
-	// /usr/lib/debug/.build-id/ab/cdef1234.debug 
-	// /usr/bin/ls.debug
-	// /usr/bin/.debug/ls.debug
-	// /usr/lib/debug/usr/bin/ls.debug
-
-	file_dir := filepath.Dir(path)
-	debug_path := file_dir + "/.debug/" + debugname
-	if exists(debug_path) {
-		log.Print(debug_path)
-		return debug_path
-	}
-
-	debug_path = "/usr/lib/debug" + file_dir + "/" + debugname
-	if exists(debug_path) {
-		log.Print(debug_path)
-		return debug_path
-	}
-
-	debug_path = ("/usr/lib/debug" +
-		strings.Replace(file_dir, "lib64", "lib", -1) +
-		"/" + debugname)
-	if exists(debug_path) {
-		log.Print(debug_path)
-		return debug_path
-	}
-	return ""
-}
-
 func NewBinary(path string) *Binary {
 	file, err := elf.Open(path)
 	if err != nil {
@@ -91,7 +89,16 @@ func NewBinary(path string) *Binary {
 		return nil
 	}
 
-	debug_filename := GetDebugFilename(path, file)
+	var loads []elf.ProgHeader
+	for i := range file.Progs {
+		if file.Progs[i].Type == elf.PT_LOAD {
+			loads = append(loads, file.Progs[i].ProgHeader)
+		}
+	}
+
+	build_id := BuildID(file)
+
+	debug_filename := GetDebugFilename(path, file, build_id)
 	if debug_filename != "" {
 		//log.Panic("Debug filename: ", debug_filename)
 		file, err = elf.Open(debug_filename)
@@ -100,156 +107,335 @@ func NewBinary(path string) *Binary {
 		}
 	}
 
-	dw, err := file.DWARF()
-	if err != nil {
-		log.Printf("!! No DWARF for %q err = %v", path, err)
-		dw = nil
-	}
-
-	tree := stree.NewTree()
-	result := &Binary{path, file, dw, make(map[uint64]*elf.Symbol),
-		make(map[uint64]*dwarf.Entry), &tree}
-
-	if dw != nil {
-		//tree := result.dwarf_stree
-		dwarf_entries := &result.dwarf_entries
-
-		dr := dw.Reader()
-		//log.Panic("Abort ", path, dwarf)
-		i := 0
-		n := 0
-		for {
-			i++
-			//if i > 1000 { break }
-			entry, err := dr.Next()
-			if err != nil {
-				log.Panic("Error reading dwarf: ", entry)
-			}
-			//log.Print("Got dwarf entry: ", entry)
-			if entry == nil {
-				break
-			}
+	result := &Binary{
+		pathname:       path,
+		build_id:       build_id,
+		elf:            file,
+		debug_filename: debug_filename,
+		has_dwarf:      HasDwarf(file),
+		loads:          loads,
+		frames:         make(map[uint64]*FrameLayout),
+	}
 
-			lpc := entry.Val(dwarf.AttrLowpc)
-			hpc := entry.Val(dwarf.AttrHighpc)
-			if hpc != nil && lpc != nil {
-				var hpcv, lpcv uint64
-				hpcv = hpc.(uint64)
-				lpcv = lpc.(uint64)
+	if result.LoadSymbolCache() {
+		return result
+	}
 
-				tree.Push(int(lpcv), int(hpcv))
-				(*dwarf_entries)[lpcv] = entry
+	if result.Dwarf() != nil {
+		result.IndexLines()
+	}
 
-				//log.Print("Got one: ", lpcv, hpcv, entry)
-				n++
-			}
+	syms, err := file.Symbols()
+	if err != nil {
+		// Stripped, but shared objects still have their exported symbols
+		syms, err = file.DynamicSymbols()
+		if err != nil {
+			log.Printf("!! No symbols for %q err = %v", path, err)
 		}
-		log.Print("Building dwarf tree..")
-		tree.BuildTree()
-		log.Print("dwarf tree built.")
-
-		//log.Panic("Abort, got ", n)
 	}
 
-	virtoffset := uint64(0)
+	result.funcsyms = FunctionSymbols(file, syms)
+	result.datasyms = DataSymbols(file, syms)
 
-	for i := range file.Progs {
-		prog := file.Progs[i]
-		if prog.Type == elf.PT_LOAD {
-			virtoffset = prog.Vaddr
-			break
-		}
-	}
+	result.SaveSymbolCache()
+	return result
+}
 
-	var syms []elf.Symbol
+// Whether `file` has debug info, without parsing it
+func HasDwarf(file *elf.File) bool {
+	return file.Section(".debug_info") != nil || file.Section(".zdebug_info") != nil
+}
 
-	func() {
-		// populate symbolmap
-		//var err error
-		syms, err = file.Symbols()
+// Returns the parsed DWARF, or nil if there is none
+func (b *Binary) Dwarf() *dwarf.Data {
+	b.dwarf_once.Do(func() {
+		if !b.has_dwarf {
+			return
+		}
+		dw, err := b.elf.DWARF()
 		if err != nil {
-			debugname := GetDebugFilename(path, file)
-			log.Print("Got debug name: ", debugname)
+			log.Printf("!! No DWARF for %q err = %v", b.pathname, err)
+			return
 		}
-	}()
+		b.dwarf = dw
+	})
+	return b.dwarf
+}
+
+type functionSymbol struct {
+	SymbolRange
+	global bool
+	// End of the symbol's section
+	end uint64
+}
+
+type functionSymbolsByValue []functionSymbol
+
+func (p functionSymbolsByValue) Len() int { return len(p) }
+func (p functionSymbolsByValue) Less(i, j int) bool {
+	if p[i].Value != p[j].Value {
+		return p[i].Value < p[j].Value
+	}
+	return p[i].global && !p[j].global
+}
+func (p functionSymbolsByValue) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
 
+// Returns the function symbols, sorted by address. Aliases of the same
+// address are dropped in favour of global symbols, and symbols without a size
+// are taken to extend to the next symbol or the end of their section.
+func FunctionSymbols(file *elf.File, syms []elf.Symbol) []SymbolRange {
+	candidates := []functionSymbol{}
 	for i := range syms {
 		s := &syms[i]
-		result.symbolmap[s.Value-virtoffset] = s
+		switch elf.ST_TYPE(s.Info) {
+		case elf.STT_FUNC, elf.STT_GNU_IFUNC:
+		default:
+			continue
+		}
+		if s.Value == 0 || s.Section == elf.SHN_UNDEF ||
+			int(s.Section) >= len(file.Sections) {
+			continue
+		}
+		section := file.Sections[s.Section]
+		candidates = append(candidates, functionSymbol{
+			SymbolRange{s.Name, s.Value, s.Size},
+			elf.ST_BIND(s.Info) == elf.STB_GLOBAL,
+			section.Addr + section.Size,
+		})
+	}
+	sort.Stable(functionSymbolsByValue(candidates))
+
+	result := []SymbolRange{}
+	for i := range candidates {
+		c := &candidates[i]
+		if i > 0 && candidates[i-1].Value == c.Value {
+			continue
+		}
+		if c.Size == 0 {
+			end := c.end
+			for j := i + 1; j < len(candidates); j++ {
+				if candidates[j].Value != c.Value {
+					if candidates[j].Value < end {
+						end = candidates[j].Value
+					}
+					break
+				}
+			}
+			if end > c.Value {
+				c.Size = end - c.Value
+			}
+		}
+		result = append(result, c.SymbolRange)
 	}
+	return result
+}
 
+// Returns the object symbols which live in allocated, non-executable
+// sections, sorted by address
+func DataSymbols(file *elf.File, syms []elf.Symbol) []SymbolRange {
+	result := []SymbolRange{}
+	for i := range syms {
+		s := &syms[i]
+		if elf.ST_TYPE(s.Info) != elf.STT_OBJECT {
+			continue
+		}
+		if s.Section == elf.SHN_UNDEF || int(s.Section) >= len(file.Sections) {
+			continue
+		}
+		flags := file.Sections[s.Section].Flags
+		if flags&elf.SHF_ALLOC == 0 || flags&elf.SHF_EXECINSTR != 0 {
+			continue
+		}
+		result = append(result, SymbolRange{s.Name, s.Value, s.Size})
+	}
+	sort.Sort(SymbolRangesByValue(result))
 	return result
 }
 
+type SymbolRangesByValue []SymbolRange
+
+func (p SymbolRangesByValue) Len() int           { return len(p) }
+func (p SymbolRangesByValue) Less(i, j int) bool { return p[i].Value < p[j].Value }
+func (p SymbolRangesByValue) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// Returns the symbol of `syms` (sorted by address) containing `addr`
+func lookupSymbol(syms []SymbolRange, addr uint64) (*SymbolRange, bool) {
+	i := sort.Search(len(syms), func(i int) bool {
+		return syms[i].Value > addr
+	}) - 1
+	if i < 0 {
+		return nil, false
+	}
+	s := &syms[i]
+	// Zero-sized symbols only match their exact address
+	if addr != s.Value && addr-s.Value >= s.Size {
+		return nil, false
+	}
+	return s, true
+}
+
+// Returns the data symbol containing the link-time address `addr`
+func (b *Binary) LookupData(addr uint64) (*SymbolRange, bool) {
+	return lookupSymbol(b.datasyms, addr)
+}
+
+// Returns the function containing the link-time address `addr`
+func (b *Binary) LookupFunction(addr uint64) (*SymbolRange, bool) {
+	return lookupSymbol(b.funcsyms, addr)
+}
+
+// Converts an offset into the binary file to the address it was linked at.
+// This is independent of where the loader decided to place the mapping, so it
+// works for both ET_EXEC and ET_DYN objects.
+func (b *Binary) LinkAddress(file_offset uint64) (uint64, bool) {
+	for i := len(b.loads) - 1; i >= 0; i-- {
+		p := &b.loads[i]
+		if p.Off <= file_offset && file_offset < p.Off+p.Memsz {
+			return file_offset - p.Off + p.Vaddr, true
+		}
+	}
+	return 0, false
+}
+
+// A binary which has been, or is being, loaded. done is closed once binary
+// is set.
+type binaryLoad struct {
+	done   chan struct{}
+	binary *Binary
+}
+
 // Memoize binary data
-var loaded_binaries map[string]*Binary
+var loaded_binaries map[string]*binaryLoad
+var loaded_binaries_lock sync.Mutex
 
 func init() {
-	loaded_binaries = make(map[string]*Binary)
+	loaded_binaries = make(map[string]*binaryLoad)
 }
 
-func (r *MemRegion) GetBinary() *Binary {
-	if r.pathname == "unknown" {
-		return nil
+// Returns the binary at `pathname`, loading it if this is the first time it
+// is asked for. Concurrent callers wait for a single load.
+func GetBinary(pathname string) *Binary {
+	loaded_binaries_lock.Lock()
+	load, ok := loaded_binaries[pathname]
+	if !ok {
+		load = &binaryLoad{done: make(chan struct{})}
+		loaded_binaries[pathname] = load
 	}
-	if binary, ok := loaded_binaries[r.pathname]; ok {
-		return binary
+	loaded_binaries_lock.Unlock()
+
+	if ok {
+		<-load.done
+		return load.binary
 	}
-	binary := NewBinary(r.pathname)
-	loaded_binaries[r.pathname] = binary
-	return binary
+	defer close(load.done)
+	load.binary = NewBinary(pathname)
+	return load.binary
 }
 
-func (data *Block) GetSymbol(addr uint64) string {
-	return data.full_data.GetSymbol(addr)
+func (r *MemRegion) GetBinary() *Binary {
+	if !r.Mapped() {
+		return nil
+	}
+	return GetBinary(r.pathname)
 }
 
-func (data *ProgramData) GetSymbol(addr uint64) string {
-	region := data.GetRegion(addr)
-	return region.GetSymbol(addr)
+// File offset of the start of the region, as listed in the page table
+func (r *MemRegion) FileOffset() uint64 {
+	offset, err := strconv.ParseUint(r.offset, 16, 64)
+	if err != nil {
+		return 0
+	}
+	return offset
 }
 
-func (r *MemRegion) GetSymbol(addr uint64) string {
+// Returns the binary mapped at `addr` and the address `addr` corresponds to in
+// that binary
+func (r *MemRegion) BinaryAddress(addr uint64) (*Binary, uint64, bool) {
 	binary := r.GetBinary()
 	if binary == nil {
-		return "nil"
+		return nil, 0, false
 	}
+	link_addr, ok := binary.LinkAddress(addr - r.low + r.FileOffset())
+	return binary, link_addr, ok
+}
 
-	sym, ok := binary.symbolmap[addr-r.low]
-	if !ok {
-		return "unk"
+// Returns the region which `addr` belongs to for the purposes of finding its
+// binary. The anonymous mapping directly after a binary's writable segment
+// holds the remainder of its .bss, so it is attributed to that binary.
+func (data *ProgramData) GetOwningRegion(addr uint64) (*MemRegion, uint64) {
+	return data.GetOwningRegionAt(addr, -1)
+}
+
+// As GetOwningRegion, with the page table in effect at record `index`
+func (data *ProgramData) GetOwningRegionAt(addr uint64, index int64) (*MemRegion, uint64) {
+	regions, i := data.lookupRegion(addr, index)
+	if i < 0 {
+		return data.unmappedRegion(addr), 0
+	}
+	r := &regions[i]
+	file_offset := addr - r.low + r.FileOffset()
+	if r.pathname != "" || i == 0 {
+		return r, file_offset
+	}
+	prev := &regions[i-1]
+	if prev.hi == r.low && prev.pathname != "" &&
+		!strings.HasPrefix(prev.pathname, "[") {
+		return prev, addr - prev.low + prev.FileOffset()
 	}
-	return demangle(sym.Name)
+	return r, file_offset
 }
 
-func (d *ProgramData) GetDwarf(addr uint64) []*dwarf.Entry {
-	r := d.GetRegion(addr)
-	return r.GetDwarf(addr)
+// Returns the name of the data object containing `addr` and the offset of
+// `addr` within it, if `addr` lies in the static data of some binary.
+func (data *ProgramData) GetDataSymbol(addr uint64) (string, uint64, bool) {
+	return data.GetDataSymbolAt(addr, -1)
 }
 
-func (r *MemRegion) GetDwarf(addr uint64) []*dwarf.Entry {
+// As GetDataSymbol, with the page table in effect at record `index`
+func (data *ProgramData) GetDataSymbolAt(addr uint64, index int64) (string, uint64, bool) {
+	r, file_offset := data.GetOwningRegionAt(addr, index)
 	binary := r.GetBinary()
-	if binary == nil || binary.dwarf == nil {
-		return make([]*dwarf.Entry, 0)
+	if binary == nil {
+		return "", 0, false
 	}
+	link_addr, ok := binary.LinkAddress(file_offset)
+	if !ok {
+		return "", 0, false
+	}
+	sym, ok := binary.LookupData(link_addr)
+	if !ok {
+		return "", 0, false
+	}
+	return demangle(sym.Name), link_addr - sym.Value, true
+}
 
-	addr = addr - r.low
-
-	intervals := (*binary.dwarf_stree).Query(int(addr), int(addr))
-	log.Print("Query: n=", len(intervals), addr, int(addr))
+func (data *Block) GetSymbol(addr uint64) string {
+	return data.full_data.GetSymbol(addr)
+}
 
-	lower_bounds := make([]int, len(intervals))
-	for i := range intervals {
-		lower_bounds[i] = intervals[i].Segment.From
-	}
-	sort.Ints(lower_bounds)
+func (data *ProgramData) GetSymbol(addr uint64) string {
+	return data.GetSymbolAt(addr, -1)
+}
 
-	dwarf_entries := make([]*dwarf.Entry, len(intervals))
+// As GetSymbol, with the page table in effect at record `index`
+func (data *ProgramData) GetSymbolAt(addr uint64, index int64) string {
+	return data.GetRegionAt(addr, index).GetSymbol(addr)
+}
 
-	for i := range lower_bounds {
-		e := binary.dwarf_entries[uint64(lower_bounds[i])]
-		dwarf_entries[i] = e
+// Returns the function containing `addr` as "name" or "name+0xoffset". If
+// there is no such function, "binary+0xoffset" with the offset into the file.
+func (r *MemRegion) GetSymbol(addr uint64) string {
+	binary, link_addr, ok := r.BinaryAddress(addr)
+	if binary == nil {
+		return "nil"
 	}
-
-	return dwarf_entries
+	if ok {
+		if sym, ok := binary.LookupFunction(link_addr); ok {
+			if link_addr == sym.Value {
+				return demangle(sym.Name)
+			}
+			return fmt.Sprintf("%s+0x%x", demangle(sym.Name), link_addr-sym.Value)
+		}
+	}
+	return fmt.Sprintf("%s+0x%x", filepath.Base(r.pathname), addr-r.low+r.FileOffset())
 }
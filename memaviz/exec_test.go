@@ -0,0 +1,103 @@
+package main
+
+import (
+	"debug/elf"
+	"testing"
+)
+
+// Makes `b` the binary GetBinary returns for its pathname, until the test ends,
+// so that symbols can be looked up without an ELF file
+func addTestBinary(t *testing.T, b *Binary) {
+	load := &binaryLoad{done: make(chan struct{}), binary: b}
+	close(load.done)
+	loaded_binaries_lock.Lock()
+	loaded_binaries[b.pathname] = load
+	loaded_binaries_lock.Unlock()
+	t.Cleanup(func() {
+		loaded_binaries_lock.Lock()
+		delete(loaded_binaries, b.pathname)
+		loaded_binaries_lock.Unlock()
+	})
+}
+
+func TestLookupSymbol(t *testing.T) {
+	syms := []SymbolRange{
+		{"a", 0x1000, 0x10},
+		{"b", 0x1010, 0},
+		{"c", 0x1100, 0x20},
+	}
+	tests := []struct {
+		addr uint64
+		want string
+	}{
+		{0xfff, ""},
+		{0x1000, "a"},
+		{0x100f, "a"},
+		// Zero-sized symbols only match their exact address
+		{0x1010, "b"},
+		{0x1011, ""},
+		{0x1100, "c"},
+		{0x111f, "c"},
+		{0x1120, ""},
+	}
+	for _, test := range tests {
+		s, ok := lookupSymbol(syms, test.addr)
+		got := ""
+		if ok {
+			got = s.Name
+		}
+		if got != test.want {
+			t.Errorf("lookupSymbol(0x%x) = %q, want %q", test.addr, got, test.want)
+		}
+	}
+	if _, ok := lookupSymbol(nil, 0x1000); ok {
+		t.Errorf("lookupSymbol found a symbol in no symbols")
+	}
+}
+
+func TestRegionGetSymbol(t *testing.T) {
+	load := func(off, vaddr, memsz uint64) elf.ProgHeader {
+		return elf.ProgHeader{Type: elf.PT_LOAD, Off: off, Vaddr: vaddr, Memsz: memsz}
+	}
+	// Linked at its load address
+	addTestBinary(t, &Binary{
+		pathname: "/test/exec",
+		loads:    []elf.ProgHeader{load(0, 0x400000, 0x2000)},
+		funcsyms: []SymbolRange{{"main", 0x401000, 0x80}},
+	})
+	// Position independent, linked at zero and loaded anywhere
+	addTestBinary(t, &Binary{
+		pathname: "/test/pie",
+		loads:    []elf.ProgHeader{load(0, 0, 0x1000), load(0x1000, 0x1000, 0x1000)},
+		funcsyms: []SymbolRange{{"main", 0x1100, 0x40}},
+	})
+	// A shared library whose code segment isn't at the same offset in the
+	// file as in memory
+	addTestBinary(t, &Binary{
+		pathname: "/test/libc.so.6",
+		loads:    []elf.ProgHeader{load(0, 0, 0x28000), load(0x28000, 0x29000, 0x100000)},
+		funcsyms: []SymbolRange{{"memcpy", 0x31000, 0x200}},
+	})
+
+	region := func(low, hi uint64, offset, pathname string) *MemRegion {
+		return &MemRegion{low: low, hi: hi, perms: "r-xp", offset: offset, pathname: pathname}
+	}
+	tests := []struct {
+		region *MemRegion
+		addr   uint64
+		want   string
+	}{
+		{region(0x400000, 0x402000, "00000000", "/test/exec"), 0x401000, "main"},
+		{region(0x400000, 0x402000, "00000000", "/test/exec"), 0x401010, "main+0x10"},
+		{region(0x555555555000, 0x555555556000, "00001000", "/test/pie"), 0x555555555104, "main+0x4"},
+		{region(0x7ffff7c28000, 0x7ffff7d28000, "00028000", "/test/libc.so.6"), 0x7ffff7c30010, "memcpy+0x10"},
+		// No function there, so the offset into the file
+		{region(0x7ffff7c28000, 0x7ffff7d28000, "00028000", "/test/libc.so.6"), 0x7ffff7c28010, "libc.so.6+0x28010"},
+		{region(0x7ffff7c28000, 0x7ffff7d28000, "00028000", "/test/missing.so"), 0x7ffff7c28010, "nil"},
+	}
+	for _, test := range tests {
+		if got := test.region.GetSymbol(test.addr); got != test.want {
+			t.Errorf("%s: GetSymbol(0x%x) = %q, want %q", test.region, test.addr, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,337 @@
+// extract.go: the "extract" action, which cuts a smaller trace out of a large
+//             one by record range, time, function call, thread or address
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+const EXTRACT_HELP = "records=A-B time=T1-T2 call=NAME thread=TID, and search terms " +
+	"for the accesses to keep: " + SEARCH_HELP
+
+// Which records to extract. All of the conditions must hold.
+type ExtractFilter struct {
+	// Records [Start, End), or all of them if End is zero
+	Start, End int64
+	// Seconds since the start of the trace [StartTime, EndTime), or all of
+	// them if EndTime is zero
+	StartTime, EndTime float64
+	// The first call to this function, from its enter to its exit
+	Call string
+	// Only the records of this thread
+	Thread     uint64
+	has_thread bool
+	// The accesses to keep, or all of them if nil
+	Query *SearchQuery
+	// If set, also has to keep an access, e.g. for a selection of the plot
+	Keep func(index int64, a *MemAccess) bool
+}
+
+// Parses e.g. "call=compute addr=0x601040+64 w". Terms which aren't
+// extraction terms make up a search query.
+func ParseExtractFilter(text string) (*ExtractFilter, error) {
+	f := &ExtractFilter{}
+	query := []string{}
+	for _, word := range strings.Fields(text) {
+		i := strings.Index(word, "=")
+		if i < 0 {
+			query = append(query, word)
+			continue
+		}
+		key, value := word[:i], word[i+1:]
+		switch key {
+		case "records":
+			var err error
+			if f.Start, f.End, err = ParseRecordRange(value); err != nil {
+				return nil, err
+			}
+		case "time":
+			from, to, ok := splitRange(value)
+			if !ok {
+				return nil, fmt.Errorf("bad time range %q", value)
+			}
+			var err error
+			if f.StartTime, err = ParseTraceTime(from); err != nil {
+				return nil, err
+			}
+			if f.EndTime, err = ParseTraceTime(to); err != nil {
+				return nil, err
+			}
+			if f.EndTime <= f.StartTime {
+				return nil, fmt.Errorf("empty time range %q", value)
+			}
+		case "call":
+			f.Call = value
+		case "thread":
+			tid, err := strconv.ParseUint(value, 0, 64)
+			if err != nil {
+				return nil, fmt.Errorf("bad thread %q", value)
+			}
+			f.Thread, f.has_thread = tid, true
+		default:
+			query = append(query, word)
+		}
+	}
+	if len(query) > 0 {
+		q, err := ParseSearchQuery(strings.Join(query, " "))
+		if err != nil {
+			return nil, err
+		}
+		f.Query = q
+	}
+	return f, nil
+}
+
+// Parses a record range "A-B", meaning records [A, B)
+func ParseRecordRange(s string) (start, end int64, err error) {
+	from, to, ok := splitRange(s)
+	start, err1 := strconv.ParseInt(from, 0, 64)
+	end, err2 := strconv.ParseInt(to, 0, 64)
+	if !ok || err1 != nil || err2 != nil || end <= start || start < 0 {
+		return 0, 0, fmt.Errorf("bad record range %q", s)
+	}
+	return start, end, nil
+}
+
+// Splits "A-B" at the first "-" which isn't the sign of A or of an exponent
+// of A, e.g. "1e-3-2e-3"
+func splitRange(s string) (string, string, bool) {
+	hex := strings.HasPrefix(strings.ToLower(s), "0x")
+	for i := 1; i < len(s); i++ {
+		if s[i] != '-' || (!hex && (s[i-1] == 'e' || s[i-1] == 'E')) {
+			continue
+		}
+		return s[:i], s[i+1:], true
+	}
+	return "", "", false
+}
+
+// Whether heap event `h` is wanted by `q`, which only has a say through its
+// addresses
+func keepHeapEvent(q *SearchQuery, h *HeapEvent) bool {
+	return q == nil || len(q.Addrs) == 0 || anyContains(q.Addrs, h.Addr)
+}
+
+// Writes the records of the trace selected by `f` to a new trace. The output
+// has enter records for the calls active where it starts and exit records for
+// those still active where it ends, so that every call in it is complete.
+// Returns the number of accesses written.
+func (data *ProgramData) Extract(f *ExtractFilter, filename string) (int64, error) {
+	fd := data.OpenBlocks()
+	defer fd.Close()
+
+	var tw *TraceWriter
+	var err error
+	var n_accesses int64
+
+	tracker := NewThreadTracker()
+	// The calls of each thread for which an enter has been written
+	written := make(map[ThreadMarker][]uint64)
+
+	// The block being written, which begins with its thread's marker
+	thread_marker := Record{Type: MEMA_THREAD}
+	out := Records{}
+	flush := func() {
+		if len(out) > 1 && err == nil {
+			err = tw.Write(out)
+		}
+		out = append(out[:0], thread_marker)
+	}
+	emit := func(r Record) {
+		if len(out) >= RECORDS_PER_BLOCK {
+			flush()
+		}
+		out = append(out, r)
+	}
+	// Brings the calls written for the current thread into line with its
+	// actual stack
+	sync_calls := func() {
+		calls := written[tracker.Thread()]
+		same := 0
+		for same < len(calls) && same < len(tracker.Stack) && calls[same] == tracker.Stack[same] {
+			same++
+		}
+		for d := len(calls) - 1; d >= same; d-- {
+			r := Record{Type: MEMA_FUNC_EXIT}
+			r.FunctionCall().FuncPointer = calls[d]
+			emit(r)
+		}
+		calls = calls[:same]
+		for d, fp := range tracker.Stack[same:] {
+			r := Record{Type: MEMA_FUNC_ENTER}
+			*r.FunctionCall() = FunctionCall{fp, tracker.ReturnPcs[same+d]}
+			emit(r)
+			calls = append(calls, fp)
+		}
+		written[tracker.Thread()] = calls
+	}
+
+	const (
+		CALL_SEARCHING = iota
+		CALL_INSIDE
+		CALL_DONE
+	)
+	call_state := CALL_SEARCHING
+	var call_tid uint64
+	var call_depth int
+
+	var start_time, last_time float64
+	have_time := false
+	in_maps := false
+
+	br := NewBlockReader(fd)
+	for block := int64(0); err == nil; block++ {
+		records := br.Next()
+		for records != nil && !WantBlock(records) {
+			records = br.Next()
+		}
+		if records == nil {
+			break
+		}
+		first := block * RECORDS_PER_BLOCK
+		if (f.End != 0 && first >= f.End) || call_state == CALL_DONE {
+			break
+		}
+		data.ScanMapsEvents(first, records)
+
+		for i := range records {
+			index := first + int64(i)
+			r := &records[i]
+			if r.Type == MEMA_THREAD {
+				tracker.Update(index, r)
+				if tw != nil {
+					flush()
+				}
+				thread_marker = *r
+				out = append(out[:0], thread_marker)
+				continue
+			}
+			if t, ok := r.Time(); ok {
+				if !have_time {
+					start_time, have_time = t, true
+				}
+				last_time = t
+			}
+
+			in := true
+			if f.End != 0 && (index < f.Start || index >= f.End) {
+				in = false
+			}
+			if f.EndTime != 0 && (!have_time || last_time-start_time < f.StartTime ||
+				last_time-start_time >= f.EndTime) {
+				in = false
+			}
+			if f.has_thread && tracker.Tid != f.Thread {
+				in = false
+			}
+			if f.Call != "" {
+				switch call_state {
+				case CALL_SEARCHING:
+					if in && r.Type == MEMA_FUNC_ENTER &&
+						matchesFunction(data.FunctionName(r.FunctionCall().FuncPointer), f.Call) {
+						call_state, call_tid, call_depth = CALL_INSIDE, tracker.Tid, tracker.Depth()
+					} else {
+						in = false
+					}
+				case CALL_INSIDE:
+					in = in && tracker.Tid == call_tid
+				default:
+					in = false
+				}
+			}
+
+			tracker.Update(index, r)
+			if !in {
+				in_maps = false
+				continue
+			}
+
+			if tw == nil {
+				// The page table at the start of the output is the one in
+				// effect here
+				tw, err = CreateTrace(filename, data.version, data.RegionsAt(index))
+				if err != nil {
+					return 0, err
+				}
+			}
+			sync_calls()
+
+			switch r.Type {
+			case MEMA_ACCESS:
+				a := r.MemAccess()
+				if (f.Query == nil || data.MatchAccess(f.Query, a, index)) &&
+					(f.Keep == nil || f.Keep(index, a)) {
+					emit(*r)
+					n_accesses++
+				}
+			case MEMA_ALLOC, MEMA_FREE:
+				if keepHeapEvent(f.Query, r.HeapEvent()) {
+					emit(*r)
+				}
+			case MEMA_MAPS:
+				// Readers expect the text in the same block
+				if len(out)+1+int(r.MapsEvent().Size+47)/48 > RECORDS_PER_BLOCK {
+					flush()
+				}
+				emit(*r)
+				in_maps = true
+			case MEMA_MAPS_TEXT:
+				// Only the text of page tables which were kept
+				if in_maps {
+					emit(*r)
+				}
+			}
+			if r.Type != MEMA_MAPS_TEXT && r.Type != MEMA_MAPS {
+				in_maps = false
+			}
+
+			if call_state == CALL_INSIDE && r.Type == MEMA_FUNC_EXIT &&
+				tracker.Tid == call_tid && tracker.Depth() <= call_depth {
+				call_state = CALL_DONE
+			}
+		}
+		if tw != nil {
+			flush()
+		}
+		if *verbose {
+			log.Printf("Processed block %d", block)
+		}
+	}
+
+	if tw == nil {
+		return 0, fmt.Errorf("no records matched")
+	}
+	// Finish the calls which were still active
+	for thread := range written {
+		thread_marker = Record{Type: MEMA_THREAD}
+		*thread_marker.ThreadMarker() = thread
+		out = append(out[:0], thread_marker)
+		tracker.Switch(thread)
+		tracker.Stack, tracker.Entries, tracker.ReturnPcs = nil, nil, nil
+		sync_calls()
+		flush()
+	}
+
+	if err2 := tw.Close(); err == nil {
+		err = err2
+	}
+	return n_accesses, err
+}
+
+// The "extract" action
+func (data *ProgramData) ExtractAction(spec string) {
+	f, err := ParseExtractFilter(spec)
+	if err != nil {
+		log.Fatalf("%v\nextract takes: %s", err, EXTRACT_HELP)
+	}
+	filename := OutputFilename(strings.TrimSuffix(data.filename, ".mema"), ".extract.mema")
+	n, err := data.Extract(f, filename)
+	if err != nil {
+		log.Fatal("Extract failed: ", err)
+	}
+	fmt.Printf("Wrote %d accesses to %s\n", n, filename)
+}
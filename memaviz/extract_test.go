@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplitRange(t *testing.T) {
+	tests := []struct {
+		text     string
+		from, to string
+		ok       bool
+	}{
+		{"1-2", "1", "2", true},
+		{"10ms-1s", "10ms", "1s", true},
+		{"1-2-3", "1", "2-3", true},
+		{"1e-3-2e-3", "1e-3", "2e-3", true},
+		{"1E-3-1", "1E-3", "1", true},
+		{"0x1e-0x20", "0x1e", "0x20", true},
+		{"1e-3", "", "", false},
+		{"1-", "1", "", true},
+		{"-1", "", "", false},
+		{"1", "", "", false},
+		{"", "", "", false},
+	}
+	for _, test := range tests {
+		from, to, ok := splitRange(test.text)
+		if from != test.from || to != test.to || ok != test.ok {
+			t.Errorf("splitRange(%q) = %q, %q, %v, want %q, %q, %v", test.text,
+				from, to, ok, test.from, test.to, test.ok)
+		}
+	}
+}
+
+func TestParseRecordRange(t *testing.T) {
+	tests := []struct {
+		text       string
+		start, end int64
+		ok         bool
+	}{
+		{"3-5", 3, 5, true},
+		{"0-1", 0, 1, true},
+		{"0x10-0x20", 16, 32, true},
+		{"5-5", 0, 0, false},
+		{"5-3", 0, 0, false},
+		{"-3-5", 0, 0, false},
+		{"3-", 0, 0, false},
+		{"3", 0, 0, false},
+		{"a-5", 0, 0, false},
+	}
+	for _, test := range tests {
+		start, end, err := ParseRecordRange(test.text)
+		if start != test.start || end != test.end || (err == nil) != test.ok {
+			t.Errorf("ParseRecordRange(%q) = %d, %d, %v, want %d, %d, ok %v", test.text,
+				start, end, err, test.start, test.end, test.ok)
+		}
+	}
+}
+
+func TestParseExtractFilter(t *testing.T) {
+	tests := []struct {
+		text string
+		want ExtractFilter
+		// Text of the search query, if there should be one
+		query string
+	}{
+		{"records=10-20", ExtractFilter{Start: 10, End: 20}, ""},
+		{"time=0.5-1.5", ExtractFilter{StartTime: 0.5, EndTime: 1.5}, ""},
+		{"time=10ms-1s", ExtractFilter{StartTime: 0.01, EndTime: 1}, ""},
+		{"time=1e-3-2e-3", ExtractFilter{StartTime: 0.001, EndTime: 0.002}, ""},
+		{"call=compute thread=0x10", ExtractFilter{Call: "compute", Thread: 16, has_thread: true}, ""},
+		{"thread=0", ExtractFilter{has_thread: true}, ""},
+		{"call=f addr=0x10+8 w", ExtractFilter{Call: "f"}, "addr=0x10+8 w"},
+		{"grid records=1-2", ExtractFilter{Start: 1, End: 2}, "grid"},
+	}
+	for _, test := range tests {
+		f, err := ParseExtractFilter(test.text)
+		if err != nil {
+			t.Errorf("ParseExtractFilter(%q): %v", test.text, err)
+			continue
+		}
+		query := ""
+		if f.Query != nil {
+			query = f.Query.Text
+		}
+		if query != test.query {
+			t.Errorf("ParseExtractFilter(%q) has query %q, want %q", test.text, query, test.query)
+		}
+		f.Query = nil
+		if !reflect.DeepEqual(*f, test.want) {
+			t.Errorf("ParseExtractFilter(%q) = %+v, want %+v", test.text, *f, test.want)
+		}
+	}
+
+	for _, text := range []string{"records=5-3", "records=", "time=2-1", "time=x-1",
+		"time=1", "thread=abc", "size=3"} {
+		if f, err := ParseExtractFilter(text); err == nil {
+			t.Errorf("ParseExtractFilter(%q) = %+v, want an error", text, *f)
+		}
+	}
+}
+
+// Describes the records of the trace, e.g. "T1 +f1 a16 -f1" (switching to
+// thread 1), checking that each thread's enters and exits balance
+func describeTestTrace(t *testing.T, data *ProgramData) string {
+	words := []string{}
+	depth := make(map[uint64]int)
+	tid := ^uint64(0)
+	data.ForEachRecord(func(index int64, r *Record) {
+		switch r.Type {
+		case MEMA_THREAD:
+			if r.ThreadMarker().Tid != tid {
+				tid = r.ThreadMarker().Tid
+				words = append(words, fmt.Sprintf("T%d", tid))
+			}
+		case MEMA_FUNC_ENTER:
+			depth[tid]++
+			words = append(words, fmt.Sprintf("+f%d", r.FunctionCall().FuncPointer))
+		case MEMA_FUNC_EXIT:
+			if depth[tid]--; depth[tid] < 0 {
+				t.Errorf("%s: exit without an enter in thread %d", data.filename, tid)
+			}
+			words = append(words, fmt.Sprintf("-f%d", r.FunctionCall().FuncPointer))
+		case MEMA_ACCESS:
+			words = append(words, fmt.Sprintf("a%d", r.MemAccess().Addr))
+		}
+	})
+	for tid, d := range depth {
+		if d != 0 {
+			t.Errorf("%s: thread %d ends %d calls deep", data.filename, tid, d)
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+func TestExtractBalancesCalls(t *testing.T) {
+	dir := testTraceDir(t)
+	defer os.RemoveAll(dir)
+
+	blocks := []Records{{
+		threadRecord(1),
+		callRecord(MEMA_FUNC_ENTER, 1), // 1
+		accessRecord(16, 0.1),          // 2
+		callRecord(MEMA_FUNC_ENTER, 2), // 3
+		accessRecord(32, 0.2),          // 4
+		accessRecord(48, 0.3),          // 5
+		callRecord(MEMA_FUNC_EXIT, 2),  // 6
+		accessRecord(64, 0.4),          // 7
+		callRecord(MEMA_FUNC_EXIT, 1),  // 8
+	}, {
+		threadRecord(2),
+		callRecord(MEMA_FUNC_ENTER, 3),
+		accessRecord(80, 0.5),
+		callRecord(MEMA_FUNC_EXIT, 3),
+	}}
+	writeTestTrace(t, dir, "in.mema", blocks...)
+
+	tests := []struct {
+		spec, want string
+	}{
+		{"records=0-9", "T1 +f1 a16 +f2 a32 a48 -f2 a64 -f1"},
+		{"records=4-5", "T1 +f1 +f2 a32 -f2 -f1"},
+		{"records=5-8", "T1 +f1 +f2 a48 -f2 a64 -f1"},
+		{"records=7-9", "T1 +f1 a64 -f1"},
+		{"call=f2", "T1 +f1 +f2 a32 a48 -f2 -f1"},
+		{"thread=2", "T2 +f3 a80 -f3"},
+		{"records=0-9 addr=48", "T1 +f1 +f2 a48 -f2 -f1"},
+		// Seconds from the first access
+		{"time=0.15-0.25", "T1 +f1 +f2 a48 -f2 -f1"},
+	}
+	for i, test := range tests {
+		// Opened afresh, since Extract reads the page tables as it goes
+		data, fd := OpenProgramData(filepath.Join(dir, "in.mema"))
+		fd.Close()
+		for f := uint64(1); f <= 3; f++ {
+			data.function_names[f] = fmt.Sprintf("f%d", f)
+		}
+
+		f, err := ParseExtractFilter(test.spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		filename := filepath.Join(dir, fmt.Sprintf("out%d.mema", i))
+		if _, err := data.Extract(f, filename); err != nil {
+			t.Errorf("%s: %v", test.spec, err)
+			continue
+		}
+		out, fd := OpenProgramData(filename)
+		fd.Close()
+		if got := describeTestTrace(t, out); got != test.want {
+			t.Errorf("%s: extracted %q, want %q", test.spec, got, test.want)
+		}
+	}
+}
+
+func TestExtractKeepsProcesses(t *testing.T) {
+	dir := testTraceDir(t)
+	defer os.RemoveAll(dir)
+
+	marker := threadRecord(1)
+	marker.ThreadMarker().Pid = 2
+	data := writeTestTrace(t, dir, "merged.mema", Records{
+		marker,
+		callRecord(MEMA_FUNC_ENTER, 1),
+		accessRecord(16, 0.1),
+		accessRecord(32, 0.2),
+		callRecord(MEMA_FUNC_EXIT, 1),
+	})
+	f, err := ParseExtractFilter("records=2-3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(dir, "out.mema")
+	if _, err := data.Extract(f, filename); err != nil {
+		t.Fatal(err)
+	}
+
+	out, fd := OpenProgramData(filename)
+	fd.Close()
+	markers := 0
+	out.ForEachRecord(func(index int64, r *Record) {
+		if r.Type == MEMA_THREAD {
+			markers++
+			if m := *r.ThreadMarker(); m != *marker.ThreadMarker() {
+				t.Errorf("record %d is a marker for %+v, want %+v", index, m, *marker.ThreadMarker())
+			}
+		}
+	})
+	// The access, then the exit which closes the call
+	if markers != 2 {
+		t.Errorf("extracted %d blocks, want 2", markers)
+	}
+}
@@ -0,0 +1,238 @@
+// flame.go: an icicle chart of the function calls, drawn next to the access
+//           plot on the same record axis
+
+package main
+
+import (
+	"flag"
+	"sort"
+
+	"github.com/go-gl/gl"
+	"github.com/go-gl/glh"
+)
+
+var show_flame = flag.Bool("flame", true, "draw the call icicle next to the plot")
+
+// Placement of the icicle, in projection co-ordinates
+const (
+	FLAME_LEFT        = 2.6
+	FLAME_RIGHT       = 4.3
+	FLAME_LEVEL_WIDTH = 0.35
+	// Rough width of a character of the names on the frames, in pixels, and
+	// the fewest worth drawing
+	FLAME_CHAR_WIDTH = 8
+	FLAME_MIN_CHARS  = 4
+	// Height of a frame needed to hold its name, in pixels
+	FLAME_LABEL_HEIGHT = 16
+)
+
+// Returns the block of `blocks` holding record `i`, or nil. Goroutines other
+// than the main thread pass a copy of data.blocks taken on it, since loading
+// appends to it.
+func BlockOf(blocks []*Block, i int64) *Block {
+	block_index := i / RECORDS_PER_BLOCK
+	if i < 0 || block_index >= int64(len(blocks)) {
+		return nil
+	}
+	return blocks[block_index]
+}
+
+type CallIntervalsByDepth []CallInterval
+
+func (p CallIntervalsByDepth) Len() int           { return len(p) }
+func (p CallIntervalsByDepth) Less(i, j int) bool { return p[i].Depth < p[j].Depth }
+func (p CallIntervalsByDepth) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// Returns the calls active at record `i`, outermost first
+func CallsAt(blocks []*Block, i int64) []CallInterval {
+	result := []CallInterval{}
+	b := BlockOf(blocks, i)
+	if b == nil {
+		return result
+	}
+	for _, c := range b.calls {
+		if c.Start <= i && i < c.End {
+			result = append(result, c)
+		}
+	}
+	sort.Sort(CallIntervalsByDepth(result))
+	return result
+}
+
+// Returns the record range of the whole call which `c` is part of, as far as
+// its parts follow on from one another. Where another thread runs in between
+// within a block, the next part is later on in the same block.
+func (data *ProgramData) CallExtent(c CallInterval) (start, end int64) {
+	start, end = c.Entry, c.End
+	for {
+		b := BlockOf(data.blocks, end)
+		if b == nil {
+			return
+		}
+		var next *CallInterval
+		for i := range b.calls {
+			p := &b.calls[i]
+			if p.Entry == c.Entry && p.Depth == c.Depth && p.Tid == c.Tid &&
+				p.Start >= end && (next == nil || p.Start < next.Start) {
+				next = p
+			}
+		}
+		if next == nil {
+			return
+		}
+		end = next.End
+	}
+}
+
+// Width of each level of the icicle, narrower if it is deep
+func (data *ProgramData) FlameLevelWidth(max_depth int) float64 {
+	w := float64(FLAME_LEVEL_WIDTH)
+	if max_depth > 0 && w*float64(max_depth) > FLAME_RIGHT-FLAME_LEFT {
+		w = (FLAME_RIGHT - FLAME_LEFT) / float64(max_depth)
+	}
+	return w
+}
+
+func (data *ProgramData) visibleCalls(start_index, n int64, fn func(c *CallInterval)) {
+	first := start_index / RECORDS_PER_BLOCK
+	if first < 0 {
+		first = 0
+	}
+	for bi := first; bi < int64(len(data.blocks)); bi++ {
+		b := data.blocks[bi]
+		if b.first_record >= start_index+n {
+			break
+		}
+		for i := range b.calls {
+			c := &b.calls[i]
+			if c.End > start_index && c.Start < start_index+n {
+				fn(c)
+			}
+		}
+	}
+}
+
+func (data *ProgramData) maxVisibleDepth(start_index, n int64) int {
+	max_depth := 0
+	data.visibleCalls(start_index, n, func(c *CallInterval) {
+		if c.Depth+1 > max_depth {
+			max_depth = c.Depth + 1
+		}
+	})
+	return max_depth
+}
+
+// Returns the call drawn at projection co-ordinate `px` and record `rec`
+func (data *ProgramData) FrameAt(px float64, rec, start_index, n int64) (CallInterval, bool) {
+	if px < FLAME_LEFT || px >= FLAME_RIGHT {
+		return CallInterval{}, false
+	}
+	w := data.FlameLevelWidth(data.maxVisibleDepth(start_index, n))
+	depth := int((px - FLAME_LEFT) / w)
+	for _, c := range CallsAt(data.blocks, rec) {
+		if c.Depth == depth {
+			return c, true
+		}
+	}
+	return CallInterval{}, false
+}
+
+// A stable, bright colour for each function
+func FunctionColour(f uint64) (r, g, b float32) {
+	h := f * 0x9E3779B97F4A7C15
+	r = 0.35 + float32(h>>56)/255*0.6
+	g = 0.35 + float32((h>>48)&0xff)/255*0.6
+	b = 0.35 + float32((h>>40)&0xff)/255*0.6
+	return
+}
+
+// Names on the frames drawn so far
+var flame_labels = NewLabelCache()
+
+// The text which fits in `chars` characters of name
+func fitName(name string, chars int) string {
+	if len(name) <= chars {
+		return name
+	}
+	return name[:chars-2] + ".."
+}
+
+// Draws the calls active within records [start_index, start_index+n), with
+// their names on the frames big enough to hold them
+func (data *ProgramData) DrawFlame(start_index, n int64) {
+	if !*show_flame {
+		return
+	}
+
+	w := data.FlameLevelWidth(data.maxVisibleDepth(start_index, n))
+	_, h := glh.GetViewportWHD()
+	// Calls shorter than this many records are under a pixel tall
+	min_records := int64(float64(n) / h)
+	label_records := int64(FLAME_LABEL_HEIGHT * float64(n) / h)
+
+	type label struct {
+		text *glh.Text
+		x, y float64
+	}
+	labels := []label{}
+
+	glh.With(&Timer{Name: "DrawFlame"}, func() {
+		glh.With(glh.Matrix{gl.MODELVIEW}, func() {
+			gl.Translated(0, -2, 0)
+			gl.Scaled(1, 4/float64(n), 1)
+			gl.Translated(0, -float64(start_index), 0)
+
+			named := []*CallInterval{}
+			glh.With(glh.Primitive{gl.QUADS}, func() {
+				data.visibleCalls(start_index, n, func(c *CallInterval) {
+					if c.End-c.Start <= min_records {
+						return
+					}
+					x1 := FLAME_LEFT + float64(c.Depth)*w
+					x2 := x1 + w*0.95
+					y1, y2 := float64(c.Start), float64(c.End)
+
+					r, g, b := FunctionColour(c.Func)
+					gl.Color4f(r, g, b, 0.8)
+					gl.Vertex2d(x1, y1)
+					gl.Vertex2d(x2, y1)
+					gl.Vertex2d(x2, y2)
+					gl.Vertex2d(x1, y2)
+
+					if min(c.End, start_index+n)-max(c.Start, start_index) >= label_records {
+						named = append(named, c)
+					}
+				})
+			})
+
+			// At the top of the part of the frame in view
+			for _, c := range named {
+				top := float64(min(c.End, start_index+n))
+				x1, y := glh.ProjToWindow(FLAME_LEFT+float64(c.Depth)*w, top)
+				x2, _ := glh.ProjToWindow(FLAME_LEFT+(float64(c.Depth)+0.95)*w, top)
+				chars := int((x2 - x1 - 4) / FLAME_CHAR_WIDTH)
+				if chars < FLAME_MIN_CHARS {
+					continue
+				}
+				// Names are looked up off the main thread
+				name, ok := data.FunctionNameIfKnown(c.Func)
+				if !ok {
+					continue
+				}
+				text := flame_labels.Get(fitName(name, chars))
+				labels = append(labels, label{text, x1, y})
+			}
+		})
+		flame_labels.EndFrame()
+
+		glh.With(glh.WindowCoords{}, func() {
+			glh.With(glh.Attrib{gl.ENABLE_BIT}, func() {
+				gl.Enable(gl.TEXTURE_2D)
+				for _, l := range labels {
+					// ProjToWindow counts from the top of the window
+					l.text.Draw(int(l.x)+2, int(h-l.y)-FLAME_LABEL_HEIGHT)
+				}
+			})
+		})
+	})
+}
@@ -90,3 +90,62 @@ func (block *Block) GetStackNames(record int64) []string {
 	}
 	return result
 }
+
+// A function call, or the part of one that falls within a block
+type CallInterval struct {
+	Func uint64
+	// Record indices, End is exclusive
+	Start, End int64
+	// Record index of the MEMA_FUNC_ENTER, which may lie in an earlier block
+	Entry int64
+	Depth int
+	Tid   uint64
+}
+
+// Returns the calls active during the block, clipped to it. The records must
+// still be loaded. `calls` carries the stacks open at the start of the block
+// and is left with those open at its end. Where the block switches thread,
+// the calls of each thread are cut, so that they don't overlap.
+func (b *Block) BuildCallIntervals(first int64, calls *ThreadTracker) []CallInterval {
+	result := []CallInterval{}
+	// Where the current thread's part of the block began
+	since := first
+	clip := func(entry int64) int64 {
+		if entry < since {
+			return since
+		}
+		return entry
+	}
+	// Adds the parts of the calls open on the current thread up to `end`
+	cut := func(end int64) {
+		for d := range calls.Stack {
+			if start := clip(calls.Entries[d]); start < end {
+				result = append(result, CallInterval{calls.Stack[d], start, end,
+					calls.Entries[d], d, calls.Tid})
+			}
+		}
+	}
+
+	for i := range b.records {
+		index := first + int64(i)
+		r := &b.records[i]
+		switch {
+		case r.Type == MEMA_THREAD && *r.ThreadMarker() != calls.Thread():
+			cut(index)
+			calls.Update(index, r)
+			since = index
+		case r.Type == MEMA_FUNC_EXIT:
+			stack, entries := calls.Stack, calls.Entries
+			calls.Update(index, r)
+			for d := calls.Depth(); d < len(stack); d++ {
+				result = append(result, CallInterval{stack[d], clip(entries[d]),
+					index + 1, entries[d], d, calls.Tid})
+			}
+		default:
+			calls.Update(index, r)
+		}
+	}
+	cut(first + int64(len(b.records)))
+
+	return result
+}
@@ -11,6 +11,9 @@ import (
 
 var MaxAnisotropy float32
 
+// Size of the window, as of the last Reshape
+var window_width, window_height int
+
 const (
 	GL_TEXTURE_MAX_ANISOTROPY_EXT     = 0x84FE
 	GL_MAX_TEXTURE_MAX_ANISOTROPY_EXT = 0x84FF
@@ -81,6 +84,7 @@ func Reshape(width, height int) {
 		return
 	}
 
+	window_width, window_height = width, height
 	gl.Viewport(0, 0, width, height)
 
 	gl.MatrixMode(gl.PROJECTION)
@@ -0,0 +1,224 @@
+// heap.go: following heap objects through the trace so that accesses can be
+//          attributed to the allocation which created their target
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Free record index of objects which are still live at the end of the trace
+const NEVER_FREED = math.MaxInt64
+
+type Allocation struct {
+	Addr, Size uint64
+	// Return address into the caller of the allocator
+	Site uint64
+	// Record indices of the allocation and the free
+	Alloc, Free int64
+}
+
+// The end of the addresses of the object
+func (a *Allocation) End() uint64 {
+	if a.Size == 0 {
+		// malloc(0) still hands out a unique pointer
+		return a.Addr + 1
+	}
+	return a.Addr + a.Size
+}
+
+// Every heap object of the trace, indexed by address and time. An object
+// occupies [Addr, Addr+Size) for records [Alloc, Free).
+type HeapTimeline struct {
+	allocations []Allocation
+	// The ids of the objects allocated at each address, in order of Alloc.
+	// Those at one address are never live at the same time.
+	by_addr [][]int
+	// Spans the objects at each address, with indices into by_addr
+	tree *IntervalTree
+}
+
+func (data *ProgramData) BuildHeapTimeline() *HeapTimeline {
+	h := &HeapTimeline{}
+	live := make(map[uint64]int)
+
+	data.ForEachRecord(func(index int64, r *Record) {
+		switch r.Type {
+		case MEMA_ALLOC:
+			e := r.HeapEvent()
+			if prev, ok := live[e.Addr]; ok {
+				// We missed the free (e.g, it happened while mema was
+				// disabled), the old object can't outlive this point.
+				h.allocations[prev].Free = index
+			}
+			live[e.Addr] = len(h.allocations)
+			h.allocations = append(h.allocations,
+				Allocation{e.Addr, e.Size, e.Pc, index, NEVER_FREED})
+		case MEMA_FREE:
+			e := r.HeapEvent()
+			if i, ok := live[e.Addr]; ok {
+				h.allocations[i].Free = index
+				delete(live, e.Addr)
+			}
+		}
+	})
+
+	// Allocations are in record order, so each address's are too
+	groups := make(map[uint64]int)
+	intervals := []Interval{}
+	for i := range h.allocations {
+		a := &h.allocations[i]
+		g, ok := groups[a.Addr]
+		if !ok {
+			g = len(h.by_addr)
+			groups[a.Addr] = g
+			h.by_addr = append(h.by_addr, nil)
+			intervals = append(intervals, Interval{a.Addr, a.End(), g})
+		}
+		h.by_addr[g] = append(h.by_addr[g], i)
+		if a.End() > intervals[g].Hi {
+			intervals[g].Hi = a.End()
+		}
+	}
+	h.tree = NewIntervalTree(intervals)
+
+	return h
+}
+
+func (h *HeapTimeline) Len() int {
+	return len(h.allocations)
+}
+
+func (h *HeapTimeline) Get(id int) *Allocation {
+	return &h.allocations[id]
+}
+
+// Returns the id of the object containing `addr` which was live at record
+// `index`, or -1.
+func (h *HeapTimeline) Lookup(addr uint64, index int64) int {
+	found := -1
+	h.tree.Stab(addr, func(g int) bool {
+		// Only the last object at this address allocated by `index` can be
+		// live at it
+		ids := h.by_addr[g]
+		k := sort.Search(len(ids), func(k int) bool {
+			return h.allocations[ids[k]].Alloc > index
+		}) - 1
+		if k < 0 {
+			return true
+		}
+		a := &h.allocations[ids[k]]
+		if index < a.Free && addr < a.End() {
+			found = ids[k]
+			return false
+		}
+		return true
+	})
+	return found
+}
+
+type SiteSummary struct {
+	Site               uint64
+	Allocations, Bytes uint64
+	ObjectsTouched     uint64
+	Counts             AccessCounts
+	// Record index of the first allocation from the site
+	First int64
+}
+
+type SiteSummaries []*SiteSummary
+
+func (p SiteSummaries) Len() int { return len(p) }
+func (p SiteSummaries) Less(i, j int) bool {
+	ti, tj := p[i].Counts.Total(), p[j].Counts.Total()
+	if ti != tj {
+		return ti > tj
+	}
+	return p[i].Bytes > p[j].Bytes
+}
+func (p SiteSummaries) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+
+// The "heap" action
+func (data *ProgramData) Heap() {
+	h := data.BuildHeapTimeline()
+
+	objects := make([]AccessCounts, h.Len())
+	var heap_accesses, attributed uint64
+
+	data.ForEachRecord(func(index int64, r *Record) {
+		if r.Type != MEMA_ACCESS {
+			return
+		}
+		a := r.MemAccess()
+		id := h.Lookup(a.Addr, index)
+		if data.GetRegionAt(a.Addr, index).pathname == "[heap]" {
+			heap_accesses++
+		}
+		if id < 0 {
+			return
+		}
+		attributed++
+		objects[id].Add(a)
+	})
+
+	sites := make(map[uint64]*SiteSummary)
+	for id := range h.allocations {
+		a := h.Get(id)
+		s, ok := sites[a.Site]
+		if !ok {
+			s = &SiteSummary{Site: a.Site, First: a.Alloc}
+			sites[a.Site] = s
+		}
+		s.Allocations++
+		s.Bytes += a.Size
+		if objects[id].Total() > 0 {
+			s.ObjectsTouched++
+		}
+		s.Counts.Reads += objects[id].Reads
+		s.Counts.Writes += objects[id].Writes
+	}
+
+	summaries := make(SiteSummaries, 0, len(sites))
+	for _, s := range sites {
+		summaries = append(summaries, s)
+	}
+	sort.Sort(summaries)
+
+	fmt.Printf("%d allocations from %d sites\n", h.Len(), len(sites))
+	fmt.Printf("%d accesses to [heap], %d accesses attributed to heap objects\n\n",
+		heap_accesses, attributed)
+
+	fmt.Println("Allocation sites")
+	fmt.Printf("  %10s %12s %10s %12s %12s  %s\n",
+		"allocs", "bytes", "touched", "reads", "writes", "site")
+	for i, s := range summaries {
+		if i >= *top_n {
+			break
+		}
+		fmt.Printf("  %10d %12d %10d %12d %12d  %s\n", s.Allocations, s.Bytes,
+			s.ObjectsTouched, s.Counts.Reads, s.Counts.Writes, data.GetSymbolAt(CallSite(s.Site), s.First))
+	}
+	fmt.Println()
+
+	ranked := make(map[uint64]*AccessCounts)
+	for id := range objects {
+		if objects[id].Total() > 0 {
+			ranked[uint64(id)] = &objects[id]
+		}
+	}
+
+	fmt.Println("Hot objects")
+	fmt.Printf("  %18s %10s %12s %12s %12s %12s  %s\n",
+		"address", "size", "allocated", "reads", "writes", "freed", "site")
+	for _, e := range RankCounts(ranked, *top_n) {
+		a := h.Get(int(e.Key))
+		freed := "never"
+		if a.Free != NEVER_FREED {
+			freed = fmt.Sprint(a.Free)
+		}
+		fmt.Printf("  %18x %10d %12d %12d %12d %12s  %s\n", a.Addr, a.Size,
+			a.Alloc, e.Counts.Reads, e.Counts.Writes, freed, data.GetSymbolAt(CallSite(a.Site), a.Alloc))
+	}
+}
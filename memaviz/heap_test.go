@@ -0,0 +1,55 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestHeapTimelineLookup(t *testing.T) {
+	dir := testTraceDir(t)
+	defer os.RemoveAll(dir)
+
+	data := writeTestTrace(t, dir, "heap.mema", Records{
+		threadRecord(1),
+		heapRecord(MEMA_ALLOC, 0x1000, 16), // 1: object 0
+		heapRecord(MEMA_FREE, 0x1000, 0),   // 2
+		heapRecord(MEMA_ALLOC, 0x1000, 32), // 3: object 1, same address
+		heapRecord(MEMA_ALLOC, 0x2000, 0),  // 4: object 2, malloc(0)
+		heapRecord(MEMA_ALLOC, 0x1000, 8),  // 5: object 3, object 1's free missed
+		heapRecord(MEMA_FREE, 0x1000, 0),   // 6
+		heapRecord(MEMA_ALLOC, 0x1008, 8),  // 7: object 4, inside object 1's old span
+	})
+	h := data.BuildHeapTimeline()
+	if h.Len() != 5 {
+		t.Fatalf("%d objects, want 5", h.Len())
+	}
+
+	tests := []struct {
+		addr  uint64
+		index int64
+		want  int
+	}{
+		{0x1000, 0, -1},
+		{0x1000, 1, 0},
+		{0x100f, 1, 0},
+		{0x1010, 1, -1},
+		{0x1000, 2, -1},
+		{0x1018, 3, 1},
+		{0x1018, 4, 1},
+		{0x1018, 5, -1},
+		{0x1004, 5, 3},
+		{0x1004, 6, -1},
+		{0x2000, 3, -1},
+		{0x2000, 4, 2},
+		{0x2000, 100, 2},
+		{0x2001, 4, -1},
+		{0x1008, 6, -1},
+		{0x1008, 7, 4},
+		{0x0fff, 1, -1},
+	}
+	for _, test := range tests {
+		if got := h.Lookup(test.addr, test.index); got != test.want {
+			t.Errorf("Lookup(0x%x, %d) = %d, want %d", test.addr, test.index, got, test.want)
+		}
+	}
+}
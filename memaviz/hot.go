@@ -0,0 +1,124 @@
+// hot.go: ranking the pages, cache lines and addresses which see the most
+//         traffic, and attributing them to regions and data symbols
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+)
+
+var top_n = flag.Int("top", 20, "number of entries to show in rankings")
+
+type AccessCounts struct {
+	Reads, Writes uint64
+	// Record index of the latest access counted, where callers keep it, for
+	// looking things up in the page table of the time
+	Last int64
+}
+
+func (c *AccessCounts) Add(a *MemAccess) {
+	if a.IsWrite == 1 {
+		c.Writes++
+	} else {
+		c.Reads++
+	}
+}
+
+func (c *AccessCounts) Total() uint64 {
+	return c.Reads + c.Writes
+}
+
+type HotEntry struct {
+	Key    uint64
+	Counts *AccessCounts
+}
+
+type HotEntries []HotEntry
+
+func (p HotEntries) Len() int { return len(p) }
+func (p HotEntries) Less(i, j int) bool {
+	ti, tj := p[i].Counts.Total(), p[j].Counts.Total()
+	if ti != tj {
+		return ti > tj
+	}
+	return p[i].Key < p[j].Key
+}
+func (p HotEntries) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+
+// Returns the `n` busiest entries of `counts`, busiest first
+func RankCounts(counts map[uint64]*AccessCounts, n int) HotEntries {
+	result := make(HotEntries, 0, len(counts))
+	for key, c := range counts {
+		result = append(result, HotEntry{key, c})
+	}
+	sort.Sort(result)
+	if n > 0 && len(result) > n {
+		result = result[:n]
+	}
+	return result
+}
+
+// Describes where `addr` lives at record `index`: its region and, for static
+// data, its symbol
+func (data *ProgramData) DescribeAddress(addr uint64, index int64) string {
+	r := data.GetRegionAt(addr, index)
+	where := r.pathname
+	if where == "" {
+		where = "[anon]"
+	}
+	if name, ok := data.GetVariable(&MemAccess{Addr: addr}, index); ok {
+		where += " " + name
+	} else if name, offset, ok := data.GetDataSymbolAt(addr, index); ok {
+		where += fmt.Sprintf(" %s+0x%x", name, offset)
+	}
+	return where
+}
+
+func (data *ProgramData) PrintHotEntries(title string, entries HotEntries, granularity uint64) {
+	fmt.Printf("%s\n", title)
+	fmt.Printf("  %18s %12s %12s %12s  %s\n", "address", "total", "reads", "writes", "where")
+	for _, e := range entries {
+		addr := e.Key * granularity
+		fmt.Printf("  %18x %12d %12d %12d  %s\n", addr, e.Counts.Total(),
+			e.Counts.Reads, e.Counts.Writes, data.DescribeAddress(addr, e.Counts.Last))
+	}
+	fmt.Println()
+}
+
+// The "hot" action
+func (data *ProgramData) Hot() {
+	pages := make(map[uint64]*AccessCounts)
+	lines := make(map[uint64]*AccessCounts)
+	addrs := make(map[uint64]*AccessCounts)
+
+	count := func(m map[uint64]*AccessCounts, key uint64, a *MemAccess, index int64) {
+		c, ok := m[key]
+		if !ok {
+			c = &AccessCounts{}
+			m[key] = c
+		}
+		c.Add(a)
+		c.Last = index
+	}
+
+	var total AccessCounts
+	data.ForEachRecord(func(index int64, r *Record) {
+		if r.Type != MEMA_ACCESS {
+			return
+		}
+		a := r.MemAccess()
+		total.Add(a)
+		count(pages, a.Addr / *PAGE_SIZE, a, index)
+		count(lines, a.Addr / *LINE_SIZE, a, index)
+		count(addrs, a.Addr, a, index)
+	})
+
+	fmt.Printf("%d accesses (%d reads, %d writes) to %d pages, %d lines, %d addresses\n\n",
+		total.Total(), total.Reads, total.Writes, len(pages), len(lines), len(addrs))
+
+	data.PrintHotEntries("Hot pages", RankCounts(pages, *top_n), *PAGE_SIZE)
+	data.PrintHotEntries("Hot cache lines", RankCounts(lines, *top_n), *LINE_SIZE)
+	data.PrintHotEntries("Hot addresses", RankCounts(addrs, *top_n), 1)
+}
@@ -0,0 +1,92 @@
+// intervaltree.go: a static interval tree answering "which intervals contain
+//                  this point?"
+
+package main
+
+import (
+	"sort"
+)
+
+// Half-open interval [Lo, Hi), with an Id to find whatever it describes
+type Interval struct {
+	Lo, Hi uint64
+	Id     int
+}
+
+// The tree is a sorted array of intervals, treated as an implicit balanced
+// binary tree (the root of [l, r) is at (l+r)/2). maxhi[i] holds the largest
+// Hi in the subtree rooted at i.
+type IntervalTree struct {
+	nodes []Interval
+	maxhi []uint64
+}
+
+type IntervalsByLo []Interval
+
+func (p IntervalsByLo) Len() int           { return len(p) }
+func (p IntervalsByLo) Less(i, j int) bool { return p[i].Lo < p[j].Lo }
+func (p IntervalsByLo) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+func NewIntervalTree(intervals []Interval) *IntervalTree {
+	t := &IntervalTree{
+		nodes: intervals,
+		maxhi: make([]uint64, len(intervals)),
+	}
+	sort.Sort(IntervalsByLo(t.nodes))
+	t.build(0, len(t.nodes))
+	return t
+}
+
+func (t *IntervalTree) build(l, r int) uint64 {
+	if l >= r {
+		return 0
+	}
+	mid := (l + r) / 2
+	hi := t.nodes[mid].Hi
+	if left := t.build(l, mid); left > hi {
+		hi = left
+	}
+	if right := t.build(mid+1, r); right > hi {
+		hi = right
+	}
+	t.maxhi[mid] = hi
+	return hi
+}
+
+func (t *IntervalTree) Len() int {
+	return len(t.nodes)
+}
+
+// Returns the intervals in the tree, sorted by Lo
+func (t *IntervalTree) Intervals() []Interval {
+	return t.nodes
+}
+
+// Calls `fn` with the Id of every interval containing `x`, until `fn`
+// returns false.
+func (t *IntervalTree) Stab(x uint64, fn func(id int) bool) {
+	t.stab(0, len(t.nodes), x, fn)
+}
+
+func (t *IntervalTree) stab(l, r int, x uint64, fn func(id int) bool) bool {
+	if l >= r {
+		return true
+	}
+	mid := (l + r) / 2
+	if t.maxhi[mid] <= x {
+		// Nothing in this subtree reaches x
+		return true
+	}
+	if !t.stab(l, mid, x, fn) {
+		return false
+	}
+	n := &t.nodes[mid]
+	if n.Lo > x {
+		// Everything to the right starts even later
+		return true
+	}
+	if x < n.Hi && !fn(n.Id) {
+		return false
+	}
+	return t.stab(mid+1, r, x, fn)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestIntervalTreeStab(t *testing.T) {
+	tree := NewIntervalTree([]Interval{
+		{10, 20, 0},
+		{15, 30, 1},
+		{0, 5, 2},
+		{18, 19, 3},
+		{40, 50, 4},
+		{10, 11, 5},
+	})
+
+	tests := []struct {
+		x    uint64
+		want []int
+	}{
+		{0, []int{2}},
+		{4, []int{2}},
+		{5, nil},
+		{10, []int{0, 5}},
+		{11, []int{0}},
+		{15, []int{0, 1}},
+		{18, []int{0, 1, 3}},
+		{19, []int{0, 1}},
+		{20, []int{1}},
+		{29, []int{1}},
+		{30, nil},
+		{45, []int{4}},
+		{50, nil},
+		{1 << 40, nil},
+	}
+	for _, test := range tests {
+		var got []int
+		tree.Stab(test.x, func(id int) bool {
+			got = append(got, id)
+			return true
+		})
+		sort.Ints(got)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Stab(%d) = %v, want %v", test.x, got, test.want)
+		}
+	}
+}
+
+func TestIntervalTreeStabStops(t *testing.T) {
+	tree := NewIntervalTree([]Interval{{0, 10, 0}, {0, 10, 1}, {0, 10, 2}})
+	n := 0
+	tree.Stab(5, func(id int) bool {
+		n++
+		return false
+	})
+	if n != 1 {
+		t.Errorf("Stab called fn %d times after it returned false, want 1", n)
+	}
+}
+
+func TestIntervalTreeEmpty(t *testing.T) {
+	tree := NewIntervalTree(nil)
+	tree.Stab(0, func(id int) bool {
+		t.Errorf("Stab found %d in an empty tree", id)
+		return true
+	})
+}
@@ -0,0 +1,40 @@
+// labels.go: the textures of text drawn on the plot, kept from frame to frame
+//            while it is drawn, since making them is slow
+
+package main
+
+import (
+	"github.com/go-gl/glh"
+)
+
+// Textures of labels by their text. Only used on the main thread.
+type LabelCache struct {
+	texts  map[string]*glh.Text
+	in_use map[string]bool
+}
+
+func NewLabelCache() *LabelCache {
+	return &LabelCache{make(map[string]*glh.Text), make(map[string]bool)}
+}
+
+// Returns the texture of `text`, making it if need be, and keeps it this frame
+func (c *LabelCache) Get(text string) *glh.Text {
+	t, ok := c.texts[text]
+	if !ok {
+		t = glh.MakeText(text, 32)
+		c.texts[text] = t
+	}
+	c.in_use[text] = true
+	return t
+}
+
+// Destroys the textures which weren't asked for since the last EndFrame
+func (c *LabelCache) EndFrame() {
+	for text, t := range c.texts {
+		if !c.in_use[text] {
+			t.Destroy()
+			delete(c.texts, text)
+		}
+	}
+	c.in_use = make(map[string]bool)
+}
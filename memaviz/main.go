@@ -9,6 +9,7 @@ import (
 	"os"
 	"os/signal"
 	"runtime"
+	"strings"
 	"time"
 
 	"github.com/go-gl/gl"
@@ -35,10 +36,14 @@ var pageboundaries = flag.Bool("pageboundaries", false, "pageboundaries")
 // TODO: Move these onto the file
 var MAGIC_IN_RECORD = flag.Bool("magic-in-record", false, "Records contain magic bytes")
 var PAGE_SIZE = flag.Uint64("page-size", 4096, "page-size")
+var LINE_SIZE = flag.Uint64("line-size", 64, "cache line size")
 
 var hide_qp_fraction = flag.Uint("hide-qp-fraction", 0,
 	"If nonzero, pages with 'accesses < busiest / hqf' are ignored")
 
+var startup_command = flag.String("command", "",
+	"prompt command to run when the viewer starts, e.g. 'goto mark phase2'")
+
 var margin_factor = float32(1) //0.975)
 
 // Redraw
@@ -77,7 +82,8 @@ func DoneThisFrame(value WorkType) bool {
 	return present
 }
 
-func main_loop(data *ProgramData) {
+// Shows `data` in the viewer, with `diff` (if not nil) drawn beside it
+func main_loop(data *ProgramData, diff *DiffView) {
 	start := time.Now()
 	frames := 0
 	lastblocks := 0
@@ -93,8 +99,8 @@ func main_loop(data *ProgramData) {
 				blocks := len(data.blocks)
 				bps := float64(blocks-lastblocks) / time.Since(start).Seconds()
 				lastblocks = blocks
-				log.Printf("fps = %5.2f; blocks = %4d; bps = %5.2f sparemem = %6d MB; alloc'd = %6.6f; (+footprint = %6.6f)",
-					fps, len(data.blocks), bps, SpareRAM(), float64(memstats.Alloc)/1024/1024,
+				log.Printf("fps = %5.2f; blocks = %4d; bps = %5.2f block cache = %6d MB of %v; alloc'd = %6.6f; (+footprint = %6.6f)",
+					fps, len(data.blocks), bps, block_cache.Used()/1024/1024, mem_budget, float64(memstats.Alloc)/1024/1024,
 					float64(memstats.Sys-memstats.Alloc)/1024/1024)
 
 				PrintTimers(frames)
@@ -104,20 +110,6 @@ func main_loop(data *ProgramData) {
 		}
 	}()
 
-	// Necessary at the moment to prevent eventual OOM
-	go func() {
-		for {
-			time.Sleep(5 * time.Second)
-			if *verbose {
-				log.Print("GC()")
-			}
-			runtime.GC()
-			if *verbose {
-				GCStats()
-			}
-		}
-	}()
-
 	var i int64 = -int64(*nback)
 
 	// TODO(pwaller): Make this work again
@@ -128,10 +120,15 @@ func main_loop(data *ProgramData) {
 
 	var stacktext, dwarftext []*glh.Text
 	var recordtext *glh.Text = nil
+	// Symbolization may have to load binaries, so it happens off the render
+	// thread. Only the most recent request's text is shown.
+	var stack_request, info_request int
 
 	var mousex, mousey, mousedownx, mousedowny int
 	var mousepx, mousepy float64
 	var lbutton bool
+	// Dragging the view rectangle of the minimap
+	var minimap_drag bool
 	escape_hit := false
 
 	glfw.SetMouseWheelCallback(func(pos int) {
@@ -180,17 +177,140 @@ func main_loop(data *ProgramData) {
 		//recordtext = MakeText(r.String(), 32)
 		//}
 
-		for j := range stacktext {
-			stacktext[j].Destroy()
+		stack_request++
+		request, blocks, at := stack_request, data.blocks, rec_actual
+		go func() {
+			stack := data.GetStackNames(blocks, at)
+			main_thread_work <- func() {
+				if request != stack_request {
+					return
+				}
+				for j := range stacktext {
+					stacktext[j].Destroy()
+				}
+				stacktext = make([]*glh.Text, len(stack))
+				for j := range stack {
+					stacktext[j] = glh.MakeText(stack[j], 32)
+				}
+			}
+		}()
+	}
+
+	// The rectangle dragged out with the right button, and its statistics
+	var selection *Selection
+	var selecting bool
+	var selection_text []*glh.Text
+	selection_request := 0
+
+	set_selection_text := func(text []string) {
+		for j := range selection_text {
+			selection_text[j].Destroy()
+		}
+		selection_text = nil
+		for _, line := range text {
+			selection_text = append(selection_text, glh.MakeText(line, 32))
+		}
+	}
+
+	finish_selection := func() {
+		selecting = false
+		s := selection.Normalised()
+		selection_request++
+		if s.End-s.Start < 2 {
+			// A click rather than a drag clears the selection
+			selection = nil
+			set_selection_text(nil)
+			return
+		}
+		selection = &s
+		request, blocks := selection_request, data.blocks
+		set_selection_text([]string{"working out selection..."})
+		go func() {
+			text := data.DescribeSelection(data.SelectionStats(blocks, s))
+			main_thread_work <- func() {
+				if request == selection_request {
+					set_selection_text(text)
+				}
+			}
+		}()
+	}
+
+	// Details of the access under the mouse, worked out once it rests
+	var tooltip *Tooltip
+	var tooltip_text []*glh.Text
+	tooltip_request := 0
+
+	set_tooltip := func(t *Tooltip) {
+		for j := range tooltip_text {
+			tooltip_text[j].Destroy()
+		}
+		tooltip, tooltip_text = t, nil
+		if t != nil {
+			for _, line := range t.Lines {
+				tooltip_text = append(tooltip_text, glh.MakeText(line, 32))
+			}
+		}
+	}
+
+	// Runs `work` after the mouse has rested for TOOLTIP_DELAY, showing the
+	// tooltip it returns
+	request_tooltip := func(work func() (*Tooltip, bool)) {
+		tooltip_request++
+		request := tooltip_request
+		go func() {
+			time.Sleep(TOOLTIP_DELAY)
+			main_thread_work <- func() {
+				if request != tooltip_request {
+					return
+				}
+				go func() {
+					t, ok := work()
+					main_thread_work <- func() {
+						if request != tooltip_request {
+							return
+						}
+						if !ok {
+							t = nil
+						}
+						set_tooltip(t)
+					}
+				}()
+			}
+		}()
+	}
+
+	update_tooltip := func() {
+		if mousepx < -2 || mousepx > 2 {
+			tooltip_request++
+			set_tooltip(nil)
+			return
 		}
-		// TODO: Load records on demand
-		if false {
-			stack := data.GetStackNames(rec_actual)
-			stacktext = make([]*glh.Text, len(stack))
-			for j := range stack {
-				stacktext[j] = glh.MakeText(stack[j], 32)
+		// Measure distances in pixels. The projection is set up in
+		// reshape (graf.go) to span 8.2 units across and 4.35 up.
+		w, h := glh.GetViewportWHD()
+		px_per_record := h * 4 / 4.35 / float64(*nback)
+		records_per_unit := w / 8.2 / px_per_record
+		tolerance := int64(10/px_per_record) + 1
+
+		blocks, px, at := data.blocks, mousepx, rec_actual
+		request_tooltip(func() (*Tooltip, bool) {
+			index, a, x, ok := data.NearestAccess(blocks, px, at, tolerance, records_per_unit)
+			if !ok {
+				return nil, false
 			}
+			return data.MakeTooltip(blocks, index, a, x), true
+		})
+	}
+
+	// Show records [start, end) with a little room either side
+	zoom_to := func(start, end int64) {
+		n := end - start
+		if n < 64 {
+			n = 64
 		}
+		*nback = n + n/10
+		i = start - n/20
+		rec = rec_actual - i
 	}
 
 	glfw.SetMouseButtonCallback(func(button, action int) {
@@ -199,36 +319,76 @@ func main_loop(data *ProgramData) {
 			switch action {
 			case glfw.KeyPress:
 				mousedownx, mousedowny = mousex, mousey
+
+				// Clicking the minimap centres the view there
+				if InMinimap(mousepx) {
+					minimap_drag = true
+					i = data.MinimapRecord(mousepy) - *nback/2
+					rec_actual = rec + i
+					update_text()
+					return
+				}
+
+				// Clicking a call in the icicle zooms to it
+				c, ok := data.FrameAt(mousepx, rec_actual, i, *nback)
+				if ok {
+					zoom_to(data.CallExtent(c))
+					return
+				}
+
 				lbutton = true
 
-				r := data.GetRecord(rec_actual)
-				if r != nil {
+				info_request++
+				request, blocks, at := info_request, data.blocks, rec_actual
+				go func() {
+					r := data.GetRecord(blocks, at)
+					if r == nil {
+						return
+					}
+					log.Print(r)
+					info := []string{fmt.Sprintf("#%d %v", at, r)}
 					if r.Type == MEMA_ACCESS {
-						log.Print(r)
 						ma := r.MemAccess()
-						dwarf := data.GetDwarf(ma.Pc)
-						log.Print("Can has dwarf? ", len(dwarf))
-						for i := range dwarf {
-							log.Print("  ", dwarf[i])
-							//recordtext = MakeText(data.records[rec_actual].String(), 32)
-
+						if name, ok := data.GetVariable(ma, at); ok {
+							log.Print("  accessed ", name)
+							info = append(info, "accessed "+name)
+						}
+						for _, loc := range data.GetSourceLocationsAt(CallSite(ma.Pc), at) {
+							log.Print("  ", loc)
+							info = append(info, loc.String())
 						}
-						log.Print("")
+					}
 
+					main_thread_work <- func() {
+						if request != info_request {
+							return
+						}
 						for j := range dwarftext {
 							dwarftext[j].Destroy()
 						}
-						dwarftext = make([]*glh.Text, len(dwarf))
-						for j := range dwarf {
-							dwarftext[j] = glh.MakeText(fmt.Sprintf("%q", dwarf[j]), 32)
+						dwarftext = make([]*glh.Text, len(info))
+						for j := range info {
+							dwarftext[j] = glh.MakeText(info[j], 32)
 						}
 					}
+				}()
 
-					//recordtext = MakeText(data.records[rec_actual].String(), 32)
-				}
+			case glfw.KeyRelease:
+				lbutton, minimap_drag = false, false
+			}
 
+		case glfw.Mouse2:
+			switch action {
+			case glfw.KeyPress:
+				if mousepx < -2 || mousepx > 2 {
+					return
+				}
+				selecting = true
+				selection = &Selection{rec_actual, rec_actual, mousepx, mousepx}
 			case glfw.KeyRelease:
-				lbutton = false
+				if selecting {
+					finish_selection()
+				}
 			}
 		}
 	})
@@ -243,7 +403,14 @@ func main_loop(data *ProgramData) {
 		dpy := py - mousepy
 		di := int64(-dpy * float64(*nback) / 4.)
 
-		if lbutton {
+		if selecting {
+			selection.End, selection.X2 = rec_actual, px
+		}
+
+		if minimap_drag {
+			i = data.MinimapRecord(py) - *nback/2
+			rec_actual = rec + i
+		} else if lbutton {
 			i += di
 		}
 
@@ -254,15 +421,241 @@ func main_loop(data *ProgramData) {
 		//x, y, px, py, rec, rec_actual, dpy, di)
 
 		update_text()
+		update_tooltip()
 	})
 
+	// Keep the mouse over the same place on screen as the view moves
+	scroll_to := func(start int64) {
+		i = start
+		rec_actual = rec + i
+		update_text()
+	}
+
+	// Zoom about the centre of the view
+	zoom_by := func(factor float64) {
+		centre := i + *nback/2
+		*nback = int64(float64(*nback) * factor)
+		if *nback < 64 {
+			*nback = 64
+		}
+		scroll_to(centre - *nback/2)
+	}
+
+	// The command prompt, and the result of the last command
+	var prompt_open bool
+	var prompt_input string
+	var prompt_text, status_text *glh.Text
+
+	update_prompt := func() {
+		if prompt_text != nil {
+			prompt_text.Destroy()
+			prompt_text = nil
+		}
+		if prompt_open {
+			prompt_text = glh.MakeText(": "+prompt_input+"_", 32)
+		}
+	}
+
+	set_status := func(status string) {
+		if status_text != nil {
+			status_text.Destroy()
+		}
+		status_text = glh.MakeText(status, 32)
+	}
+
+	// Records matching the last search, see search.go
+	var hits []int64
+	search_request := 0
+
+	// Centre record `n` in the view and point at it
+	show_record := func(n int64) {
+		i = n - *nback/2
+		rec, rec_actual = n-i, n
+		update_text()
+	}
+
+	run_search := func(query string) {
+		q, err := ParseSearchQuery(query)
+		if err != nil {
+			set_status(err.Error())
+			return
+		}
+		search_request++
+		request, blocks, from := search_request, data.blocks, i+*nback/2
+		set_status("searching for " + query + "...")
+		go func() {
+			result := data.Search(blocks, q)
+			main_thread_work <- func() {
+				if request != search_request {
+					return
+				}
+				hits = result
+				set_status(fmt.Sprintf("%d hits for %s (N/P next/previous)", len(hits), query))
+				if n, ok := NextHit(hits, from, true); ok {
+					show_record(n)
+				}
+			}
+		}()
+	}
+
+	run_command := func(command string) {
+		if query, ok := SearchCommand(command); ok {
+			run_search(query)
+			return
+		}
+		if words := strings.Fields(command); len(words) == 2 && words[0] == "export" {
+			if selection == nil || selecting {
+				set_status("nothing selected, drag out a rectangle with the right button")
+				return
+			}
+			s, blocks, filename := *selection, data.blocks, words[1]
+			set_status("exporting to " + filename + "...")
+			go func() {
+				n, err := data.ExportSelection(blocks, s, filename)
+				main_thread_work <- func() {
+					if err != nil {
+						set_status(err.Error())
+						return
+					}
+					set_status(fmt.Sprintf("wrote %d accesses to %s", n, filename))
+				}
+			}()
+			return
+		}
+		status, ok, err := data.BookmarkCommand(command, i, i+*nback)
+		if ok {
+			if err != nil {
+				status = err.Error()
+			}
+			set_status(status)
+			return
+		}
+		blocks, from := data.blocks, i+*nback/2
+		go func() {
+			// Searches may read from disk and load binaries
+			start, end, err := data.RunCommand(blocks, command, from)
+			main_thread_work <- func() {
+				if err != nil {
+					set_status(err.Error())
+					return
+				}
+				set_status(command)
+				if end-start <= 1 {
+					show_record(start)
+				} else {
+					zoom_to(start, end)
+					update_text()
+				}
+			}
+		}()
+	}
+
 	glfw.SetKeyCallback(func(key, state int) {
+		if state != glfw.KeyPress {
+			return
+		}
+
+		if prompt_open {
+			switch key {
+			case glfw.KeyEsc:
+				prompt_open = false
+			case glfw.KeyEnter, glfw.KeyKPEnter:
+				prompt_open = false
+				if strings.TrimSpace(prompt_input) != "" {
+					run_command(prompt_input)
+				}
+			case glfw.KeyBackspace:
+				if len(prompt_input) > 0 {
+					r := []rune(prompt_input)
+					prompt_input = string(r[:len(r)-1])
+				}
+			}
+			update_prompt()
+			return
+		}
+
 		switch key {
 		case glfw.KeyEsc:
 			escape_hit = true
+		case 'T':
+			*simple_names = !*simple_names
+			data.ForgetFunctionNames()
+			update_text()
+
+		case glfw.KeyPageup:
+			scroll_to(i + *nback)
+		case glfw.KeyPagedown:
+			scroll_to(i - *nback)
+		case glfw.KeyUp:
+			scroll_to(i + *nback/10)
+		case glfw.KeyDown:
+			scroll_to(i - *nback/10)
+		case glfw.KeyHome:
+			scroll_to(-*nback / 20)
+		case glfw.KeyEnd:
+			scroll_to(NumRecords(data.blocks) - *nback + *nback/20)
+		case '[', ']':
+			block := (i + *nback/2) / RECORDS_PER_BLOCK
+			if key == '[' && block > 0 {
+				block--
+			} else if key == ']' {
+				block++
+			}
+			scroll_to(block * RECORDS_PER_BLOCK)
+		case '=', glfw.KeyKPAdd:
+			zoom_by(0.8)
+		case '-', glfw.KeyKPSubtract:
+			zoom_by(1.25)
+
+		case 'N', 'P':
+			if n, ok := NextHit(hits, i+*nback/2, key == 'N'); ok {
+				show_record(n)
+			}
+		case ',', '.':
+			// Follow the accesses to the address in the tooltip
+			if tooltip == nil {
+				break
+			}
+			n := tooltip.Prev
+			if key == '.' {
+				n = tooltip.Next
+			}
+			if n >= 0 {
+				show_record(n)
+				blocks := data.blocks
+				request_tooltip(func() (*Tooltip, bool) { return data.TooltipAt(blocks, n) })
+			}
+		case 'B':
+			if b, ok := data.NextBookmark(i + *nback/2); ok {
+				set_status(b.String())
+				zoom_to(b.Start, b.End)
+				update_text()
+			}
+
+		case glfw.KeyEnter:
+			prompt_open, prompt_input = true, ""
+			update_prompt()
 		}
 	})
 
+	glfw.SetCharCallback(func(char, state int) {
+		if state != glfw.KeyPress {
+			return
+		}
+		if !prompt_open {
+			switch char {
+			case ':':
+				prompt_open, prompt_input = true, ""
+			case '/':
+				prompt_open, prompt_input = true, "/"
+			}
+			update_prompt()
+			return
+		}
+		prompt_input += string(rune(char))
+		update_prompt()
+	})
+
 	draw_mousepoint := func() {
 
 		// Draw the mouse point
@@ -287,15 +680,30 @@ func main_loop(data *ProgramData) {
 			glh.With(glh.Attrib{gl.ENABLE_BIT}, func() {
 				gl.Enable(gl.TEXTURE_2D)
 				// text.Draw(0, 0)
+				// Right of the icicle
 				for text_idx := range stacktext {
-					stacktext[text_idx].Draw(int(w*0.55), int(h)-35-text_idx*16)
+					stacktext[text_idx].Draw(int(w*0.8), int(h)-35-text_idx*16)
 				}
 				for text_idx := range dwarftext {
-					dwarftext[text_idx].Draw(int(w*0.55), 35+text_idx*16)
+					dwarftext[text_idx].Draw(int(w*0.8), 35+text_idx*16)
 				}
 				if recordtext != nil {
 					recordtext.Draw(int(w*0.55), 35)
 				}
+				if status_text != nil {
+					status_text.Draw(10, int(h)-51)
+				}
+				if prompt_text != nil {
+					prompt_text.Draw(10, int(h)-35)
+				}
+				// Between the stack and the clicked record
+				for j := range selection_text {
+					selection_text[j].Draw(int(w*0.8), int(h*0.65)-j*16)
+				}
+				// Beside the mouse, which is measured from the top
+				for j := range tooltip_text {
+					tooltip_text[j].Draw(mousex+16, int(h)-mousey-16-j*16)
+				}
 			})
 		})
 	}
@@ -303,12 +711,27 @@ func main_loop(data *ProgramData) {
 	Draw = func() {
 
 		gl.Clear(gl.COLOR_BUFFER_BIT | gl.DEPTH_BUFFER_BIT)
+		if diff != nil {
+			diff.Left()
+		}
 
 		// Draw the memory access/function data
 		data.Draw(i, *nback)
+		data.DrawFlame(i, *nback)
+		DrawHits(hits, i, *nback)
+		data.DrawMinimap(i, *nback, hits)
 
 		draw_mousepoint()
+		if tooltip != nil {
+			tooltip.DrawMarker(i, *nback)
+		}
+		if selection != nil {
+			selection.Normalised().Draw(i, *nback)
+		}
 		draw_text()
+		if diff != nil {
+			diff.Draw(i, *nback)
+		}
 
 		// Visible region quad
 		// gl.Color4f(1, 1, 1, 0.25)
@@ -317,6 +740,10 @@ func main_loop(data *ProgramData) {
 		// StatsHUD()
 	}
 
+	if *startup_command != "" {
+		run_command(*startup_command)
+	}
+
 	interrupt := make(chan os.Signal)
 	signal.Notify(interrupt, os.Interrupt)
 	ctrlc_hit := false
@@ -334,6 +761,7 @@ func main_loop(data *ProgramData) {
 		})
 
 		glfw.SwapBuffers()
+		block_cache.EndFrame()
 
 		DoMainThreadWork()
 
@@ -342,23 +770,11 @@ func main_loop(data *ProgramData) {
 	}
 }
 
-func FailSafe() {
-	for {
-		time.Sleep(1 * time.Microsecond)
-		if SystemFree() < 200e6 {
-			DumpStatsHUD()
-			log.Fatal("Less than 200MB system RAM free. Aborting")
-		}
-	}
-}
-
 func main() {
 	flag.Parse()
 
 	log.SetFlags(log.Ltime | log.Lshortfile)
 
-	go FailSafe()
-
 	if *profiling {
 		go func() { log.Println(http.ListenAndServe(":6060", nil)) }()
 	}
@@ -369,14 +785,48 @@ func main() {
 	}
 
 	var data *ProgramData
+	var diff *DiffView
 	var action = "visualize"
+	var query string
+
+	// merge takes any number of traces
+	if flag.NArg() > 1 && flag.Arg(0) == "merge" {
+		MergeAction(flag.Args()[1:])
+		return
+	}
 
 	switch flag.NArg() {
 	default:
 		flag.Usage()
 		println()
 		println("memaviz [action] filename.mema")
+		println("memaviz grep QUERY filename.mema")
+		println("memaviz [-o out.mema] extract FILTER filename.mema")
+		println("memaviz [-o out.mema] [-interleave] merge a.mema b.mema ...")
+		println("memaviz [-split] diff before.mema after.mema")
 		println("  actions:")
+		println("    visualize (default)")
+		println("    hot       rank the busiest pages, cache lines and addresses")
+		println("    heap      attribute accesses to heap objects and allocation sites")
+		println("    profile   per-function self and inclusive access counts")
+		println("    pprof     export a profile for go tool pprof (-o, default filename.mema.pprof)")
+		println("    trace     export a Chrome Trace Event timeline (-o, default filename.mema.json)")
+		println("    annotate  print source files with per-line read/write counts (-files)")
+		println("    vars      rank the variables accessed, grouped by -group")
+		println("    grep      print the accesses matching QUERY: " + SEARCH_HELP)
+		println("    bookmarks list the bookmarks saved in filename.mema.bookmarks")
+		println("    extract   write the records matching FILTER to a new trace (-o): " + EXTRACT_HELP)
+		println("    merge     combine traces into one (-o, default merged.mema), each a process")
+		println("              which can be viewed on its own with -pid N")
+		println("    diff      compare two traces function by function, or with -split view them")
+		println("              side by side, the second following the first through their calls")
+		println()
+		println("  viewer keys: PgUp/PgDn/Up/Down scroll, Home/End, [ ] previous/next block,")
+		println("    +/- zoom, T toggle -simple-names, Enter or : open the command prompt,")
+		println("    / search, N/P next/previous hit, B next bookmark, click or drag the minimap,")
+		println("    hover for details of an access, then , and . for the previous/next access to it,")
+		println("    right-drag to select records and addresses for statistics and export")
+		println("  commands: " + COMMAND_HELP)
 		println("    pack")
 		println()
 		return
@@ -385,7 +835,25 @@ func main() {
 
 	case 2:
 		action = flag.Arg(0)
-		data = NewProgramData(flag.Arg(1))
+		if action == "visualize" {
+			data = NewProgramData(flag.Arg(1))
+		} else {
+			var fd *os.File
+			data, fd = OpenProgramData(flag.Arg(1))
+			fd.Close()
+		}
+
+	case 3:
+		action, query = flag.Arg(0), flag.Arg(1)
+		if action == "diff" && *split_view {
+			data = NewProgramData(flag.Arg(1))
+			diff = NewDiffView(data, NewProgramData(flag.Arg(2)))
+			action = "visualize"
+			break
+		}
+		var fd *os.File
+		data, fd = OpenProgramData(flag.Arg(2))
+		fd.Close()
 	}
 
 	switch action {
@@ -394,7 +862,31 @@ func main() {
 		defer cleanup()
 
 		InitStatsHUD()
-		main_loop(data)
+		main_loop(data, diff)
+	case "hot":
+		data.Hot()
+	case "heap":
+		data.Heap()
+	case "profile":
+		data.Profile()
+	case "pprof":
+		data.ExportPprof()
+	case "trace":
+		data.ExportChromeTrace()
+	case "annotate":
+		data.Annotate()
+	case "vars":
+		data.Variables()
+	case "grep":
+		data.Grep(query)
+	case "bookmarks":
+		data.ListBookmarks()
+	case "extract":
+		data.ExtractAction(query)
+	case "diff":
+		before, fd := OpenProgramData(query)
+		fd.Close()
+		Diff(before, data)
 	case "pack":
 		// data.PackBinaries()
 
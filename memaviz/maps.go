@@ -0,0 +1,291 @@
+// maps.go: the page table of the traced program, as recorded at startup and
+//          after every mmap, munmap, dlopen, ... during the run
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+// A page table which was in effect from record First until the next one of
+// the same process
+type RegionTable struct {
+	First   int64
+	Pid     uint64
+	Regions []MemRegion
+}
+
+// The records from First until the next run belong to process Pid (see
+// ThreadMarker)
+type ProcessRun struct {
+	First int64
+	Pid   uint64
+}
+
+// Parses the text of /proc/self/maps
+func (data *ProgramData) ParseMaps(text string) []MemRegion {
+	regions := []MemRegion{}
+	last := MemRegion{}
+
+	for _, line := range strings.Split(text, "\n") {
+		if len(line) == 0 {
+			continue
+		}
+		x := MemRegion{data: data}
+
+		_, err := fmt.Sscanf(line, "%x-%x %s %s %s %s %s", &x.low, &x.hi,
+			&x.perms, &x.offset, &x.dev, &x.inode, &x.pathname)
+		if err != nil {
+			_, err := fmt.Sscanf(line, "%x-%x %s %s %s %s", &x.low, &x.hi,
+				&x.perms, &x.offset, &x.dev, &x.inode)
+			x.pathname = ""
+			if err != nil {
+				log.Panic("Error parsing: ", err, " '", line, "'")
+			}
+		}
+		regions = append(regions, x)
+		if !(last.low < x.low) {
+			panic("Expecting map regions to be sorted")
+		}
+		last = x
+	}
+	return regions
+}
+
+// Formats `regions` as /proc/self/maps does, for writing a trace
+func FormatMaps(regions []MemRegion) string {
+	lines := make([]string, 0, len(regions))
+	for _, r := range regions {
+		line := fmt.Sprintf("%08x-%08x %s %s %s %s", r.low, r.hi, r.perms, r.offset, r.dev, r.inode)
+		if r.pathname != "" {
+			line += " " + r.pathname
+		}
+		lines = append(lines, line+"\n")
+	}
+	return strings.Join(lines, "")
+}
+
+// Returns the /proc/self/maps text of the MEMA_MAPS record records[i], which
+// is carried by the MEMA_MAPS_TEXT records after it
+func ReadMapsText(records Records, i int) string {
+	size := int(records[i].MapsEvent().Size)
+	text := make([]byte, 0, size)
+	for j := i + 1; j < len(records) && records[j].Type == MEMA_MAPS_TEXT; j++ {
+		text = append(text, records[j].Content[:]...)
+	}
+	if len(text) > size {
+		text = text[:size]
+	}
+	// The runtime truncates very large page tables, drop any partial line
+	if n := strings.LastIndex(string(text), "\n"); n >= 0 && n != len(text)-1 {
+		text = text[:n+1]
+	}
+	return string(text)
+}
+
+// Returns a MEMA_MAPS record and the MEMA_MAPS_TEXT records carrying `text`,
+// as the runtime writes them when the page table changes
+func MakeMapsRecords(time float64, text string) Records {
+	records := make(Records, 1, 1+(len(text)+47)/48)
+	records[0].Type = MEMA_MAPS
+	*records[0].MapsEvent() = MapsEvent{time, uint64(len(text))}
+	for len(text) > 0 {
+		r := Record{Type: MEMA_MAPS_TEXT}
+		n := copy(r.Content[:], text)
+		text = text[n:]
+		records = append(records, r)
+	}
+	return records
+}
+
+// Records the page tables found in a block starting at record `first`, and
+// which process it belongs to. Blocks must be scanned in order; seeing one
+// again (as when a trace is read several times) has no effect.
+func (data *ProgramData) ScanMapsEvents(first int64, records Records) {
+	var pid uint64
+	if len(records) > 0 && records[0].Type == MEMA_THREAD {
+		pid = records[0].ThreadMarker().Pid
+	}
+	data.scanProcess(first, pid)
+
+	for i := range records {
+		if records[i].Type != MEMA_MAPS {
+			continue
+		}
+		index := first + int64(i)
+
+		data.regions_lock.Lock()
+		n := len(data.region_tables)
+		seen := n > 0 && data.region_tables[n-1].First >= index
+		data.regions_lock.Unlock()
+		if seen {
+			continue
+		}
+
+		table := RegionTable{index, pid, data.ParseMaps(ReadMapsText(records, i))}
+		if *debug {
+			log.Printf("Page table of process %d at record %d:", pid, index)
+			for j := range table.Regions {
+				log.Print(" ", &table.Regions[j])
+			}
+		}
+
+		data.regions_lock.Lock()
+		data.region_tables = append(data.region_tables, table)
+		data.regions_lock.Unlock()
+		data.region_cache.Clear()
+	}
+}
+
+// Notes that the block at record `first` belongs to process `pid`
+func (data *ProgramData) scanProcess(first int64, pid uint64) {
+	data.regions_lock.Lock()
+	defer data.regions_lock.Unlock()
+	n := len(data.process_runs)
+	if n > 0 && data.process_runs[n-1].First >= first {
+		return
+	}
+	// Only merged traces have more than process zero
+	if (n == 0 && pid == 0) || (n > 0 && data.process_runs[n-1].Pid == pid) {
+		return
+	}
+	data.process_runs = append(data.process_runs, ProcessRun{first, pid})
+}
+
+// Returns the process which record `index` belongs to
+func (data *ProgramData) ProcessAt(index int64) uint64 {
+	data.regions_lock.RLock()
+	defer data.regions_lock.RUnlock()
+	runs := data.process_runs
+	i := sort.Search(len(runs), func(i int) bool {
+		return runs[i].First > index
+	}) - 1
+	if i < 0 {
+		return 0
+	}
+	return runs[i].Pid
+}
+
+func (data *ProgramData) RegionTables() []RegionTable {
+	data.regions_lock.RLock()
+	defer data.regions_lock.RUnlock()
+	return data.region_tables
+}
+
+// Returns which page table was in effect at record `index`: an index into
+// RegionTables(), -1 for the one from the start of the run, or -2 if `index`
+// is negative (not known). In merged traces it is the latest one of the
+// process that the record belongs to.
+func (data *ProgramData) tableAt(index int64) int {
+	if index < 0 {
+		return -2
+	}
+	tables := data.RegionTables()
+	t := sort.Search(len(tables), func(i int) bool {
+		return tables[i].First > index
+	}) - 1
+	pid := data.ProcessAt(index)
+	for t >= 0 && tables[t].Pid != pid {
+		t--
+	}
+	return t
+}
+
+// Returns the page table in effect at record `index`
+func (data *ProgramData) RegionsAt(index int64) []MemRegion {
+	t := data.tableAt(index)
+	if t < 0 {
+		return data.region
+	}
+	return data.RegionTables()[t].Regions
+}
+
+// Returns the index of the region of `regions` containing `addr`, or -1
+func findRegion(regions []MemRegion, addr uint64) int {
+	i := sort.Search(len(regions), func(i int) bool {
+		return regions[i].hi > addr
+	})
+	if i < len(regions) && regions[i].low <= addr {
+		return i
+	}
+	return -1
+}
+
+// Returns the page table and index in it of the region containing `addr` at
+// record `index`. If `index` is negative (not known), the page table from the
+// start of the run is tried first, then the later ones most recent first.
+// With -pid, those are the tables of that process, since the one in the header
+// of a merged trace is another process's.
+func (data *ProgramData) lookupRegion(addr uint64, index int64) ([]MemRegion, int) {
+	if index >= 0 {
+		regions := data.RegionsAt(index)
+		return regions, findRegion(regions, addr)
+	}
+	tables := data.RegionTables()
+	if *only_pid != 0 {
+		first := -1
+		for t := range tables {
+			if tables[t].Pid == *only_pid {
+				first = t
+				break
+			}
+		}
+		if first < 0 {
+			// None of its blocks have been read yet
+			return data.region, findRegion(data.region, addr)
+		}
+		if i := findRegion(tables[first].Regions, addr); i >= 0 {
+			return tables[first].Regions, i
+		}
+	} else if i := findRegion(data.region, addr); i >= 0 {
+		return data.region, i
+	}
+	for t := len(tables) - 1; t >= 0; t-- {
+		if *only_pid != 0 && tables[t].Pid != *only_pid {
+			continue
+		}
+		if i := findRegion(tables[t].Regions, addr); i >= 0 {
+			return tables[t].Regions, i
+		}
+	}
+	return nil, -1
+}
+
+// Stands in for a region where there isn't one
+func (data *ProgramData) unmappedRegion(addr uint64) *MemRegion {
+	return &MemRegion{low: addr, hi: addr, perms: "-", offset: "-", dev: "-",
+		inode: "-", pathname: "unknown", data: data, unmapped: true}
+}
+
+// Returns the region containing `addr` at record `index` (or, if that is
+// negative, at some point in the run). If nothing was mapped there, returns
+// an unmapped region and false.
+func (data *ProgramData) FindRegion(addr uint64, index int64) (*MemRegion, bool) {
+	key := RegionCacheKey{addr, data.tableAt(index)}
+	if r, ok := data.region_cache.Get(key); ok {
+		return r, r.Mapped()
+	}
+	generation := data.region_cache.Generation()
+
+	regions, i := data.lookupRegion(addr, index)
+	var r *MemRegion
+	if i < 0 {
+		r = data.unmappedRegion(addr)
+	} else {
+		r = &regions[i]
+	}
+	data.region_cache.Add(key, r, generation)
+	return r, r.Mapped()
+}
+
+func (data *ProgramData) GetRegionAt(addr uint64, index int64) *MemRegion {
+	r, _ := data.FindRegion(addr, index)
+	return r
+}
+
+func (data *ProgramData) GetRegion(addr uint64) *MemRegion {
+	return data.GetRegionAt(addr, -1)
+}
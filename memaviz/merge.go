@@ -0,0 +1,244 @@
+// merge.go: the "merge" action, which combines traces of several runs or
+//           processes into one, and viewing the processes of the result
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+)
+
+var interleave = flag.Bool("interleave", false,
+	"merge interleaves the blocks of the traces by time, rather than concatenating the traces")
+var only_pid = flag.Uint64("pid", 0, "only read the blocks of this process of a merged trace")
+
+// Whether the block `records` is wanted, given -pid
+func WantBlock(records Records) bool {
+	if *only_pid == 0 || len(records) == 0 || records[0].Type != MEMA_THREAD {
+		return true
+	}
+	return records[0].ThreadMarker().Pid == *only_pid
+}
+
+// One of the traces being merged, positioned at a block
+type mergeInput struct {
+	filename string
+	// The process of the output which each of its processes becomes. A trace
+	// which isn't merged has only process zero.
+	pids   map[uint64]uint64
+	data   *ProgramData
+	fd     *os.File
+	reader *BlockReader
+	// The current block, nil at the end of the trace
+	records Records
+	// Time of the first timed record of the current block, or of the last
+	// one seen if it has none
+	time float64
+	// The text of its page table at the start of the run, and whether it
+	// has been written. Merged traces carry their page tables in their blocks.
+	maps    string
+	started bool
+	// Thread ids renumbered since another trace uses them
+	tids map[ThreadMarker]uint64
+}
+
+// Reads the next block
+func (in *mergeInput) advance() {
+	in.records = in.reader.Next()
+	for i := range in.records {
+		if t, ok := in.records[i].Time(); ok {
+			in.time = t
+			break
+		}
+	}
+}
+
+// Returns the processes of a merged trace, in order, by reading through it
+func (in *mergeInput) scanProcesses() []uint64 {
+	fd := in.data.OpenBlocks()
+	defer fd.Close()
+	seen := make(map[uint64]bool)
+	pids := UInt64Slice{}
+	br := NewBlockReader(fd)
+	for records := br.Next(); records != nil; records = br.Next() {
+		if len(records) > 0 && records[0].Type == MEMA_THREAD {
+			if pid := records[0].ThreadMarker().Pid; !seen[pid] {
+				seen[pid] = true
+				pids = append(pids, pid)
+			}
+		}
+	}
+	pids.Sort()
+	return pids
+}
+
+type mergeInputsByTime []*mergeInput
+
+func (p mergeInputsByTime) Len() int           { return len(p) }
+func (p mergeInputsByTime) Less(i, j int) bool { return p[i].time < p[j].time }
+func (p mergeInputsByTime) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// A process of a merged trace, and where it came from
+type MergedProcess struct {
+	Pid      uint64
+	Filename string
+	// Its process in Filename, if that is a merged trace too, otherwise zero
+	InputPid uint64
+}
+
+// Writes the traces `filenames` as one trace, either one after another in
+// order of their start times or, with -interleave, block by block in time
+// order. Each trace becomes a process, numbered from one in the order given,
+// and keeps its own page tables. The processes of a trace which was merged
+// already stay apart, numbered in turn. The page table of each process is
+// written at the start of its first block, so that lookups find it whichever
+// process is looked at. Returns the processes of the result.
+func Merge(filenames []string, filename string) ([]MergedProcess, error) {
+	inputs := []*mergeInput{}
+	processes := []MergedProcess{}
+	for _, name := range filenames {
+		data, fd := OpenProgramData(name)
+		in := &mergeInput{
+			filename: name,
+			pids:     make(map[uint64]uint64),
+			data:     data,
+			fd:       fd,
+			reader:   NewBlockReader(fd),
+			maps:     FormatMaps(data.region),
+			tids:     make(map[ThreadMarker]uint64),
+		}
+		defer in.fd.Close()
+		in.advance()
+
+		input_pids := []uint64{0}
+		if len(in.records) > 0 && in.records[0].Type == MEMA_THREAD &&
+			in.records[0].ThreadMarker().Pid != 0 {
+			input_pids = in.scanProcesses()
+			in.started = true
+		}
+		for _, pid := range input_pids {
+			in.pids[pid] = uint64(len(processes) + 1)
+			processes = append(processes, MergedProcess{in.pids[pid], name, pid})
+		}
+		inputs = append(inputs, in)
+	}
+	sort.Stable(mergeInputsByTime(inputs))
+
+	// The records are copied as they are, so must mean the same thing
+	for _, in := range inputs[1:] {
+		if in.data.version != inputs[0].data.version {
+			return nil, fmt.Errorf("%s is a version %d trace and %s version %d",
+				inputs[0].filename, inputs[0].data.version, in.filename, in.data.version)
+		}
+	}
+
+	tw, err := CreateTrace(filename, inputs[0].data.version, inputs[0].data.region)
+	if err != nil {
+		return nil, err
+	}
+
+	// Which process each thread id in the output belongs to
+	tid_owner := make(map[uint64]uint64)
+	out := Records{}
+
+	// Writes `records` in blocks which each begin with `marker`
+	write := func(marker Record, records Records) {
+		for len(records) > 0 && err == nil {
+			n := RECORDS_PER_BLOCK - 1
+			if n > len(records) {
+				n = len(records)
+			}
+			// Keep page tables in one block with their text
+			split := n
+			for split > 0 && split < len(records) && records[split].Type == MEMA_MAPS_TEXT {
+				split--
+			}
+			if split > 0 {
+				n = split
+			}
+			out = append(append(out[:0], marker), records[:n]...)
+			err = tw.Write(out)
+			records = records[n:]
+		}
+	}
+
+	for err == nil {
+		// The next block is the earliest one if interleaving, otherwise
+		// the next one of the earliest trace which hasn't finished
+		var next *mergeInput
+		for _, in := range inputs {
+			if in.records == nil {
+				continue
+			}
+			if next == nil || (*interleave && in.time < next.time) {
+				next = in
+			}
+			if !*interleave {
+				break
+			}
+		}
+		if next == nil {
+			break
+		}
+
+		records := next.records
+		marker := Record{Type: MEMA_THREAD}
+		marker.ThreadMarker().Pid = next.pids[0]
+		body := records
+		if len(records) > 0 && records[0].Type == MEMA_THREAD {
+			thread := *records[0].ThreadMarker()
+			pid, tid := next.pids[thread.Pid], thread.Tid
+			if owner, ok := tid_owner[tid]; ok && owner != pid {
+				if _, ok := next.tids[thread]; !ok {
+					next.tids[thread] = tid&0xffffffff | pid<<32
+					log.Printf("Thread %d of %s is renumbered %d", tid, next.filename, next.tids[thread])
+				}
+			}
+			if renumbered, ok := next.tids[thread]; ok {
+				tid = renumbered
+			}
+			tid_owner[tid] = pid
+			*marker.ThreadMarker() = ThreadMarker{tid, pid}
+			body = records[1:]
+		}
+
+		if !next.started {
+			next.started = true
+			body = append(MakeMapsRecords(next.time, next.maps), body...)
+		}
+		write(marker, body)
+
+		if *verbose {
+			log.Printf("Wrote a block of %s", next.filename)
+		}
+		next.advance()
+	}
+
+	if err2 := tw.Close(); err == nil {
+		err = err2
+	}
+	return processes, err
+}
+
+// The "merge" action
+func MergeAction(filenames []string) {
+	if len(filenames) < 2 {
+		log.Fatal("merge takes at least two traces")
+	}
+	filename := OutputFilename("merged", ".mema")
+	processes, err := Merge(filenames, filename)
+	if err != nil {
+		log.Fatal("Merge failed: ", err)
+	}
+	fmt.Printf("Wrote %s with processes:\n", filename)
+	for _, p := range processes {
+		if p.InputPid != 0 {
+			fmt.Printf("  -pid %d  %s -pid %d\n", p.Pid, p.Filename, p.InputPid)
+		} else {
+			fmt.Printf("  -pid %d  %s\n", p.Pid, p.Filename)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Describes the blocks of the trace at `filename` by their markers and
+// accesses, e.g. "1/7:a16,a32" for thread 7 of process 1
+func describeMergedTrace(filename string) string {
+	_, fd := OpenProgramData(filename)
+	defer fd.Close()
+	blocks := []string{}
+	br := NewBlockReader(fd)
+	for records := br.Next(); records != nil; records = br.Next() {
+		m := records[0].ThreadMarker()
+		accesses := []string{}
+		for i := range records {
+			if records[i].Type == MEMA_ACCESS {
+				accesses = append(accesses, fmt.Sprintf("a%d", records[i].MemAccess().Addr))
+			}
+		}
+		blocks = append(blocks, fmt.Sprintf("%d/%d:%s", m.Pid, m.Tid, strings.Join(accesses, ",")))
+	}
+	return strings.Join(blocks, " ")
+}
+
+func TestMerge(t *testing.T) {
+	dir := testTraceDir(t)
+	defer os.RemoveAll(dir)
+	defer func(saved bool) { *interleave = saved }(*interleave)
+
+	writeTestTrace(t, dir, "a.mema",
+		Records{threadRecord(1), accessRecord(16, 1)},
+		Records{threadRecord(1), accessRecord(32, 3)})
+	writeTestTrace(t, dir, "b.mema",
+		Records{threadRecord(1), accessRecord(48, 2)},
+		Records{threadRecord(2), accessRecord(64, 4)})
+	writeTestTrace(t, dir, "c.mema",
+		Records{threadRecord(5), accessRecord(80, 0.5)})
+	path := func(name string) string { return filepath.Join(dir, name) }
+
+	tests := []struct {
+		inputs     []string
+		interleave bool
+		want       string
+		processes  []MergedProcess
+	}{
+		// One after another, and b's thread 1 renumbered since a has one
+		{[]string{"a.mema", "b.mema"}, false,
+			"1/1:a16 1/1:a32 2/8589934593:a48 2/2:a64",
+			[]MergedProcess{{1, "a.mema", 0}, {2, "b.mema", 0}}},
+		// In time order
+		{[]string{"a.mema", "b.mema"}, true,
+			"1/1:a16 2/8589934593:a48 1/1:a32 2/2:a64",
+			[]MergedProcess{{1, "a.mema", 0}, {2, "b.mema", 0}}},
+		// A merged trace keeps its processes apart, which come first since
+		// it is given first, though c starts earlier
+		{[]string{"ab.mema", "c.mema"}, true,
+			"3/5:a80 1/1:a16 2/8589934593:a48 1/1:a32 2/2:a64",
+			[]MergedProcess{{1, "ab.mema", 1}, {2, "ab.mema", 2}, {3, "c.mema", 0}}},
+		{[]string{"c.mema", "ab.mema"}, false,
+			"1/5:a80 2/1:a16 3/8589934593:a48 2/1:a32 3/2:a64",
+			[]MergedProcess{{1, "c.mema", 0}, {2, "ab.mema", 1}, {3, "ab.mema", 2}}},
+	}
+	for i, test := range tests {
+		*interleave = test.interleave
+		inputs := []string{}
+		for _, name := range test.inputs {
+			inputs = append(inputs, path(name))
+		}
+		output := path(fmt.Sprintf("out%d.mema", i))
+		if i == 1 {
+			// The input of the nested merges
+			output = path("ab.mema")
+		}
+		processes, err := Merge(inputs, output)
+		if err != nil {
+			t.Fatalf("%v: %v", test.inputs, err)
+		}
+		if got := describeMergedTrace(output); got != test.want {
+			t.Errorf("%v, -interleave=%v: merged %q, want %q", test.inputs, test.interleave, got, test.want)
+		}
+		if len(processes) != len(test.processes) {
+			t.Errorf("%v: processes %+v, want %+v", test.inputs, processes, test.processes)
+			continue
+		}
+		for j, p := range processes {
+			want := test.processes[j]
+			want.Filename = path(want.Filename)
+			if p != want {
+				t.Errorf("%v: process %d is %+v, want %+v", test.inputs, j, p, want)
+			}
+		}
+	}
+}
+
+func TestWantBlock(t *testing.T) {
+	defer func(saved uint64) { *only_pid = saved }(*only_pid)
+
+	marker := func(pid uint64) Record {
+		r := threadRecord(1)
+		r.ThreadMarker().Pid = pid
+		return r
+	}
+	tests := []struct {
+		only_pid uint64
+		records  Records
+		want     bool
+	}{
+		{0, Records{marker(2), accessRecord(16, 1)}, true},
+		{2, Records{marker(2), accessRecord(16, 1)}, true},
+		{1, Records{marker(2), accessRecord(16, 1)}, false},
+		// Traces which aren't merged are process zero
+		{1, Records{marker(0)}, false},
+		// Blocks without a marker can't be told apart
+		{1, Records{accessRecord(16, 1)}, true},
+		{1, Records{}, true},
+	}
+	for _, test := range tests {
+		*only_pid = test.only_pid
+		if got := WantBlock(test.records); got != test.want {
+			t.Errorf("-pid %d: WantBlock(%+v) = %v, want %v", test.only_pid, test.records, got, test.want)
+		}
+	}
+}
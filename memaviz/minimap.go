@@ -0,0 +1,165 @@
+// minimap.go: a narrow strip at the right of the window showing the whole
+//             trace, with the part in view, search hits and bookmarks
+
+package main
+
+import (
+	"flag"
+	"math"
+
+	"github.com/go-gl/gl"
+	"github.com/go-gl/glh"
+)
+
+var show_minimap = flag.Bool("minimap", true, "draw an overview of the whole trace")
+
+// Placement of the minimap, in projection co-ordinates
+const (
+	MINIMAP_LEFT  = 5.75
+	MINIMAP_RIGHT = 6.05
+	// Number of address columns the accesses of a block are binned into
+	MINIMAP_COLUMNS = 32
+	// Blocks are merged when there are more than this many
+	MINIMAP_MAX_ROWS = 512
+)
+
+// Bins the accesses of the block by their x position in the plot, reads and
+// writes separately. Must be called between ActiveRegionIDs and
+// GenerateVertices, which drops the records.
+func (block *Block) ComputeDensity() {
+	block.density = make([]uint32, 2*MINIMAP_COLUMNS)
+
+	for i := range block.records {
+		r := &block.records[i]
+		if r.Type != MEMA_ACCESS {
+			continue
+		}
+		a := r.MemAccess()
+		px, ok := block.AccessX(a.Addr)
+		if !ok {
+			continue
+		}
+		// The plot spans -2 to 2
+		x := int((px + 2) / 4 * MINIMAP_COLUMNS)
+		if x < 0 {
+			x = 0
+		}
+		if x >= MINIMAP_COLUMNS {
+			x = MINIMAP_COLUMNS - 1
+		}
+		block.density[2*x+int(a.IsWrite)]++
+	}
+}
+
+// Whether `px` (in projection co-ordinates) is over the minimap
+func InMinimap(px float64) bool {
+	return *show_minimap && px >= MINIMAP_LEFT && px < MINIMAP_RIGHT
+}
+
+// Returns the record at height `py` (in projection co-ordinates) of the
+// minimap
+func (data *ProgramData) MinimapRecord(py float64) int64 {
+	return int64((py + 2) / 4 * float64(NumRecords(data.blocks)))
+}
+
+// Draws the minimap, marking the records [start_index, start_index+n) in
+// view and the records `hits`
+func (data *ProgramData) DrawMinimap(start_index, n int64, hits []int64) {
+	if !*show_minimap || len(data.blocks) == 0 {
+		return
+	}
+	blocks := data.blocks
+	total := NumRecords(blocks)
+	column_width := (MINIMAP_RIGHT - MINIMAP_LEFT) / MINIMAP_COLUMNS
+
+	glh.With(&Timer{Name: "DrawMinimap"}, func() {
+		glh.With(glh.Matrix{gl.MODELVIEW}, func() {
+			gl.Translated(0, -2, 0)
+			gl.Scaled(1, 4/float64(total), 1)
+
+			// Density, one row per group of blocks. Brightness is the log of
+			// the number of accesses, colour the fraction of writes.
+			per_row := (len(blocks) + MINIMAP_MAX_ROWS - 1) / MINIMAP_MAX_ROWS
+			var row [2 * MINIMAP_COLUMNS]uint32
+			glh.With(glh.Primitive{gl.QUADS}, func() {
+				for first := 0; first < len(blocks); first += per_row {
+					last := first + per_row
+					if last > len(blocks) {
+						last = len(blocks)
+					}
+					row = [2 * MINIMAP_COLUMNS]uint32{}
+					max := uint32(0)
+					for _, b := range blocks[first:last] {
+						for j, c := range b.density {
+							row[j] += c
+						}
+					}
+					for x := 0; x < MINIMAP_COLUMNS; x++ {
+						if c := row[2*x] + row[2*x+1]; c > max {
+							max = c
+						}
+					}
+					if max == 0 {
+						continue
+					}
+
+					y1 := float64(blocks[first].first_record)
+					y2 := float64(blocks[last-1].first_record + blocks[last-1].nrecords)
+					for x := 0; x < MINIMAP_COLUMNS; x++ {
+						reads, writes := row[2*x], row[2*x+1]
+						if reads+writes == 0 {
+							continue
+						}
+						v := float32(math.Log(float64(reads+writes)+1) / math.Log(float64(max)+1))
+						w := float32(writes) / float32(reads+writes)
+						gl.Color4f(v*w, v*(1-w), 0, 1)
+						x1 := MINIMAP_LEFT + float64(x)*column_width
+						gl.Vertex2d(x1, y1)
+						gl.Vertex2d(x1+column_width, y1)
+						gl.Vertex2d(x1+column_width, y2)
+						gl.Vertex2d(x1, y2)
+					}
+				}
+			})
+
+			// Bookmarks to the left, search hits across
+			glh.With(glh.Primitive{gl.QUADS}, func() {
+				for _, b := range data.Bookmarks() {
+					r, g, bl := BookmarkColour(b.Name)
+					gl.Color4f(r, g, bl, 0.9)
+					gl.Vertex2d(MINIMAP_LEFT-0.05, float64(b.Start))
+					gl.Vertex2d(MINIMAP_LEFT-0.02, float64(b.Start))
+					gl.Vertex2d(MINIMAP_LEFT-0.02, float64(b.End))
+					gl.Vertex2d(MINIMAP_LEFT-0.05, float64(b.End))
+				}
+			})
+			_, h := glh.GetViewportWHD()
+			glh.With(glh.Primitive{gl.LINES}, func() {
+				gl.Color4f(1, 0, 1, 0.8)
+				// At most one line per pixel
+				last := int64(-1)
+				per_pixel := total / int64(h+1)
+				for _, hit := range hits {
+					if last >= 0 && hit-last <= per_pixel {
+						continue
+					}
+					last = hit
+					gl.Vertex2d(MINIMAP_LEFT, float64(hit))
+					gl.Vertex2d(MINIMAP_RIGHT, float64(hit))
+				}
+			})
+
+			// The view
+			gl.Color4f(1, 1, 1, 0.25)
+			glh.With(glh.Primitive{gl.QUADS}, func() {
+				glh.Squared(MINIMAP_LEFT-0.02, float64(start_index),
+					MINIMAP_RIGHT-MINIMAP_LEFT+0.04, float64(n))
+			})
+			gl.Color4f(1, 1, 1, 1)
+			glh.With(glh.Primitive{gl.LINE_LOOP}, func() {
+				glh.Squared(MINIMAP_LEFT-0.02, float64(start_index),
+					MINIMAP_RIGHT-MINIMAP_LEFT+0.04, float64(n))
+			})
+		})
+	})
+}
@@ -0,0 +1,236 @@
+// pprof.go: exporting the accesses of a trace as a pprof profile, so that
+//           `go tool pprof` can be used to explore them
+
+package main
+
+import (
+	"encoding/binary"
+	"flag"
+	"log"
+	"os"
+
+	"github.com/google/pprof/profile"
+)
+
+var output_filename = flag.String("o", "", "output file for the export actions")
+
+// Returns -o, or `filename` with `extension` appended
+func OutputFilename(filename, extension string) string {
+	if *output_filename != "" {
+		return *output_filename
+	}
+	return filename + extension
+}
+
+// Indices into the sample values
+const (
+	PPROF_READS = iota
+	PPROF_WRITES
+	PPROF_BYTES
+	PPROF_MISSES
+	PPROF_NVALUES
+)
+
+type PprofBuilder struct {
+	data *ProgramData
+	p    *profile.Profile
+
+	samples   map[string]*profile.Sample
+	locations map[RegionCacheKey]*profile.Location
+	functions map[string]*profile.Function
+	mappings  map[*MemRegion]*profile.Mapping
+}
+
+func NewPprofBuilder(data *ProgramData) *PprofBuilder {
+	return &PprofBuilder{
+		data: data,
+		p: &profile.Profile{
+			SampleType: []*profile.ValueType{
+				{Type: "reads", Unit: "count"},
+				{Type: "writes", Unit: "count"},
+				// Cache lines touched for the first time, in bytes
+				{Type: "bytes", Unit: "bytes"},
+				{Type: "cache_misses", Unit: "count"},
+			},
+			DefaultSampleType: "cache_misses",
+		},
+		samples:   make(map[string]*profile.Sample),
+		locations: make(map[RegionCacheKey]*profile.Location),
+		functions: make(map[string]*profile.Function),
+		mappings:  make(map[*MemRegion]*profile.Mapping),
+	}
+}
+
+func (b *PprofBuilder) Mapping(addr uint64, index int64) *profile.Mapping {
+	r, ok := b.data.FindRegion(addr, index)
+	if !ok {
+		return nil
+	}
+	m, ok := b.mappings[r]
+	if !ok {
+		m = &profile.Mapping{
+			ID:     uint64(len(b.p.Mapping) + 1),
+			Start:  r.low,
+			Limit:  r.hi,
+			Offset: r.FileOffset(),
+			File:   r.pathname,
+		}
+		b.p.Mapping = append(b.p.Mapping, m)
+		b.mappings[r] = m
+	}
+	return m
+}
+
+func (b *PprofBuilder) Function(name, filename string) *profile.Function {
+	key := name + "\x00" + filename
+	f, ok := b.functions[key]
+	if !ok {
+		f = &profile.Function{
+			ID:       uint64(len(b.p.Function) + 1),
+			Name:     name,
+			Filename: filename,
+		}
+		b.p.Function = append(b.p.Function, f)
+		b.functions[key] = f
+	}
+	return f
+}
+
+// Returns the location for `addr` at record `index`, which lies in the
+// function starting at `function` (zero if unknown)
+func (b *PprofBuilder) Location(addr, function uint64, index int64) *profile.Location {
+	key := RegionCacheKey{addr, b.data.tableAt(index)}
+	l, ok := b.locations[key]
+	if ok {
+		return l
+	}
+	if function == 0 {
+		function = addr
+	}
+	l = &profile.Location{
+		ID:      uint64(len(b.p.Location) + 1),
+		Address: addr,
+		Mapping: b.Mapping(addr, index),
+	}
+	// Innermost first, as pprof expects for inlined functions
+	for _, loc := range b.data.GetSourceLocationsAt(addr, index) {
+		l.Line = append(l.Line, profile.Line{
+			Function: b.Function(loc.Function, loc.File),
+			Line:     int64(loc.Line),
+			Column:   int64(loc.Column),
+		})
+	}
+	if len(l.Line) == 0 {
+		l.Line = []profile.Line{
+			{Function: b.Function(b.data.GetSymbolAt(function, index), "")},
+		}
+	}
+	b.p.Location = append(b.p.Location, l)
+	b.locations[key] = l
+	return l
+}
+
+// Adds `values` to the sample for an access by `pc` with call stack `stack`,
+// made at record `index`. `returns` are the return addresses of the calls of
+// `stack`, zero where they aren't recorded.
+func (b *PprofBuilder) Add(index int64, pc uint64, stack, returns []uint64, values *[PPROF_NVALUES]int64) {
+	// The same addresses mean different code under different page tables
+	key := make([]byte, 8*(2*len(stack)+2))
+	binary.LittleEndian.PutUint64(key, uint64(b.data.tableAt(index)))
+	binary.LittleEndian.PutUint64(key[8:], pc)
+	for i, f := range stack {
+		binary.LittleEndian.PutUint64(key[8*(2*i+2):], f)
+		binary.LittleEndian.PutUint64(key[8*(2*i+3):], returns[i])
+	}
+
+	s, ok := b.samples[string(key)]
+	if !ok {
+		// pprof wants the leaf first
+		locations := make([]*profile.Location, 0, len(stack)+1)
+		leaf_function := uint64(0)
+		if len(stack) > 0 {
+			leaf_function = stack[len(stack)-1]
+		}
+		locations = append(locations, b.Location(CallSite(pc), leaf_function, index))
+		// The callers, at the call they made, or failing that their entry
+		for i := len(stack) - 2; i >= 0; i-- {
+			site := stack[i]
+			if returns[i+1] != 0 {
+				site = CallSite(returns[i+1])
+			}
+			locations = append(locations, b.Location(site, stack[i], index))
+		}
+		s = &profile.Sample{
+			Location: locations,
+			Value:    make([]int64, PPROF_NVALUES),
+		}
+		b.p.Sample = append(b.p.Sample, s)
+		b.samples[string(key)] = s
+	}
+	for i := range values {
+		s.Value[i] += values[i]
+	}
+}
+
+func (data *ProgramData) BuildPprof() *profile.Profile {
+	b := NewPprofBuilder(data)
+	cache := NewDefaultCache()
+	calls := NewThreadTracker()
+	touched := make(map[uint64]struct{})
+
+	first_time, last_time := 0., 0.
+
+	data.ForEachRecord(func(index int64, r *Record) {
+		if calls.Update(index, r) || r.Type != MEMA_ACCESS {
+			return
+		}
+		a := r.MemAccess()
+
+		var values [PPROF_NVALUES]int64
+		if a.IsWrite == 1 {
+			values[PPROF_WRITES] = 1
+		} else {
+			values[PPROF_READS] = 1
+		}
+		if cache.Access(a.Addr) {
+			values[PPROF_MISSES] = 1
+		}
+		line := a.Addr / *LINE_SIZE
+		if _, ok := touched[line]; !ok {
+			touched[line] = struct{}{}
+			values[PPROF_BYTES] = int64(*LINE_SIZE)
+		}
+
+		b.Add(index, a.Pc, calls.Stack, calls.ReturnPcs, &values)
+
+		if first_time == 0 {
+			first_time = a.Time
+		}
+		last_time = a.Time
+	})
+
+	b.p.TimeNanos = int64(first_time * 1e9)
+	b.p.DurationNanos = int64((last_time - first_time) * 1e9)
+
+	return b.p
+}
+
+// The "pprof" action
+func (data *ProgramData) ExportPprof() {
+	p := data.BuildPprof()
+	if err := p.CheckValid(); err != nil {
+		log.Panic("Invalid profile: ", err)
+	}
+
+	filename := OutputFilename(data.filename, ".pprof")
+	fd, err := os.Create(filename)
+	if err != nil {
+		log.Panic("Fatal error: ", err)
+	}
+	defer fd.Close()
+
+	if err := p.Write(fd); err != nil {
+		log.Panic("Error writing profile: ", err)
+	}
+	log.Printf("Wrote %d samples to %s", len(p.Sample), filename)
+}
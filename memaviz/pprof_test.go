@@ -0,0 +1,58 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestBuildPprofCallSites(t *testing.T) {
+	dir := testTraceDir(t)
+	defer os.RemoveAll(dir)
+
+	enter := func(f, ret uint64) Record {
+		r := callRecord(MEMA_FUNC_ENTER, f)
+		r.FunctionCall().ReturnPc = ret
+		return r
+	}
+	access := func(pc, addr uint64) Record {
+		r := accessRecord(addr, 0)
+		r.MemAccess().Pc = pc
+		return r
+	}
+	data := writeTestTrace(t, dir, "in.mema", Records{
+		threadRecord(1),
+		enter(0x1000, 0),
+		access(0x1010, 0),
+		enter(0x2000, 0x1020),
+		access(0x2010, 64),
+		callRecord(MEMA_FUNC_EXIT, 0x2000),
+		callRecord(MEMA_FUNC_EXIT, 0x1000),
+	}, Records{
+		threadRecord(2),
+		enter(0x1000, 0),
+		// Without a return address, as in older traces
+		enter(0x2000, 0),
+		access(0x2010, 128),
+		callRecord(MEMA_FUNC_EXIT, 0x2000),
+		callRecord(MEMA_FUNC_EXIT, 0x1000),
+	})
+
+	p := data.BuildPprof()
+	if err := p.CheckValid(); err != nil {
+		t.Fatal(err)
+	}
+	var got [][]uint64
+	for _, s := range p.Sample {
+		var addrs []uint64
+		for _, l := range s.Location {
+			addrs = append(addrs, l.Address)
+		}
+		got = append(got, addrs)
+	}
+	// Leaf first, each caller at its call, or its entry if that isn't known
+	want := [][]uint64{{0x100f}, {0x200f, 0x101f}, {0x200f, 0x1000}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("sample locations = %x, want %x", got, want)
+	}
+}
@@ -0,0 +1,338 @@
+// profile.go: attributing accesses to the functions which made them, and to
+//             all of their callers
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"sort"
+)
+
+var profile_sort = flag.String("sort", "self",
+	"order of the profile: self, inclusive or misses")
+
+type ProfileCounts struct {
+	AccessCounts
+	// Accesses which missed in the simulated cache
+	Misses uint64
+	// Distinct bytes and cache lines touched. A function's are summed over
+	// its calls, each of which counts what it touched once.
+	Bytes, Lines uint64
+}
+
+func (c *ProfileCounts) Add(a *MemAccess, miss bool) {
+	c.AccessCounts.Add(a)
+	if miss {
+		c.Misses++
+	}
+}
+
+// Adds in the counts of `o`, e.g. for another function of the same name
+func (c *ProfileCounts) AddCounts(o *ProfileCounts) {
+	c.Reads += o.Reads
+	c.Writes += o.Writes
+	c.Misses += o.Misses
+	c.Bytes += o.Bytes
+	c.Lines += o.Lines
+}
+
+// The bytes and cache lines touched, e.g. during a call
+type footprint struct {
+	bytes, lines map[uint64]struct{}
+}
+
+func newFootprint() *footprint {
+	return &footprint{make(map[uint64]struct{}), make(map[uint64]struct{})}
+}
+
+// Marks [addr, addr+size) touched, and returns how many of its bytes and
+// lines weren't already
+func (f *footprint) touch(addr, size uint64) (uint64, uint64) {
+	new_bytes, new_lines := uint64(0), uint64(0)
+	for b := addr; b < addr+size; b++ {
+		if _, ok := f.bytes[b]; !ok {
+			f.bytes[b] = struct{}{}
+			new_bytes++
+		}
+	}
+	for l := addr / *LINE_SIZE; l <= (addr+size-1) / *LINE_SIZE; l++ {
+		if _, ok := f.lines[l]; !ok {
+			f.lines[l] = struct{}{}
+			new_lines++
+		}
+	}
+	return new_bytes, new_lines
+}
+
+// Adds in what `o` touched, reusing the larger of their maps
+func (f *footprint) merge(o *footprint) {
+	if len(o.bytes) > len(f.bytes) {
+		f.bytes, o.bytes = o.bytes, f.bytes
+	}
+	for b := range o.bytes {
+		f.bytes[b] = struct{}{}
+	}
+	if len(o.lines) > len(f.lines) {
+		f.lines, o.lines = o.lines, f.lines
+	}
+	for l := range o.lines {
+		f.lines[l] = struct{}{}
+	}
+}
+
+// An active call, with what it has touched itself and including its callees.
+// Each callee's is merged into its caller's when it exits, rather than every
+// access being added to each active call.
+type profileFrame struct {
+	f          uint64
+	self, incl *footprint
+}
+
+type FunctionProfile struct {
+	Func            uint64
+	Self, Inclusive ProfileCounts
+	Calls           uint64
+
+	// Index (plus one) of the last access counted in Inclusive, so that
+	// recursive calls don't count an access more than once
+	last_counted int64
+}
+
+type FunctionProfiles struct {
+	functions map[uint64]*FunctionProfile
+	Total     ProfileCounts
+}
+
+func (p *FunctionProfiles) Get(f uint64) *FunctionProfile {
+	fp, ok := p.functions[f]
+	if !ok {
+		fp = &FunctionProfile{Func: f}
+		p.functions[f] = fp
+	}
+	return fp
+}
+
+// Counts what the innermost call of `frames` touched, and merges it into its
+// caller's. `stack` is the stack of calls without it.
+func (p *FunctionProfiles) exitFrame(frames []*profileFrame, stack []uint64) []*profileFrame {
+	frame := frames[len(frames)-1]
+	frames = frames[:len(frames)-1]
+
+	// A recursive call's bytes are counted by the outermost one
+	recursive := false
+	for _, f := range stack {
+		recursive = recursive || f == frame.f
+	}
+	if !recursive {
+		fp := p.Get(frame.f)
+		fp.Inclusive.Bytes += uint64(len(frame.incl.bytes))
+		fp.Inclusive.Lines += uint64(len(frame.incl.lines))
+	}
+	if len(frames) > 0 {
+		frames[len(frames)-1].incl.merge(frame.incl)
+	}
+	return frames
+}
+
+func (data *ProgramData) BuildProfile() *FunctionProfiles {
+	p := &FunctionProfiles{functions: make(map[uint64]*FunctionProfile)}
+	cache := NewDefaultCache()
+	calls := NewThreadTracker()
+	// The active calls of each thread, following calls.Stack
+	frames := make(map[ThreadMarker][]*profileFrame)
+	total, outside := newFootprint(), newFootprint()
+
+	data.ForEachRecord(func(index int64, r *Record) {
+		if r.Type == MEMA_FUNC_ENTER {
+			p.Get(r.FunctionCall().FuncPointer).Calls++
+		}
+		if calls.Update(index, r) {
+			fs := frames[calls.Thread()]
+			for len(fs) > calls.Depth() {
+				fs = p.exitFrame(fs, calls.Stack[:len(fs)-1])
+			}
+			if len(fs) < calls.Depth() {
+				fs = append(fs, &profileFrame{calls.Current(), newFootprint(), newFootprint()})
+			}
+			frames[calls.Thread()] = fs
+			return
+		}
+		if r.Type != MEMA_ACCESS {
+			return
+		}
+		a := r.MemAccess()
+		miss := cache.Access(a.Addr)
+		size, ok := data.AccessSize(a)
+		if !ok {
+			size = 1
+		}
+
+		p.Total.Add(a, miss)
+		b, l := total.touch(a.Addr, size)
+		p.Total.Bytes, p.Total.Lines = p.Total.Bytes+b, p.Total.Lines+l
+
+		// Accesses outside of any traced function go to function 0
+		fs := frames[calls.Thread()]
+		if len(fs) == 0 {
+			fp := p.Get(0)
+			fp.Self.Add(a, miss)
+			fp.Inclusive.Add(a, miss)
+			b, l := outside.touch(a.Addr, size)
+			fp.Self.Bytes, fp.Self.Lines = fp.Self.Bytes+b, fp.Self.Lines+l
+			fp.Inclusive.Bytes, fp.Inclusive.Lines = fp.Self.Bytes, fp.Self.Lines
+			return
+		}
+
+		frame := fs[len(fs)-1]
+		fp := p.Get(frame.f)
+		fp.Self.Add(a, miss)
+		b, l = frame.self.touch(a.Addr, size)
+		fp.Self.Bytes, fp.Self.Lines = fp.Self.Bytes+b, fp.Self.Lines+l
+		frame.incl.touch(a.Addr, size)
+
+		for _, f := range calls.Stack {
+			fp := p.Get(f)
+			if fp.last_counted == index+1 {
+				continue
+			}
+			fp.last_counted = index + 1
+			fp.Inclusive.Add(a, miss)
+		}
+	})
+
+	// Calls still being made at the end
+	for thread, fs := range frames {
+		stack := calls.Threads()[thread].Stack
+		for len(fs) > 0 {
+			fs = p.exitFrame(fs, stack[:len(fs)-1])
+		}
+	}
+	return p
+}
+
+// Function profiles ordered by `key`, largest first
+func (p *FunctionProfiles) Sorted(key func(fp *FunctionProfile) uint64) []*FunctionProfile {
+	result := make([]*FunctionProfile, 0, len(p.functions))
+	for _, fp := range p.functions {
+		result = append(result, fp)
+	}
+	sort.Sort(FunctionProfilesBy{result, key})
+	return result
+}
+
+type FunctionProfilesBy struct {
+	profiles []*FunctionProfile
+	key      func(fp *FunctionProfile) uint64
+}
+
+func (p FunctionProfilesBy) Len() int { return len(p.profiles) }
+func (p FunctionProfilesBy) Less(i, j int) bool {
+	ki, kj := p.key(p.profiles[i]), p.key(p.profiles[j])
+	if ki != kj {
+		return ki > kj
+	}
+	return p.profiles[i].Func < p.profiles[j].Func
+}
+func (p FunctionProfilesBy) Swap(i, j int) {
+	p.profiles[i], p.profiles[j] = p.profiles[j], p.profiles[i]
+}
+
+func (data *ProgramData) FunctionName(f uint64) string {
+	if f == 0 {
+		return "<no function>"
+	}
+	data.lock.Lock()
+	name, ok := data.function_names[f]
+	data.lock.Unlock()
+	if ok {
+		return name
+	}
+
+	// Not under the lock, this may have to load the binary
+	name = data.GetSymbol(f)
+
+	data.lock.Lock()
+	data.function_names[f] = name
+	data.lock.Unlock()
+	return name
+}
+
+// Returns the name of `f` if it has been looked up already, otherwise looks
+// it up in the background, for the main thread which mustn't wait for it
+func (data *ProgramData) FunctionNameIfKnown(f uint64) (string, bool) {
+	data.lock.Lock()
+	defer data.lock.Unlock()
+	name, ok := data.function_names[f]
+	if data.function_name_requests == nil {
+		data.function_name_requests = make(map[uint64]bool)
+	}
+	if !ok && !data.function_name_requests[f] {
+		data.function_name_requests[f] = true
+		go func() {
+			data.FunctionName(f)
+			data.lock.Lock()
+			delete(data.function_name_requests, f)
+			data.lock.Unlock()
+		}()
+	}
+	return name, ok
+}
+
+// Drops the cached function names, e.g. because -simple-names changed
+func (data *ProgramData) ForgetFunctionNames() {
+	data.lock.Lock()
+	data.function_names = make(map[uint64]string)
+	data.lock.Unlock()
+}
+
+func percent(a, b uint64) float64 {
+	if b == 0 {
+		return 0
+	}
+	return 100 * float64(a) / float64(b)
+}
+
+// The "profile" action
+func (data *ProgramData) Profile() {
+	p := data.BuildProfile()
+
+	var key func(fp *FunctionProfile) uint64
+	switch *profile_sort {
+	case "self":
+		key = func(fp *FunctionProfile) uint64 { return fp.Self.Total() }
+	case "inclusive":
+		key = func(fp *FunctionProfile) uint64 { return fp.Inclusive.Total() }
+	case "misses":
+		key = func(fp *FunctionProfile) uint64 { return fp.Self.Misses }
+	default:
+		log.Fatalf("Unknown -sort %q", *profile_sort)
+	}
+
+	total := p.Total.Total()
+	fmt.Printf("%d accesses (%d reads, %d writes), %d distinct bytes, "+
+		"%d simulated misses in a %d byte %d-way cache with %d byte lines\n\n",
+		total, p.Total.Reads, p.Total.Writes, p.Total.Bytes,
+		p.Total.Misses, *cache_size, *cache_ways, *LINE_SIZE)
+
+	fmt.Printf("%54s | %47s |\n", "self", "inclusive")
+	fmt.Printf("%6s %6s %10s %10s %9s %8s | %6s %10s %10s %9s %8s |  %s\n",
+		"self%", "sum%", "reads", "writes", "distinct", "misses",
+		"incl%", "reads", "writes", "distinct", "misses", "function")
+
+	cumulative := uint64(0)
+	for i, fp := range p.Sorted(key) {
+		if *top_n > 0 && i >= *top_n {
+			break
+		}
+		s, in := &fp.Self, &fp.Inclusive
+		cumulative += s.Total()
+		fmt.Printf("%5.1f%% %5.1f%% %10d %10d %9d %8d | %5.1f%% %10d %10d %9d %8d |  %s\n",
+			percent(s.Total(), total), percent(cumulative, total),
+			s.Reads, s.Writes, s.Bytes, s.Misses,
+			percent(in.Total(), total),
+			in.Reads, in.Writes, in.Bytes, in.Misses,
+			data.FunctionName(fp.Func))
+	}
+}
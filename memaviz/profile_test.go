@@ -0,0 +1,82 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func sizedAccessRecord(addr uint64, size uint8) Record {
+	r := accessRecord(addr, 0)
+	r.MemAccess().Size = size
+	return r
+}
+
+func TestBuildProfile(t *testing.T) {
+	dir := testTraceDir(t)
+	defer os.RemoveAll(dir)
+
+	const top, f, g, h = 1, 2, 3, 4
+	data := writeTestTrace(t, dir, "in.mema", Records{
+		threadRecord(1),
+		callRecord(MEMA_FUNC_ENTER, top),
+		sizedAccessRecord(0, 8),
+		callRecord(MEMA_FUNC_ENTER, f),
+		sizedAccessRecord(0, 8),
+		sizedAccessRecord(8, 8),
+		callRecord(MEMA_FUNC_EXIT, f),
+		callRecord(MEMA_FUNC_ENTER, f),
+		sizedAccessRecord(8, 8),
+		callRecord(MEMA_FUNC_EXIT, f),
+		sizedAccessRecord(100, 4),
+		callRecord(MEMA_FUNC_EXIT, top),
+	}, Records{
+		threadRecord(2),
+		callRecord(MEMA_FUNC_ENTER, g),
+		sizedAccessRecord(200, 8),
+		callRecord(MEMA_FUNC_ENTER, g),
+		sizedAccessRecord(200, 8),
+		sizedAccessRecord(208, 8),
+		callRecord(MEMA_FUNC_EXIT, g),
+		callRecord(MEMA_FUNC_EXIT, g),
+	}, Records{
+		threadRecord(3),
+		// Of unknown size, so counted as one byte
+		sizedAccessRecord(400, 0),
+		// Never exits
+		callRecord(MEMA_FUNC_ENTER, h),
+		sizedAccessRecord(300, 2),
+	})
+
+	p := data.BuildProfile()
+	type counts struct{ accesses, bytes, lines uint64 }
+	get := func(c *ProfileCounts) counts { return counts{c.Total(), c.Bytes, c.Lines} }
+
+	if got, want := get(&p.Total), (counts{10, 39, 5}); got != want {
+		t.Errorf("Total = %+v, want %+v", got, want)
+	}
+	tests := []struct {
+		f               uint64
+		calls           uint64
+		self, inclusive counts
+	}{
+		{0, 0, counts{1, 1, 1}, counts{1, 1, 1}},
+		{top, 1, counts{2, 12, 2}, counts{5, 20, 2}},
+		// Counted once for each call
+		{f, 2, counts{3, 24, 2}, counts{3, 24, 2}},
+		// Only the outermost of the recursive calls counts towards inclusive
+		{g, 2, counts{3, 24, 2}, counts{3, 16, 1}},
+		{h, 1, counts{1, 2, 1}, counts{1, 2, 1}},
+	}
+	for _, test := range tests {
+		fp := p.Get(test.f)
+		if fp.Calls != test.calls {
+			t.Errorf("f%d made %d calls, want %d", test.f, fp.Calls, test.calls)
+		}
+		if got := get(&fp.Self); got != test.self {
+			t.Errorf("f%d self = %+v, want %+v", test.f, got, test.self)
+		}
+		if got := get(&fp.Inclusive); got != test.inclusive {
+			t.Errorf("f%d inclusive = %+v, want %+v", test.f, got, test.inclusive)
+		}
+	}
+}
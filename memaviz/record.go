@@ -13,6 +13,11 @@ const (
 	MEMA_ACCESS     = 0
 	MEMA_FUNC_ENTER = 1
 	MEMA_FUNC_EXIT  = 2
+	MEMA_ALLOC      = 3
+	MEMA_FREE       = 4
+	MEMA_THREAD     = 5
+	MEMA_MAPS       = 6
+	MEMA_MAPS_TEXT  = 7
 )
 
 type Record struct {
@@ -29,6 +34,31 @@ func (r *Record) FunctionCall() *FunctionCall {
 	return (*FunctionCall)(unsafe.Pointer(&r.Content[0]))
 }
 
+func (r *Record) HeapEvent() *HeapEvent {
+	return (*HeapEvent)(unsafe.Pointer(&r.Content[0]))
+}
+
+func (r *Record) ThreadMarker() *ThreadMarker {
+	return (*ThreadMarker)(unsafe.Pointer(&r.Content[0]))
+}
+
+func (r *Record) MapsEvent() *MapsEvent {
+	return (*MapsEvent)(unsafe.Pointer(&r.Content[0]))
+}
+
+// Returns the time of the record, if it has one
+func (r *Record) Time() (float64, bool) {
+	switch r.Type {
+	case MEMA_ACCESS:
+		return r.MemAccess().Time, true
+	case MEMA_ALLOC, MEMA_FREE:
+		return r.HeapEvent().Time, true
+	case MEMA_MAPS:
+		return r.MapsEvent().Time, true
+	}
+	return 0, false
+}
+
 var DummyRecord Record
 
 func RecordSize() int {
@@ -72,6 +102,22 @@ func (r Record) String() string {
 		return fmt.Sprintf("r=%d MemAccess{t=%f write=%5t 0x%x 0x%x 0x%x 0x%x}",
 			r.Type, a.Time, a.IsWrite == 1, a.Pc, a.Bp, a.Sp, a.Addr)
 	}
+	if r.Type == MEMA_ALLOC || r.Type == MEMA_FREE {
+		return fmt.Sprintf("r=%d %v", r.Type, r.HeapEvent())
+	}
+	if r.Type == MEMA_THREAD {
+		t := r.ThreadMarker()
+		if t.Pid != 0 {
+			return fmt.Sprintf("r=%d Thread{tid=%d pid=%d}", r.Type, t.Tid, t.Pid)
+		}
+		return fmt.Sprintf("r=%d Thread{tid=%d}", r.Type, t.Tid)
+	}
+	if r.Type == MEMA_MAPS {
+		return fmt.Sprintf("r=%d %v", r.Type, r.MapsEvent())
+	}
+	if r.Type == MEMA_MAPS_TEXT {
+		return fmt.Sprintf("r=%d MapsText{%q}", r.Type, string(r.Content[:]))
+	}
 	f := r.FunctionCall()
 	//return fmt.Sprintf("r=%d/%x FunctionCall{ptr=0x%x}",
 	//r.Type, r.Magic, f.FuncPointer)
@@ -81,17 +127,52 @@ func (r Record) String() string {
 
 type FunctionCall struct {
 	FuncPointer uint64
-	// TODO: Add PC.
-	//       Any other useful data?
+	// On MEMA_FUNC_ENTER, the return address into the caller, or 0 for traces
+	// before version 3
+	ReturnPc uint64
 }
 
 type MemAccess struct {
 	Time             float64
 	Pc, Bp, Sp, Addr uint64
-	IsWrite          uint64 // because alignment.
+	IsWrite          uint8
+	// In bytes, or 0 if unknown (see ProgramData.AccessSize)
+	Size uint8
+	_    [6]byte // because alignment.
 }
 
 func (a MemAccess) String() string {
 	return fmt.Sprintf("MemAccess{t=%f write=%5t 0x%x 0x%x 0x%x 0x%x}",
 		a.Time, a.IsWrite == 1, a.Pc, a.Bp, a.Sp, a.Addr)
 }
+
+// Content of MEMA_ALLOC and MEMA_FREE records
+type HeapEvent struct {
+	Time float64
+	// Return address into the caller of the allocator
+	Pc, Addr, Size uint64
+}
+
+func (h HeapEvent) String() string {
+	return fmt.Sprintf("HeapEvent{t=%f 0x%x 0x%x size=%d}",
+		h.Time, h.Pc, h.Addr, h.Size)
+}
+
+// Content of MEMA_THREAD records, which start every block
+type ThreadMarker struct {
+	Tid uint64
+	// Which of the traces combined by "merge" the block came from, counting
+	// from one. The runtime leaves it zero.
+	Pid uint64
+}
+
+// Content of MEMA_MAPS records. They are followed by enough MEMA_MAPS_TEXT
+// records to hold Size bytes of /proc/self/maps, 48 in each.
+type MapsEvent struct {
+	Time float64
+	Size uint64
+}
+
+func (m MapsEvent) String() string {
+	return fmt.Sprintf("MapsEvent{t=%f size=%d}", m.Time, m.Size)
+}
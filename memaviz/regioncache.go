@@ -0,0 +1,87 @@
+// regioncache.go: a small LRU of recent region lookups, since symbolization
+//                 asks about the same few pcs over and over
+
+package main
+
+import (
+	"container/list"
+	"sync"
+)
+
+const REGION_CACHE_SIZE = 1024
+
+type RegionCacheKey struct {
+	Addr uint64
+	// Which page table the lookup was made in (see ProgramData.tableAt)
+	Table int
+}
+
+type regionCacheEntry struct {
+	key    RegionCacheKey
+	region *MemRegion
+}
+
+type RegionCache struct {
+	size    int
+	order   *list.List // most recently used at the front
+	entries map[RegionCacheKey]*list.Element
+	// Incremented by Clear, so that lookups which started before it don't
+	// add stale results
+	generation int
+	lock       sync.Mutex
+}
+
+func NewRegionCache(size int) *RegionCache {
+	return &RegionCache{
+		size:    size,
+		order:   list.New(),
+		entries: make(map[RegionCacheKey]*list.Element),
+	}
+}
+
+func (c *RegionCache) Get(key RegionCacheKey) (*MemRegion, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*regionCacheEntry).region, true
+}
+
+func (c *RegionCache) Generation() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.generation
+}
+
+// Adds the result of a lookup which started at `generation`
+func (c *RegionCache) Add(key RegionCacheKey, region *MemRegion, generation int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if generation != c.generation {
+		return
+	}
+	if e, ok := c.entries[key]; ok {
+		e.Value.(*regionCacheEntry).region = region
+		c.order.MoveToFront(e)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&regionCacheEntry{key, region})
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*regionCacheEntry).key)
+	}
+}
+
+// Forgets everything, e.g. because a new page table means that a lookup at an
+// unknown position might find something different
+func (c *RegionCache) Clear() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.generation++
+	c.order.Init()
+	c.entries = make(map[RegionCacheKey]*list.Element)
+}
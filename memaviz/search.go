@@ -0,0 +1,307 @@
+// search.go: finding the accesses to an address, symbol or function, for the
+//            viewer's hit list and the "grep" action
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-gl/gl"
+	"github.com/go-gl/glh"
+)
+
+var max_hits = flag.Int("max-hits", 1000000, "stop searching after this many matching records")
+
+const SEARCH_HELP = "addr=A[-B|+N] pc=A[-B|+N] sym=NAME func=NAME r w (all terms must match)"
+
+// An inclusive-exclusive range of addresses
+type AddrRange struct {
+	Low, Hi uint64
+}
+
+func (r AddrRange) Contains(addr uint64) bool {
+	return r.Low <= addr && addr < r.Hi
+}
+
+// Parses "0x1000", "0x1000-0x2000" or "0x1000+64"
+func ParseAddrRange(s string) (AddrRange, error) {
+	parse := func(s string) (uint64, error) {
+		return strconv.ParseUint(s, 0, 64)
+	}
+	if i := strings.IndexAny(s, "-+"); i > 0 {
+		low, err := parse(s[:i])
+		if err != nil {
+			return AddrRange{}, fmt.Errorf("bad address %q", s[:i])
+		}
+		n, err := parse(s[i+1:])
+		if err != nil {
+			return AddrRange{}, fmt.Errorf("bad address %q", s[i+1:])
+		}
+		if s[i] == '+' {
+			return AddrRange{low, low + n}, nil
+		}
+		if n < low {
+			return AddrRange{}, fmt.Errorf("empty range %q", s)
+		}
+		return AddrRange{low, n}, nil
+	}
+	a, err := parse(s)
+	if err != nil {
+		return AddrRange{}, fmt.Errorf("bad address %q", s)
+	}
+	return AddrRange{a, a + 1}, nil
+}
+
+// The accesses a search is for. Zero values match anything.
+type SearchQuery struct {
+	Text string
+
+	Addrs    []AddrRange
+	Pcs      []AddrRange
+	Symbol   string
+	Function string
+	// Read or write only
+	Reads, Writes bool
+
+	// Whether the function at each pc matches Function, under each page
+	// table, since a pc may be another function once libraries are mapped
+	function_pcs map[RegionCacheKey]bool
+}
+
+// Parses a query such as "sym=grid w" or "addr=0x601040+8 func=main". A bare
+// number is an address and a bare name a symbol.
+func ParseSearchQuery(text string) (*SearchQuery, error) {
+	q := &SearchQuery{Text: text, function_pcs: make(map[RegionCacheKey]bool)}
+	words := strings.Fields(text)
+	if len(words) == 0 {
+		return nil, fmt.Errorf("empty search, try: %s", SEARCH_HELP)
+	}
+	for _, word := range words {
+		key, value := "", word
+		if i := strings.Index(word, "="); i >= 0 {
+			key, value = word[:i], word[i+1:]
+		}
+		if key == "" {
+			switch {
+			case word == "r" || word == "read":
+				key = "r"
+			case word == "w" || word == "write":
+				key = "w"
+			case word[0] >= '0' && word[0] <= '9':
+				key = "addr"
+			default:
+				key = "sym"
+			}
+		}
+
+		switch key {
+		case "addr", "a", "pc":
+			r, err := ParseAddrRange(value)
+			if err != nil {
+				return nil, err
+			}
+			if key == "pc" {
+				q.Pcs = append(q.Pcs, r)
+			} else {
+				q.Addrs = append(q.Addrs, r)
+			}
+		case "sym", "s", "var", "v":
+			q.Symbol = value
+		case "func", "f":
+			q.Function = value
+		case "r":
+			q.Reads = true
+		case "w":
+			q.Writes = true
+		default:
+			return nil, fmt.Errorf("bad search term %q, try: %s", word, SEARCH_HELP)
+		}
+	}
+	return q, nil
+}
+
+func anyContains(ranges []AddrRange, addr uint64) bool {
+	for _, r := range ranges {
+		if r.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether the access at record `index` matches the query. The cheap tests go
+// first, since every access of the trace goes through here.
+func (data *ProgramData) MatchAccess(q *SearchQuery, a *MemAccess, index int64) bool {
+	if q.Reads != q.Writes && (a.IsWrite == 1) != q.Writes {
+		return false
+	}
+	if len(q.Addrs) > 0 && !anyContains(q.Addrs, a.Addr) {
+		return false
+	}
+	if len(q.Pcs) > 0 && !anyContains(q.Pcs, a.Pc) {
+		return false
+	}
+	if q.Function != "" {
+		key := RegionCacheKey{a.Pc, data.tableAt(index)}
+		m, ok := q.function_pcs[key]
+		if !ok {
+			name := data.GetRegionAt(a.Pc, index).GetSymbol(a.Pc)
+			if i := strings.LastIndex(name, "+0x"); i >= 0 {
+				name = name[:i]
+			}
+			m = matchesFunction(name, q.Function)
+			q.function_pcs[key] = m
+		}
+		if !m {
+			return false
+		}
+	}
+	if q.Symbol != "" {
+		name, ok := data.GetVariable(a, index)
+		if !ok {
+			name, _, ok = data.GetDataSymbolAt(a.Addr, index)
+		}
+		if !ok || (VariableRoot(name) != q.Symbol && name != q.Symbol) {
+			return false
+		}
+	}
+	return true
+}
+
+// The name of the variable in a name from GetVariable, e.g. "grid" for
+// "grid[3][7].cost"
+func VariableRoot(name string) string {
+	for i, c := range name {
+		if c == '.' || c == '[' || c == '+' {
+			return name[:i]
+		}
+	}
+	return name
+}
+
+// Returns the indices of the records in `blocks` which match `q`, in order
+func (data *ProgramData) Search(blocks []*Block, q *SearchQuery) []int64 {
+	hits := []int64{}
+	for _, b := range blocks {
+		data.WithBlockRecords(b, func(records Records) {
+			for i := range records {
+				if len(hits) >= *max_hits {
+					return
+				}
+				r := &records[i]
+				index := b.first_record + int64(i)
+				if r.Type == MEMA_ACCESS && data.MatchAccess(q, r.MemAccess(), index) {
+					hits = append(hits, index)
+				}
+			}
+		})
+	}
+	return hits
+}
+
+// Returns the first hit after record `from` (before it, if `forward` is
+// false), wrapping around at the ends of the trace
+func NextHit(hits []int64, from int64, forward bool) (int64, bool) {
+	if len(hits) == 0 {
+		return 0, false
+	}
+	if forward {
+		i := sort.Search(len(hits), func(i int) bool { return hits[i] > from })
+		if i == len(hits) {
+			i = 0
+		}
+		return hits[i], true
+	}
+	i := sort.Search(len(hits), func(i int) bool { return hits[i] >= from }) - 1
+	if i < 0 {
+		i = len(hits) - 1
+	}
+	return hits[i], true
+}
+
+// Marks the hits in records [start_index, start_index+n) with ticks to the
+// left of the plot and faint lines across it
+func DrawHits(hits []int64, start_index, n int64) {
+	first := sort.Search(len(hits), func(i int) bool { return hits[i] >= start_index })
+	last := sort.Search(len(hits), func(i int) bool { return hits[i] >= start_index+n })
+	if first == last {
+		return
+	}
+	// Don't draw more than a few lines per pixel
+	_, h := glh.GetViewportWHD()
+	stride := (last - first) / int(4*h+1)
+	if stride < 1 {
+		stride = 1
+	}
+
+	glh.With(glh.Matrix{gl.MODELVIEW}, func() {
+		gl.Translated(0, -2, 0)
+		gl.Scaled(1, 4/float64(n), 1)
+		gl.Translated(0, -float64(start_index), 0)
+
+		glh.With(glh.Primitive{gl.LINES}, func() {
+			for j := first; j < last; j += stride {
+				y := float64(hits[j])
+				gl.Color4f(1, 0, 1, 1)
+				gl.Vertex2d(-2.25, y)
+				gl.Vertex2d(-2.12, y)
+				gl.Color4f(1, 0, 1, 0.2)
+				gl.Vertex2d(-2, y)
+				gl.Vertex2d(2, y)
+			}
+		})
+	})
+}
+
+// The "grep" action: prints the accesses matching `query` with the variable
+// or data symbol accessed and the source location of the access
+func (data *ProgramData) Grep(query string) {
+	q, err := ParseSearchQuery(query)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	locations := make(map[uint64]string)
+	n := 0
+	data.ForEachRecord(func(index int64, r *Record) {
+		if n >= *max_hits || r.Type != MEMA_ACCESS {
+			return
+		}
+		a := r.MemAccess()
+		if !data.MatchAccess(q, a, index) {
+			return
+		}
+		n++
+
+		kind := "r"
+		if a.IsWrite == 1 {
+			kind = "w"
+		}
+		what, ok := data.GetVariable(a, index)
+		if !ok {
+			if name, offset, ok := data.GetDataSymbolAt(a.Addr, index); ok {
+				what = fmt.Sprintf("%s+%d", name, offset)
+			} else {
+				what = data.GetRegionAt(a.Addr, index).pathname
+			}
+		}
+		loc, ok := locations[a.Pc]
+		if !ok {
+			loc = data.GetRegionAt(a.Pc, index).GetSymbol(a.Pc)
+			if locs := data.GetSourceLocationsAt(CallSite(a.Pc), index); len(locs) > 0 {
+				l := locs[0]
+				loc += fmt.Sprintf(" %s:%d", l.File, l.Line)
+			}
+			locations[a.Pc] = loc
+		}
+		fmt.Printf("#%-10d %s 0x%012x %-24s pc=0x%x %s\n", index, kind, a.Addr, what, a.Pc, loc)
+	})
+	if n >= *max_hits {
+		fmt.Printf("Stopped after %d matches (-max-hits)\n", n)
+	}
+}
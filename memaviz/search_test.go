@@ -0,0 +1,133 @@
+package main
+
+import (
+	"debug/elf"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestParseAddrRange(t *testing.T) {
+	tests := []struct {
+		text string
+		want AddrRange
+		ok   bool
+	}{
+		{"0x1000", AddrRange{0x1000, 0x1001}, true},
+		{"4096", AddrRange{4096, 4097}, true},
+		{"0x1000-0x2000", AddrRange{0x1000, 0x2000}, true},
+		{"0x1000+64", AddrRange{0x1000, 0x1040}, true},
+		{"0x2000-0x1000", AddrRange{}, false},
+		{"0x1000+", AddrRange{}, false},
+		{"-0x1000", AddrRange{}, false},
+		{"grid", AddrRange{}, false},
+	}
+	for _, test := range tests {
+		got, err := ParseAddrRange(test.text)
+		if (err == nil) != test.ok || got != test.want {
+			t.Errorf("ParseAddrRange(%q) = %v, %v, want %v, ok %v",
+				test.text, got, err, test.want, test.ok)
+		}
+	}
+}
+
+func TestParseSearchQuery(t *testing.T) {
+	tests := []struct {
+		text string
+		want SearchQuery
+	}{
+		{"addr=0x601040+8", SearchQuery{Addrs: []AddrRange{{0x601040, 0x601048}}}},
+		{"0x601040", SearchQuery{Addrs: []AddrRange{{0x601040, 0x601041}}}},
+		{"a=0x10 a=0x20-0x30", SearchQuery{Addrs: []AddrRange{{0x10, 0x11}, {0x20, 0x30}}}},
+		{"pc=0x400000+0x100", SearchQuery{Pcs: []AddrRange{{0x400000, 0x400100}}}},
+		{"sym=grid w", SearchQuery{Symbol: "grid", Writes: true}},
+		{"grid", SearchQuery{Symbol: "grid"}},
+		{"v=grid", SearchQuery{Symbol: "grid"}},
+		{"func=main read", SearchQuery{Function: "main", Reads: true}},
+		{"f=main r w", SearchQuery{Function: "main", Reads: true, Writes: true}},
+	}
+	for _, test := range tests {
+		q, err := ParseSearchQuery(test.text)
+		if err != nil {
+			t.Errorf("ParseSearchQuery(%q): %v", test.text, err)
+			continue
+		}
+		test.want.Text = test.text
+		test.want.function_pcs = q.function_pcs
+		if !reflect.DeepEqual(*q, test.want) {
+			t.Errorf("ParseSearchQuery(%q) = %+v, want %+v", test.text, *q, test.want)
+		}
+	}
+
+	for _, text := range []string{"", "  ", "addr=zz", "pc=0x20-0x10", "size=8"} {
+		if q, err := ParseSearchQuery(text); err == nil {
+			t.Errorf("ParseSearchQuery(%q) = %+v, want an error", text, *q)
+		}
+	}
+}
+
+func TestMatchAccessReadsWrites(t *testing.T) {
+	data := &ProgramData{}
+	read := &MemAccess{Addr: 0x10}
+	write := &MemAccess{Addr: 0x10, IsWrite: 1}
+
+	tests := []struct {
+		text          string
+		reads, writes bool
+	}{
+		{"0x10", true, true},
+		{"0x10 r", true, false},
+		{"0x10 w", false, true},
+		{"0x10 r w", true, true},
+		{"0x11", false, false},
+		{"0x8+8 w", false, false},
+		{"0x8+9 w", false, true},
+	}
+	for _, test := range tests {
+		q, err := ParseSearchQuery(test.text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := data.MatchAccess(q, read, 0); got != test.reads {
+			t.Errorf("%q matches a read: %v, want %v", test.text, got, test.reads)
+		}
+		if got := data.MatchAccess(q, write, 0); got != test.writes {
+			t.Errorf("%q matches a write: %v, want %v", test.text, got, test.writes)
+		}
+	}
+}
+
+func TestMatchAccessFunctionPerTable(t *testing.T) {
+	dir := testTraceDir(t)
+	defer os.RemoveAll(dir)
+
+	// The same pc is in f of one library, then in g of another mapped there
+	for _, b := range []*Binary{
+		{pathname: "/test/libf.so", funcsyms: []SymbolRange{{"f", 0x1000, 0x100}}},
+		{pathname: "/test/libg.so", funcsyms: []SymbolRange{{"g", 0x1000, 0x100}}},
+	} {
+		b.loads = []elf.ProgHeader{{Type: elf.PT_LOAD, Off: 0, Vaddr: 0, Memsz: 0x2000}}
+		addTestBinary(t, b)
+	}
+	access := accessRecord(0x10, 1)
+	access.MemAccess().Pc = 0x7f0000001010
+	block := func(library string) Records {
+		maps := MakeMapsRecords(1, "7f0000000000-7f0000002000 r-xp 00000000 00:00 0 "+library+"\n")
+		return append(append(Records{threadRecord(1)}, maps...), access)
+	}
+	data := writeTestTrace(t, dir, "in.mema", block("/test/libf.so"), block("/test/libg.so"))
+
+	q, err := ParseSearchQuery("func=f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	matches := []bool{}
+	data.ForEachRecord(func(index int64, r *Record) {
+		if r.Type == MEMA_ACCESS {
+			matches = append(matches, data.MatchAccess(q, r.MemAccess(), index))
+		}
+	})
+	if len(matches) != 2 || !matches[0] || matches[1] {
+		t.Errorf("func=f matches the accesses under each page table: %v, want [true false]", matches)
+	}
+}
@@ -0,0 +1,209 @@
+// selection.go: statistics for, and export of, the accesses in a rectangle
+//               dragged out on the plot
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/go-gl/gl"
+	"github.com/go-gl/glh"
+)
+
+// Entries shown in each ranking of the selection panel
+const SELECTION_TOP_N = 5
+
+// Records [Start, End), and the accesses among them drawn between X1 and X2
+// across the plot. Since each block lays out the pages it touches
+// differently, this isn't in general a single range of addresses.
+type Selection struct {
+	Start, End int64
+	X1, X2     float64
+}
+
+// Returns the selection with its corners in order, clipped to the plot
+func (s Selection) Normalised() Selection {
+	if s.End < s.Start {
+		s.Start, s.End = s.End, s.Start
+	}
+	if s.X2 < s.X1 {
+		s.X1, s.X2 = s.X2, s.X1
+	}
+	if s.X1 < -2 {
+		s.X1 = -2
+	}
+	if s.X2 > 2 {
+		s.X2 = 2
+	}
+	if s.Start < 0 {
+		s.Start = 0
+	}
+	return s
+}
+
+// Calls `fn` for each record records[j] of `blocks` in the selection's range of
+// records, with whether it is an access inside the rectangle
+func (data *ProgramData) ForEachInSelection(blocks []*Block, s Selection, fn func(b *Block, records Records, j int, selected bool)) {
+	for _, b := range blocks {
+		if b.first_record+b.nrecords <= s.Start || b.first_record >= s.End {
+			continue
+		}
+		data.WithBlockRecords(b, func(records Records) {
+			for j := range records {
+				index := b.first_record + int64(j)
+				if index < s.Start || index >= s.End {
+					continue
+				}
+				selected := false
+				if records[j].Type == MEMA_ACCESS {
+					x, ok := b.AccessX(records[j].MemAccess().Addr)
+					selected = ok && x >= s.X1 && x <= s.X2
+				}
+				fn(b, records, j, selected)
+			}
+		})
+	}
+}
+
+type SelectionStats struct {
+	Selection
+	AccessCounts
+	LowAddr, HiAddr    uint64
+	Lines, Pages       int
+	StartTime, EndTime float64
+	TopPcs, TopFuncs   HotEntries
+}
+
+// Works out the statistics of the accesses in the selection
+func (data *ProgramData) SelectionStats(blocks []*Block, s Selection) *SelectionStats {
+	stats := &SelectionStats{Selection: s}
+	lines := make(map[uint64]bool)
+	pages := make(map[uint64]bool)
+	pcs := make(map[uint64]*AccessCounts)
+
+	data.ForEachInSelection(blocks, s, func(b *Block, records Records, j int, selected bool) {
+		if !selected {
+			return
+		}
+		a := records[j].MemAccess()
+		if stats.Total() == 0 || a.Addr < stats.LowAddr {
+			stats.LowAddr = a.Addr
+		}
+		if a.Addr >= stats.HiAddr {
+			stats.HiAddr = a.Addr + 1
+		}
+		if stats.Total() == 0 || a.Time < stats.StartTime {
+			stats.StartTime = a.Time
+		}
+		if a.Time > stats.EndTime {
+			stats.EndTime = a.Time
+		}
+		stats.Add(a)
+		lines[a.Addr / *LINE_SIZE] = true
+		pages[a.Addr / *PAGE_SIZE] = true
+
+		c, ok := pcs[a.Pc]
+		if !ok {
+			c = &AccessCounts{}
+			pcs[a.Pc] = c
+		}
+		c.Add(a)
+		c.Last = b.first_record + int64(j)
+	})
+	stats.Lines, stats.Pages = len(lines), len(pages)
+
+	// Attribute the pcs to the functions containing them, keyed by where the
+	// function starts
+	funcs := make(map[uint64]*AccessCounts)
+	for pc, c := range pcs {
+		f := pc
+		if binary, link_pc, ok := data.GetRegionAt(pc, c.Last).BinaryAddress(pc); ok {
+			if sym, ok := binary.LookupFunction(link_pc); ok {
+				f = pc - (link_pc - sym.Value)
+			}
+		}
+		fc, ok := funcs[f]
+		if !ok {
+			fc = &AccessCounts{}
+			funcs[f] = fc
+		}
+		fc.Reads += c.Reads
+		fc.Writes += c.Writes
+		fc.Last = max(fc.Last, c.Last)
+	}
+
+	stats.TopPcs = RankCounts(pcs, SELECTION_TOP_N)
+	stats.TopFuncs = RankCounts(funcs, SELECTION_TOP_N)
+	return stats
+}
+
+// The text of the selection panel
+func (data *ProgramData) DescribeSelection(stats *SelectionStats) []string {
+	s := stats.Selection
+	text := []string{fmt.Sprintf("records %d-%d (%d)", s.Start, s.End, s.End-s.Start)}
+	if stats.Total() == 0 {
+		return append(text, "no accesses selected")
+	}
+	ratio := "no writes"
+	if stats.Writes != 0 {
+		ratio = fmt.Sprintf("%.2f reads per write", float64(stats.Reads)/float64(stats.Writes))
+	}
+	text = append(text,
+		// Not every address in between is selected
+		fmt.Sprintf("accesses from 0x%x to 0x%x, selected by where each block draws them",
+			stats.LowAddr, stats.HiAddr),
+		fmt.Sprintf("%d accesses: %d reads, %d writes, %s", stats.Total(),
+			stats.Reads, stats.Writes, ratio),
+		fmt.Sprintf("%d distinct lines, %d distinct pages", stats.Lines, stats.Pages),
+		fmt.Sprintf("%.6fs from %.6fs to %.6fs", stats.EndTime-stats.StartTime,
+			stats.StartTime, stats.EndTime))
+
+	text = append(text, "top pcs:")
+	for _, e := range stats.TopPcs {
+		text = append(text, fmt.Sprintf("  %8d  0x%x %s", e.Counts.Total(), e.Key, data.GetSymbolAt(e.Key, e.Counts.Last)))
+	}
+	text = append(text, "top functions:")
+	for _, e := range stats.TopFuncs {
+		name := data.GetSymbolAt(e.Key, e.Counts.Last)
+		if i := strings.LastIndex(name, "+0x"); i >= 0 {
+			name = name[:i]
+		}
+		text = append(text, fmt.Sprintf("  %8d  %s", e.Counts.Total(), name))
+	}
+	return text
+}
+
+// Writes the accesses in the selection to a new trace, along with the other
+// records in its range, as extract does with records=Start-End
+func (data *ProgramData) ExportSelection(blocks []*Block, s Selection, filename string) (int64, error) {
+	f := &ExtractFilter{Start: s.Start, End: s.End}
+	f.Keep = func(index int64, a *MemAccess) bool {
+		b := BlockOf(blocks, index)
+		if b == nil {
+			return false
+		}
+		x, ok := b.AccessX(a.Addr)
+		return ok && x >= s.X1 && x <= s.X2
+	}
+	return data.Extract(f, filename)
+}
+
+// Draws the outline of the selection in the view of records [start_index,
+// start_index+n)
+func (s Selection) Draw(start_index, n int64) {
+	glh.With(glh.Matrix{gl.MODELVIEW}, func() {
+		gl.Translated(0, -2, 0)
+		gl.Scaled(1, 4/float64(n), 1)
+		gl.Translated(0, -float64(start_index), 0)
+
+		gl.Color4f(0.3, 0.6, 1, 0.15)
+		glh.With(glh.Primitive{gl.QUADS}, func() {
+			glh.Squared(s.X1, float64(s.Start), s.X2-s.X1, float64(s.End-s.Start))
+		})
+		gl.Color4f(0.3, 0.6, 1, 1)
+		glh.With(glh.Primitive{gl.LINE_LOOP}, func() {
+			glh.Squared(s.X1, float64(s.Start), s.X2-s.X1, float64(s.End-s.Start))
+		})
+	})
+}
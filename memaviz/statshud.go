@@ -6,6 +6,7 @@ import (
 	"log"
 	"math"
 	"os"
+	"runtime"
 	"time"
 
 	"github.com/pwaller/go-hexcolor"
@@ -127,7 +128,7 @@ func InitStatsHUD() {
 
 	statistics := &Statistics{}
 	statistics.Add(&plots, "GPU Free", "#FF9F00", func() float64 { return gpufree })
-	statistics.Add(&plots, "SpareRAM()", "#ff0000", func() float64 { return float64(SpareRAM() * 1e6) })
+	statistics.Add(&plots, "Block cache", "#ff0000", func() float64 { return float64(block_cache.Used()) })
 	statistics.Add(&plots, "MaxRSS", "#FFE240", func() float64 { return float64(memhelper.GetMaxRSS()) })
 	statistics.Add(&plots, "Heap Idle", "#33ff33", func() float64 { return float64(memstats.HeapIdle) })
 	statistics.Add(&plots, "Alloc", "#FF6600", func() float64 { return float64(memstats.Alloc) })
@@ -143,6 +144,7 @@ func InitStatsHUD() {
 		i := -1
 		for {
 			time.Sleep(250 * time.Millisecond)
+			runtime.ReadMemStats(memstats)
 			max := statistics.Update()
 			if max > top {
 				top = max
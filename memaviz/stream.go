@@ -0,0 +1,189 @@
+// stream.go: sequential access to the records of a trace, without any of the
+//            machinery needed for drawing them, and writing new traces
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"log"
+	"os"
+
+	"github.com/pwaller/go-clz4"
+)
+
+// Reads and decompresses blocks one after another
+type BlockReader struct {
+	reader  io.Reader
+	input   []byte
+	round_1 []byte
+	output  []byte
+}
+
+func NewBlockReader(reader io.Reader) *BlockReader {
+	return &BlockReader{
+		reader:  reader,
+		input:   make([]byte, 0, 10*1024*1024),
+		round_1: make([]byte, 1, 10*1024*1024),
+		output:  make([]byte, 1, 10*1024*1024),
+	}
+}
+
+// Returns the compressed bytes of the next block, or nil at the end of the
+// file. The slice is only valid until the next call.
+func (br *BlockReader) NextRaw() []byte {
+	var block_size int64
+	err := binary.Read(br.reader, binary.LittleEndian, &block_size)
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		log.Panic("Error: ", err)
+	}
+
+	br.input = br.input[0:block_size]
+	n, err := io.ReadFull(br.reader, br.input)
+	if int64(n) != block_size {
+		log.Panicf("Err = %q, expected %d, got %d", err, block_size, n)
+	}
+	return br.input
+}
+
+// Returns the records of the next block, or nil at the end of the file. The
+// records are only valid until the next call.
+func (br *BlockReader) Next() Records {
+	input := br.NextRaw()
+	if input == nil {
+		return nil
+	}
+	br.output = br.output[:cap(br.output)]
+	clz4.UncompressUnknownOutputSize(input, &br.round_1)
+	clz4.UncompressUnknownOutputSize(br.round_1, &br.output)
+
+	var records Records
+	if len(br.output) > 0 {
+		records.FromBytes(br.output)
+	}
+	return records
+}
+
+// Opens the trace file positioned at the first block
+func (data *ProgramData) OpenBlocks() *os.File {
+	fd, err := os.Open(data.filename)
+	if err != nil {
+		log.Panic("Fatal error: ", err)
+	}
+	_, err = fd.Seek(data.blocks_offset, 0)
+	if err != nil {
+		log.Panic(err)
+	}
+	return fd
+}
+
+// Calls `fn` for every record in the trace, in order. `index` is the record
+// index as used by the viewer. The record is only valid during the call.
+// With -pid, the blocks of other processes are skipped.
+func (data *ProgramData) ForEachRecord(fn func(index int64, r *Record)) {
+	fd := data.OpenBlocks()
+	defer fd.Close()
+
+	br := NewBlockReader(fd)
+	for block := int64(0); ; block++ {
+		records := br.Next()
+		for records != nil && !WantBlock(records) {
+			records = br.Next()
+		}
+		if records == nil {
+			break
+		}
+		data.ScanMapsEvents(block*RECORDS_PER_BLOCK, records)
+		for i := range records {
+			fn(block*RECORDS_PER_BLOCK+int64(i), &records[i])
+		}
+		if *verbose {
+			log.Printf("Processed block %d", block)
+		}
+	}
+}
+
+// Compresses and writes blocks in the format read by BlockReader, as the
+// runtime does: the records compressed twice with LZ4, preceded by the size
+// of the result
+type BlockWriter struct {
+	writer  io.Writer
+	round_1 []byte
+	output  []byte
+}
+
+func NewBlockWriter(writer io.Writer) *BlockWriter {
+	return &BlockWriter{writer: writer}
+}
+
+// Compresses `input` into `output`, growing it if needed
+func compressBlock(input, output []byte) ([]byte, error) {
+	if bound := clz4.CompressBound(input); cap(output) < bound {
+		output = make([]byte, bound)
+	}
+	n, err := clz4.Compress(input, output[:cap(output)])
+	if err != nil {
+		return output, err
+	}
+	return output[:n], nil
+}
+
+func (bw *BlockWriter) Write(records Records) error {
+	if len(records) == 0 {
+		return nil
+	}
+	var err error
+	bw.round_1, err = compressBlock(*records.AsBytes(), bw.round_1)
+	if err != nil {
+		return err
+	}
+	bw.output, err = compressBlock(bw.round_1, bw.output)
+	if err != nil {
+		return err
+	}
+	err = binary.Write(bw.writer, binary.LittleEndian, int64(len(bw.output)))
+	if err != nil {
+		return err
+	}
+	_, err = bw.writer.Write(bw.output)
+	return err
+}
+
+// Writes a new trace file
+type TraceWriter struct {
+	fd     *os.File
+	writer *bufio.Writer
+	*BlockWriter
+}
+
+// Creates a trace of format `version` whose page table at the start of the run
+// is `regions`. Blocks must then be written, each beginning with its
+// MEMA_THREAD record.
+func CreateTrace(filename string, version int, regions []MemRegion) (*TraceWriter, error) {
+	fd, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	writer := bufio.NewWriterSize(fd, 1024*1024)
+	tw := &TraceWriter{fd, writer, NewBlockWriter(writer)}
+
+	writer.WriteString(TRACE_MAGIC[version-1])
+	writer.WriteString(FormatMaps(regions))
+	if err := writer.WriteByte(0); err != nil {
+		tw.Close()
+		return nil, err
+	}
+	return tw, nil
+}
+
+func (tw *TraceWriter) Close() error {
+	err := tw.writer.Flush()
+	if err2 := tw.fd.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
@@ -0,0 +1,194 @@
+// symcache.go: an on-disk cache of the symbol, line and scope tables of
+//              binaries, so that their DWARF doesn't have to be read again
+//              every session
+
+package main
+
+import (
+	"compress/gzip"
+	"crypto/sha1"
+	"encoding/gob"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+var symbol_cache = flag.String("symbol-cache", "",
+	"directory for cached symbol tables (default ~/.cache/memaviz, 'off' to disable)")
+
+// Bump when the contents of SymbolCache change
+const SYMBOL_CACHE_VERSION = 2
+
+type CachedLineRow struct {
+	Address      uint64
+	File         uint32
+	Line, Column uint32
+	End          bool
+}
+
+type SymbolCache struct {
+	// The debug file the tables were read from. The cache is stale if that
+	// changes, e.g. because debug info has been installed since.
+	DebugFile string
+
+	FuncSyms, DataSyms []SymbolRange
+
+	// Line rows refer to file names by their index into Files
+	Files     []string
+	Lines     []CachedLineRow
+	UnitFiles [][]string
+
+	// Filled in once something has needed the scopes (see IndexScopes)
+	HaveScopes  bool
+	Scopes      []DwarfScope
+	ScopeRanges []Interval
+	Variables   []DwarfVariable
+}
+
+func SymbolCacheDir() string {
+	switch *symbol_cache {
+	case "off":
+		return ""
+	case "":
+		dir, err := os.UserCacheDir()
+		if err != nil {
+			return ""
+		}
+		return filepath.Join(dir, "memaviz")
+	}
+	return *symbol_cache
+}
+
+// Returns the name of the cache file for the binary, keyed by its build ID or,
+// failing that, a hash of its contents
+func (b *Binary) SymbolCacheFilename() string {
+	dir := SymbolCacheDir()
+	if dir == "" {
+		return ""
+	}
+	key := b.build_id
+	if key == "" {
+		fd, err := os.Open(b.pathname)
+		if err != nil {
+			return ""
+		}
+		defer fd.Close()
+		h := sha1.New()
+		if _, err := io.Copy(h, fd); err != nil {
+			return ""
+		}
+		key = "sha1-" + hex.EncodeToString(h.Sum(nil))
+	}
+	return filepath.Join(dir,
+		fmt.Sprintf("%s-%s.v%d", filepath.Base(b.pathname), key, SYMBOL_CACHE_VERSION))
+}
+
+// Fills in the symbol and line tables, and the scopes if they were indexed,
+// from the cache, returning false if they aren't cached
+func (b *Binary) LoadSymbolCache() bool {
+	filename := b.SymbolCacheFilename()
+	if filename == "" {
+		return false
+	}
+	fd, err := os.Open(filename)
+	if err != nil {
+		return false
+	}
+	defer fd.Close()
+
+	var cache SymbolCache
+	r, err := gzip.NewReader(fd)
+	if err == nil {
+		err = gob.NewDecoder(r).Decode(&cache)
+	}
+	if err != nil {
+		log.Printf("Ignoring bad symbol cache %s: %v", filename, err)
+		return false
+	}
+	if cache.DebugFile != b.debug_filename {
+		return false
+	}
+
+	b.funcsyms, b.datasyms = cache.FuncSyms, cache.DataSyms
+	b.dwarf_files = cache.UnitFiles
+	b.lines = make([]LineRow, len(cache.Lines))
+	for i, l := range cache.Lines {
+		b.lines[i] = LineRow{l.Address, cache.Files[l.File], int(l.Line), int(l.Column), l.End}
+	}
+	if cache.HaveScopes {
+		b.scopes_once.Do(func() {
+			b.dwarf_scopes, b.variables = cache.Scopes, cache.Variables
+			b.dwarf_tree = NewIntervalTree(cache.ScopeRanges)
+		})
+	}
+	if *verbose {
+		log.Printf("Loaded symbols for %s from %s", b.pathname, filename)
+	}
+	return true
+}
+
+// Writes the cache, including the scopes if they have been indexed
+func (b *Binary) SaveSymbolCache() {
+	filename := b.SymbolCacheFilename()
+	if filename == "" {
+		return
+	}
+
+	cache := SymbolCache{
+		DebugFile: b.debug_filename,
+		FuncSyms:  b.funcsyms,
+		DataSyms:  b.datasyms,
+		UnitFiles: b.dwarf_files,
+		Lines:     make([]CachedLineRow, len(b.lines)),
+	}
+	file_index := make(map[string]uint32)
+	for i, l := range b.lines {
+		f, ok := file_index[l.File]
+		if !ok {
+			f = uint32(len(cache.Files))
+			file_index[l.File] = f
+			cache.Files = append(cache.Files, l.File)
+		}
+		cache.Lines[i] = CachedLineRow{l.Address, f, uint32(l.Line), uint32(l.Column), l.End}
+	}
+	if b.dwarf_tree != nil {
+		cache.HaveScopes = true
+		cache.Scopes = b.dwarf_scopes
+		cache.ScopeRanges = b.dwarf_tree.Intervals()
+		cache.Variables = b.variables
+	}
+
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		log.Printf("Can't create symbol cache: %v", err)
+		return
+	}
+	// Write to a temporary file first so that a concurrent reader never sees
+	// a partial cache
+	fd, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".tmp")
+	if err != nil {
+		log.Printf("Can't create symbol cache: %v", err)
+		return
+	}
+	w := gzip.NewWriter(fd)
+	err = gob.NewEncoder(w).Encode(&cache)
+	if err == nil {
+		err = w.Close()
+	}
+	if err == nil {
+		err = fd.Close()
+	} else {
+		fd.Close()
+	}
+	if err == nil {
+		err = os.Rename(fd.Name(), filename)
+	}
+	if err != nil {
+		log.Printf("Can't write symbol cache %s: %v", filename, err)
+		os.Remove(fd.Name())
+	}
+}
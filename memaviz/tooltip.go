@@ -0,0 +1,192 @@
+// tooltip.go: details of the access under the mouse, shown next to it when it
+//             rests over the plot
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/go-gl/gl"
+	"github.com/go-gl/glh"
+)
+
+const (
+	// How long the mouse must rest before the tooltip is worked out
+	TOOLTIP_DELAY = 150 * time.Millisecond
+	// How many blocks either side of an access are searched for the previous
+	// and next access to its address, since each one has to be read from disk
+	TOOLTIP_SEARCH_BLOCKS = 2
+	// Innermost calls of the stack shown
+	TOOLTIP_STACK_DEPTH = 4
+)
+
+type Tooltip struct {
+	Index  int64
+	Access MemAccess
+	// Where the access is drawn, in the co-ordinates of the plot
+	X     float64
+	Lines []string
+	// The previous and next accesses to the same address, or -1
+	Prev, Next int64
+}
+
+// Returns the access drawn nearest to (px, rec), and no further than
+// `tolerance` records from it, with the x distance scaled as if
+// `records_per_unit` records spanned one unit of x
+func (data *ProgramData) NearestAccess(blocks []*Block, px float64, rec, tolerance int64, records_per_unit float64) (int64, MemAccess, float64, bool) {
+	best, best_distance := int64(-1), float64(tolerance*tolerance)
+	var best_access MemAccess
+	var best_x float64
+
+	// The window may cross into the block either side
+	first, last := (rec-tolerance)/RECORDS_PER_BLOCK, (rec+tolerance)/RECORDS_PER_BLOCK
+	for bi := first; bi <= last; bi++ {
+		b := BlockOf(blocks, bi*RECORDS_PER_BLOCK)
+		if b == nil || b.quiet_pages == nil {
+			continue
+		}
+		data.WithBlockRecords(b, func(records Records) {
+			from, to := rec-tolerance-b.first_record, rec+tolerance-b.first_record
+			if from < 0 {
+				from = 0
+			}
+			if to > int64(len(records)) {
+				to = int64(len(records))
+			}
+			for j := from; j < to; j++ {
+				r := &records[j]
+				if r.Type != MEMA_ACCESS {
+					continue
+				}
+				a := r.MemAccess()
+				x, ok := b.AccessX(a.Addr)
+				if !ok {
+					continue
+				}
+				dx := (x - px) * records_per_unit
+				dy := float64(b.first_record + j - rec)
+				if d := dx*dx + dy*dy; d <= best_distance {
+					best, best_distance = b.first_record+j, d
+					best_access, best_x = *a, x
+				}
+			}
+		})
+	}
+	return best, best_access, best_x, best >= 0
+}
+
+// Returns the previous (or next, if `forward`) access to `addr` from record
+// `from`, looking through at most TOOLTIP_SEARCH_BLOCKS blocks past its own
+func (data *ProgramData) FindAccessTo(blocks []*Block, addr uint64, from int64, forward bool) (int64, bool) {
+	first := from / RECORDS_PER_BLOCK
+	result := int64(-1)
+	for k := int64(0); k <= TOOLTIP_SEARCH_BLOCKS && result < 0; k++ {
+		bi := first + k
+		if !forward {
+			bi = first - k
+		}
+		if bi < 0 || bi >= int64(len(blocks)) {
+			break
+		}
+		b := blocks[bi]
+		data.WithBlockRecords(b, func(records Records) {
+			for n := range records {
+				j := n
+				if !forward {
+					j = len(records) - 1 - n
+				}
+				index := b.first_record + int64(j)
+				if (forward && index <= from) || (!forward && index >= from) {
+					continue
+				}
+				r := &records[j]
+				if r.Type == MEMA_ACCESS && r.MemAccess().Addr == addr {
+					result = index
+					return
+				}
+			}
+		})
+	}
+	return result, result >= 0
+}
+
+// Works out the tooltip for access `a` at record `index` of `blocks`
+func (data *ProgramData) MakeTooltip(blocks []*Block, index int64, a MemAccess, x float64) *Tooltip {
+	t := &Tooltip{Index: index, Access: a, X: x, Prev: -1, Next: -1}
+
+	kind := "read"
+	if a.IsWrite == 1 {
+		kind = "write"
+	}
+	if size, ok := data.AccessSize(&a); ok {
+		kind += fmt.Sprintf(" of %d bytes", size)
+	}
+	t.Lines = append(t.Lines, fmt.Sprintf("#%d %s 0x%x at %.6fs", index, kind, a.Addr, a.Time))
+	if pid := data.ProcessAt(index); pid != 0 {
+		t.Lines[0] += fmt.Sprintf(" in process %d", pid)
+	}
+
+	region := data.GetRegionAt(a.Addr, index)
+	what := fmt.Sprintf("%s %s", region, region.perms)
+	if name, ok := data.GetVariable(&a, index); ok {
+		what = name + " in " + what
+	} else if name, offset, ok := data.GetDataSymbolAt(a.Addr, index); ok {
+		what = fmt.Sprintf("%s+%d in %s", name, offset, what)
+	}
+	t.Lines = append(t.Lines, what)
+
+	pc := fmt.Sprintf("pc 0x%x %s", a.Pc, data.GetRegionAt(a.Pc, index).GetSymbol(a.Pc))
+	if locs := data.GetSourceLocationsAt(CallSite(a.Pc), index); len(locs) > 0 {
+		pc += fmt.Sprintf(" %s:%d", locs[0].File, locs[0].Line)
+	}
+	t.Lines = append(t.Lines, pc)
+
+	stack := data.GetStackNames(blocks, index)
+	for j := len(stack) - 1; j >= 0 && j >= len(stack)-TOOLTIP_STACK_DEPTH; j-- {
+		t.Lines = append(t.Lines, "  in "+stack[j])
+	}
+
+	links := ""
+	if prev, ok := data.FindAccessTo(blocks, a.Addr, index, false); ok {
+		t.Prev = prev
+		links += fmt.Sprintf("  , previous #%d", prev)
+	}
+	if next, ok := data.FindAccessTo(blocks, a.Addr, index, true); ok {
+		t.Next = next
+		links += fmt.Sprintf("  . next #%d", next)
+	}
+	if links == "" {
+		links = "  no other access to it nearby"
+	}
+	t.Lines = append(t.Lines, links)
+	return t
+}
+
+// Marks the access of tooltip `t` in the view of records [start_index,
+// start_index+n)
+func (t *Tooltip) DrawMarker(start_index, n int64) {
+	glh.With(glh.Matrix{gl.MODELVIEW}, func() {
+		gl.Translated(0, -2, 0)
+		gl.Scaled(1, 4/float64(n), 1)
+		gl.Translated(0, -float64(start_index), 0)
+
+		gl.PointSize(6)
+		glh.With(glh.Primitive{gl.POINTS}, func() {
+			gl.Color4f(1, 1, 0, 1)
+			gl.Vertex2d(t.X, float64(t.Index))
+		})
+	})
+}
+
+// Works out the tooltip for record `index`, if it is an access
+func (data *ProgramData) TooltipAt(blocks []*Block, index int64) (*Tooltip, bool) {
+	b := BlockOf(blocks, index)
+	r := data.GetRecord(blocks, index)
+	if b == nil || r == nil || r.Type != MEMA_ACCESS {
+		return nil, false
+	}
+	a := r.MemAccess()
+	x, _ := b.AccessX(a.Addr)
+	return data.MakeTooltip(blocks, index, *a, x), true
+}
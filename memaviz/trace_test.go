@@ -0,0 +1,61 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func threadRecord(tid uint64) Record {
+	r := Record{Type: MEMA_THREAD}
+	r.ThreadMarker().Tid = tid
+	return r
+}
+
+func callRecord(kind int64, f uint64) Record {
+	r := Record{Type: kind}
+	r.FunctionCall().FuncPointer = f
+	return r
+}
+
+func accessRecord(addr uint64, time float64) Record {
+	r := Record{Type: MEMA_ACCESS}
+	*r.MemAccess() = MemAccess{Time: time, Addr: addr}
+	return r
+}
+
+func heapRecord(kind int64, addr, size uint64) Record {
+	r := Record{Type: kind}
+	*r.HeapEvent() = HeapEvent{Addr: addr, Size: size}
+	return r
+}
+
+// A directory for the traces of a test, which the test removes
+func testTraceDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "memaviz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// Writes a trace with an empty page table and the blocks `blocks`, each of
+// which begins with its MEMA_THREAD record, and opens it
+func writeTestTrace(t *testing.T, dir, name string, blocks ...Records) *ProgramData {
+	filename := filepath.Join(dir, name)
+	tw, err := CreateTrace(filename, len(TRACE_MAGIC), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range blocks {
+		if err := tw.Write(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data, fd := OpenProgramData(filename)
+	fd.Close()
+	return data
+}
@@ -8,7 +8,6 @@ import (
 	"reflect"
 	"runtime"
 	"sort"
-	"time"
 
 	"github.com/go-gl/gl"
 )
@@ -29,6 +28,13 @@ func (p UInt64Slice) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
 // Sort is a convenience method.
 func (p UInt64Slice) Sort() { sort.Sort(p) }
 
+type Int64Slice []int64
+
+func (p Int64Slice) Len() int           { return len(p) }
+func (p Int64Slice) Less(i, j int) bool { return p[i] < p[j] }
+func (p Int64Slice) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func (p Int64Slice) Sort()              { sort.Sort(p) }
+
 func min(a, b int64) int64 {
 	if b < a {
 		return b
@@ -36,6 +42,13 @@ func min(a, b int64) int64 {
 	return a
 }
 
+func max(a, b int64) int64 {
+	if b > a {
+		return b
+	}
+	return a
+}
+
 func Capture() {
 	// TODO: co-ordinates, filename, cleverness to stitch many together
 	im := image.NewNRGBA(image.Rect(0, 0, 400, 400))
@@ -113,45 +126,6 @@ func SystemFree() int64 {
 	return free + cached
 }
 
-// Returns the number of spare megabytes of ram after leaving 100 + 10% spare
-func SpareRAM() int64 {
-	const GRACE_ABS = 100 // MB
-	const GRACE_REL = 20  // %
-
-	runtime.ReadMemStats(memstats)
-
-	total, free, _, cached := meminfo()
-
-	/*
-		si := &syscall.Sysinfo_t{}
-		err := syscall.Sysinfo(si)
-		if err != nil {
-			return -999913379999
-		}
-	*/
-	grace := int64(GRACE_REL*total/100 + GRACE_ABS)
-	/*
-		free := int64(si.Freeram + si.Bufferram)
-		log.Print("Free: ", free/1024/1024, " grace: ", grace/1024/1024, " freeram: ", si.Freeram/1024/1024, "bufram: ", si.Bufferram/1024/1024)
-		log.Printf("%+v", si)
-	*/
-
-	allocated_but_unused := int64(memstats.HeapIdle)
-
-	//log.Print("Grace: ", grace, " free: ", free)
-	return (free + cached - grace + allocated_but_unused) / 1024 / 1024
-}
-
-func BlockUnlessSpareRAM(needed_mb int64) {
-	for {
-		spare := SpareRAM()
-		if spare >= needed_mb {
-			break
-		}
-		time.Sleep(100 * time.Microsecond)
-	}
-}
-
 func ints(low, n int64) <-chan int64 {
 	result := make(chan int64)
 	go func() {
@@ -162,11 +136,3 @@ func ints(low, n int64) <-chan int64 {
 	}()
 	return result
 }
-
-func GCStats() {
-	memstats := new(runtime.MemStats)
-	runtime.ReadMemStats(memstats)
-	log.Printf("  -- paused for %v -- total %v -- N %d",
-		time.Duration(memstats.PauseNs[(memstats.NumGC-1)%256]),
-		time.Duration(memstats.PauseTotalNs), memstats.NumGC)
-}
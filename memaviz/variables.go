@@ -0,0 +1,411 @@
+// variables.go: naming the variable (and the field or element within it) which
+//               a memory access touched, from the DWARF variables and types
+
+package main
+
+import (
+	"debug/dwarf"
+	"flag"
+	"fmt"
+	"regexp"
+	"sort"
+)
+
+var variable_group = flag.String("group", "variable",
+	"how the 'vars' action groups accesses: 'variable', 'field' (array indices "+
+		"merged) or 'element'")
+
+// DWARF location expression opcodes which we understand
+const (
+	DW_OP_addr           = 0x03
+	DW_OP_reg6           = 0x56
+	DW_OP_reg7           = 0x57
+	DW_OP_breg6          = 0x76
+	DW_OP_breg7          = 0x77
+	DW_OP_fbreg          = 0x91
+	DW_OP_call_frame_cfa = 0x9c
+)
+
+// A variable with a fixed address (global, or static local). The type is
+// read when it's needed (see Binary.VariableType).
+type DwarfVariable struct {
+	Name       string
+	Addr, Size uint64
+	TypeOffset dwarf.Offset
+}
+
+type DwarfVariablesByAddr []DwarfVariable
+
+func (p DwarfVariablesByAddr) Len() int           { return len(p) }
+func (p DwarfVariablesByAddr) Less(i, j int) bool { return p[i].Addr < p[j].Addr }
+func (p DwarfVariablesByAddr) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// A local variable or parameter which lives at a fixed offset from its
+// function's frame base
+type LocalVariable struct {
+	Name   string
+	Offset int64
+	Type   dwarf.Type
+}
+
+// The locals visible at some pc, and how to find the frame base
+type FrameLayout struct {
+	// Register (DW_OP_reg6 for the frame pointer, DW_OP_reg7 for the stack
+	// pointer) and offset from it of the frame base, or DW_OP_call_frame_cfa
+	BaseReg    byte
+	BaseOffset int64
+	Locals     []LocalVariable
+}
+
+func readSLEB128(b []byte) (int64, []byte) {
+	var result int64
+	var shift uint
+	for i, c := range b {
+		result |= int64(c&0x7f) << shift
+		shift += 7
+		if c&0x80 == 0 {
+			if shift < 64 && c&0x40 != 0 {
+				result |= -1 << shift
+			}
+			return result, b[i+1:]
+		}
+	}
+	return result, nil
+}
+
+// Returns the type of a variable, following its specification or abstract
+// origin if it doesn't have one itself
+func (b *Binary) entryType(e *dwarf.Entry) (dwarf.Type, bool) {
+	off, ok := b.entryTypeOffset(e)
+	if !ok {
+		return nil, false
+	}
+	t, err := b.dwarf.Type(off)
+	return t, err == nil
+}
+
+func (b *Binary) entryTypeOffset(e *dwarf.Entry) (dwarf.Offset, bool) {
+	for i := 0; i < 8 && e != nil; i++ {
+		if off, ok := e.Val(dwarf.AttrType).(dwarf.Offset); ok {
+			return off, true
+		}
+		next, ok := e.Val(dwarf.AttrSpecification).(dwarf.Offset)
+		if !ok {
+			next, ok = e.Val(dwarf.AttrAbstractOrigin).(dwarf.Offset)
+		}
+		if !ok {
+			break
+		}
+		r := b.dwarf.Reader()
+		r.Seek(next)
+		e, _ = r.Next()
+	}
+	return 0, false
+}
+
+// Records `e` in b.variables if it is a variable at a fixed address
+func (b *Binary) indexVariable(e *dwarf.Entry) {
+	loc, ok := e.Val(dwarf.AttrLocation).([]byte)
+	if !ok || len(loc) != 9 || loc[0] != DW_OP_addr {
+		return
+	}
+	addr := b.elf.ByteOrder.Uint64(loc[1:])
+	off, ok := b.entryTypeOffset(e)
+	if !ok {
+		return
+	}
+	t, err := b.dwarf.Type(off)
+	if err != nil || t.Size() <= 0 {
+		return
+	}
+	b.variables = append(b.variables,
+		DwarfVariable{b.EntryName(e), addr, uint64(t.Size()), off})
+}
+
+// Reads the type of `v`
+func (b *Binary) VariableType(v *DwarfVariable) (dwarf.Type, bool) {
+	dw := b.Dwarf()
+	if dw == nil {
+		return nil, false
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	t, err := dw.Type(v.TypeOffset)
+	return t, err == nil
+}
+
+// Returns the variable with a fixed address containing link-time address
+// `addr`
+func (b *Binary) LookupVariable(addr uint64) (*DwarfVariable, bool) {
+	b.IndexScopes()
+	i := sort.Search(len(b.variables), func(i int) bool {
+		return b.variables[i].Addr > addr
+	}) - 1
+	if i < 0 || addr-b.variables[i].Addr >= b.variables[i].Size {
+		return nil, false
+	}
+	return &b.variables[i], true
+}
+
+// Returns the locals of the function executing at link-time address `pc`,
+// including those of the blocks and inlined calls which contain `pc`
+func (b *Binary) FrameAt(pc uint64) (*FrameLayout, bool) {
+	scopes := b.ScopesAt(pc)
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if layout, ok := b.frames[pc]; ok {
+		return layout, layout != nil
+	}
+	layout := b.frameAt(scopes)
+	b.frames[pc] = layout
+	return layout, layout != nil
+}
+
+func (b *Binary) frameAt(scopes []*DwarfScope) *FrameLayout {
+	first := -1
+	for i := len(scopes) - 1; i >= 0; i-- {
+		if scopes[i].Tag == dwarf.TagSubprogram {
+			first = i
+			break
+		}
+	}
+	if first < 0 {
+		return nil
+	}
+	entries := make([]*dwarf.Entry, len(scopes)-first)
+	for i, s := range scopes[first:] {
+		if entries[i] = b.ScopeEntry(s); entries[i] == nil {
+			return nil
+		}
+	}
+
+	layout := &FrameLayout{}
+	base, ok := entries[0].Val(dwarf.AttrFrameBase).([]byte)
+	if !ok || len(base) == 0 {
+		return nil
+	}
+	switch base[0] {
+	case DW_OP_call_frame_cfa, DW_OP_reg6, DW_OP_reg7:
+		layout.BaseReg = base[0]
+	case DW_OP_breg6, DW_OP_breg7:
+		layout.BaseReg = base[0] - DW_OP_breg6 + DW_OP_reg6
+		layout.BaseOffset, _ = readSLEB128(base[1:])
+	default:
+		return nil
+	}
+
+	for _, e := range entries {
+		b.scopeLocals(e, layout)
+	}
+	return layout
+}
+
+// Appends the direct children of `scope` which live at a fixed offset from
+// the frame base
+func (b *Binary) scopeLocals(scope *dwarf.Entry, layout *FrameLayout) {
+	if !scope.Children {
+		return
+	}
+	r := b.dwarf.Reader()
+	r.Seek(scope.Offset)
+	r.Next()
+	for {
+		e, err := r.Next()
+		if err != nil || e == nil || e.Tag == 0 {
+			return
+		}
+		if e.Children {
+			r.SkipChildren()
+		}
+		if e.Tag != dwarf.TagVariable && e.Tag != dwarf.TagFormalParameter {
+			continue
+		}
+		loc, ok := e.Val(dwarf.AttrLocation).([]byte)
+		if !ok || len(loc) < 2 || loc[0] != DW_OP_fbreg {
+			// Location lists and registers aren't supported
+			continue
+		}
+		offset, rest := readSLEB128(loc[1:])
+		if len(rest) != 0 {
+			continue
+		}
+		t, ok := b.entryType(e)
+		if !ok || t.Size() <= 0 {
+			continue
+		}
+		layout.Locals = append(layout.Locals,
+			LocalVariable{b.EntryName(e), offset, t})
+	}
+}
+
+// Returns the frame base for an access made with the frame layout `l`
+func (l *FrameLayout) Base(a *MemAccess) uint64 {
+	switch l.BaseReg {
+	case DW_OP_call_frame_cfa:
+		// The saved frame pointer and the return address sit between the
+		// frame pointer and the canonical frame address. Like Bp itself, this
+		// needs the function to keep a frame pointer
+		// (-fno-omit-frame-pointer).
+		return a.Bp + 16
+	case DW_OP_reg6:
+		return a.Bp + uint64(l.BaseOffset)
+	default:
+		return a.Sp + uint64(l.BaseOffset)
+	}
+}
+
+// Describes the part of a value of type `t` at byte `offset`, such as "[3][7].cost"
+func DescribeOffset(t dwarf.Type, offset uint64) string {
+	path := ""
+	for t != nil {
+		switch tt := t.(type) {
+		case *dwarf.TypedefType:
+			t = tt.Type
+			continue
+		case *dwarf.QualType:
+			t = tt.Type
+			continue
+		case *dwarf.StructType:
+			var field *dwarf.StructField
+			for _, f := range tt.Field {
+				size := f.Type.Size()
+				if f.ByteOffset >= 0 && uint64(f.ByteOffset) <= offset &&
+					offset-uint64(f.ByteOffset) < uint64(size) {
+					field = f
+					break
+				}
+			}
+			if field == nil {
+				t = nil
+				continue
+			}
+			if field.Name != "" {
+				path += "." + field.Name
+			}
+			offset -= uint64(field.ByteOffset)
+			t = field.Type
+			continue
+		case *dwarf.ArrayType:
+			size := tt.Type.Size()
+			if size <= 0 {
+				t = nil
+				continue
+			}
+			path += fmt.Sprintf("[%d]", offset/uint64(size))
+			offset %= uint64(size)
+			t = tt.Type
+			continue
+		}
+		t = nil
+	}
+	if offset != 0 {
+		path += fmt.Sprintf("+%d", offset)
+	}
+	return path
+}
+
+// Names the variable, and the field or element within it, which `a` accessed
+// (e.g. "grid[3][7].cost"), from globals and then the locals of the
+// accessing function. `index` is the record index of `a`, or -1.
+func (data *ProgramData) GetVariable(a *MemAccess, index int64) (string, bool) {
+	r, file_offset := data.GetOwningRegionAt(a.Addr, index)
+	if binary := r.GetBinary(); binary != nil {
+		if link_addr, ok := binary.LinkAddress(file_offset); ok {
+			if v, ok := binary.LookupVariable(link_addr); ok {
+				t, _ := binary.VariableType(v)
+				return v.Name + DescribeOffset(t, link_addr-v.Addr), true
+			}
+		}
+	}
+
+	if data.version < 2 {
+		// Bp and Sp are the runtime's own frame
+		return "", false
+	}
+	pc := CallSite(a.Pc)
+	binary, link_pc, ok := data.GetRegionAt(pc, index).BinaryAddress(pc)
+	if !ok || !binary.has_dwarf {
+		return "", false
+	}
+	layout, ok := binary.FrameAt(link_pc)
+	if !ok {
+		return "", false
+	}
+	base := layout.Base(a)
+	for _, v := range layout.Locals {
+		start := base + uint64(v.Offset)
+		if start <= a.Addr && a.Addr-start < uint64(v.Type.Size()) {
+			return v.Name + DescribeOffset(v.Type, a.Addr-start), true
+		}
+	}
+	return "", false
+}
+
+var array_index = regexp.MustCompile(`\[\d+\]`)
+
+// The key under which the "vars" action counts an access to `name`
+func VariableGroup(name string) string {
+	switch *variable_group {
+	case "element":
+		return name
+	case "field":
+		return array_index.ReplaceAllString(name, "[]")
+	}
+	return VariableRoot(name)
+}
+
+type VariableEntry struct {
+	Name   string
+	Counts *AccessCounts
+}
+
+type VariableEntries []VariableEntry
+
+func (p VariableEntries) Len() int { return len(p) }
+func (p VariableEntries) Less(i, j int) bool {
+	return p[i].Counts.Total() > p[j].Counts.Total()
+}
+func (p VariableEntries) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+
+// The "vars" action
+func (data *ProgramData) Variables() {
+	counts := make(map[string]*AccessCounts)
+	var total, unknown AccessCounts
+	data.ForEachRecord(func(index int64, r *Record) {
+		if r.Type != MEMA_ACCESS {
+			return
+		}
+		a := r.MemAccess()
+		total.Add(a)
+		name, ok := data.GetVariable(a, index)
+		if !ok {
+			unknown.Add(a)
+			return
+		}
+		key := VariableGroup(name)
+		c, ok := counts[key]
+		if !ok {
+			c = &AccessCounts{}
+			counts[key] = c
+		}
+		c.Add(a)
+	})
+
+	entries := make(VariableEntries, 0, len(counts))
+	for name, c := range counts {
+		entries = append(entries, VariableEntry{name, c})
+	}
+	sort.Sort(entries)
+	if *top_n > 0 && len(entries) > *top_n {
+		entries = entries[:*top_n]
+	}
+
+	fmt.Printf("%d accesses, %d not to a known variable\n\n", total.Total(), unknown.Total())
+	fmt.Printf("  %12s %12s %12s %7s  %s\n", "total", "reads", "writes", "%", "variable")
+	for _, e := range entries {
+		c := e.Counts
+		fmt.Printf("  %12d %12d %12d %6.2f%%  %s\n", c.Total(), c.Reads, c.Writes,
+			percent(c.Total(), total.Total()), e.Name)
+	}
+}